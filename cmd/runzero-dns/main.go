@@ -204,77 +204,53 @@ func handleReflect(w dns.ResponseWriter, r *dns.Msg) {
 }
 
 func decodeAndLogTracer(ip string, port string, r *dns.Msg) (uint32, bool) {
-	var tracerDecodeKey uint32
-	encodedName := strings.SplitN(r.Question[0].Name[2:], ".", 2)
-	encodedBytes, err := hex.DecodeString(encodedName[0])
+	_, tracer, err := rnd.DecodeTracerName(r.Question[0].Name, helperDomain)
 	if err != nil {
 		log.Printf("%s:%s requested invalid tracer name %s wth XID %d (%s)", ip, port, r.Question[0].Name, r.Id, err)
-		return tracerDecodeKey, false
+		return 0, false
 	}
 
-	// [XXXX] [AAAABBBBCCCCDDDD] [YYYYZZZZ]
-	if len(encodedBytes) != 28 {
-		log.Printf("%s:%s requested invalid tracer name length %s wth XID %d", ip, port, r.Question[0].Name, r.Id)
-		return tracerDecodeKey, false
-	}
-
-	tracerDecodeKey = binary.BigEndian.Uint32(encodedBytes[0:4])
-	decodedBytes := rnd.XorBytesWithBytes(encodedBytes[4:], encodedBytes[0:4])
-	tracerIP := net.IP(decodedBytes[0:16])
-	tracerTS := binary.BigEndian.Uint64(decodedBytes[16:24])
-
-	log.Printf("%s:%s requested trace %s (type:%d/class:%d) with XID %d (ip:%s ts:%s)",
+	log.Printf("%s:%s requested trace %s (type:%d/class:%d) with XID %d (ip:%s ts:%s%s)",
 		ip, port, r.Question[0].Name, r.Question[0].Qtype, r.Question[0].Qclass, r.Id,
-		tracerIP.String(), time.Unix(0, int64(tracerTS)).UTC().String(),
+		tracer.IP.String(), tracer.Timestamp.UTC().String(), tracerExtra(tracer),
 	)
-	return tracerDecodeKey, true
+	return tracer.Key, true
 }
 
 func decodeAndLogAddress(ip string, port string, qname string, r *dns.Msg) (dns.RR, error) {
-	encodedName := strings.SplitN(qname, ".", 2)
-
-	if len(encodedName) != 2 {
-		return &dns.A{}, fmt.Errorf("invalid subdomain name (dots=%d)", len(encodedName))
-	}
-
-	if len(encodedName[0]) != 58 {
-		return &dns.A{}, fmt.Errorf("invalid subdomain length (%d)", len(encodedName[0]))
-	}
-
-	encodedBytes, err := hex.DecodeString(encodedName[0][2:])
+	_, tracer, err := rnd.DecodeTracerName(qname, helperDomain)
 	if err != nil {
 		return &dns.A{}, fmt.Errorf("invalid subdomain name (%s)", err)
 	}
 
-	// [XXXX] [AAAABBBBCCCCDDDD] [YYYYZZZZ]
-	if len(encodedBytes) != 28 {
-		return &dns.A{}, fmt.Errorf("invalid subdomain name length (%d): #%v", len(encodedBytes), encodedBytes)
-	}
-
-	decodedBytes := rnd.XorBytesWithBytes(encodedBytes[4:], encodedBytes[0:4])
-	tracerIP := net.IP(decodedBytes[0:16])
-	tracerTS := binary.BigEndian.Uint64(decodedBytes[16:24])
-
-	log.Printf("%s:%s requested referral %s (type:%d/class:%d) with XID %d (ip:%s ts:%s)",
+	log.Printf("%s:%s requested referral %s (type:%d/class:%d) with XID %d (ip:%s ts:%s%s)",
 		ip, port, qname, r.Question[0].Qtype, r.Question[0].Qclass, r.Id,
-		tracerIP.String(), time.Unix(0, int64(tracerTS)).UTC().String(),
+		tracer.IP.String(), tracer.Timestamp.UTC().String(), tracerExtra(tracer),
 	)
 
 	// Handle IPv4 referrals
-	if tracerIP.To4() != nil {
+	if tracer.IP.To4() != nil {
 		return &dns.A{
 			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-			A:   tracerIP,
+			A:   tracer.IP.To4(),
 		}, nil
 	}
 
 	// Handle IPv6 referrals
 	return &dns.AAAA{
-		Hdr:  dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
-		AAAA: tracerIP,
+		Hdr:  dns.RR_Header{Name: qname, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+		AAAA: tracer.IP,
 	}, nil
 }
 
+// tracerExtra formats the fields only present in versioned tracers for logging
+func tracerExtra(t *rnd.Tracer) string {
+	if t.Version == rnd.TracerVersionLegacy {
+		return ""
+	}
+	return fmt.Sprintf(" v:%d probe:%d scan:%.8x seq:%d", t.Version, t.ProbeType, t.ScanID, t.Sequence)
+}
+
 func serveDNS(net, name, secret string, soreuseport bool) {
 	switch name {
 	case "":
@@ -332,7 +308,7 @@ func main() {
 	go serveDNS("tcp", name, secret, false)
 	go serveDNS("udp", name, secret, false)
 
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sig
 	log.Printf("signal (%s) received, stopping", s)
@@ -0,0 +1,169 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// checkpointVersion identifies the layout of the checkpoint file
+const checkpointVersion = 2
+
+// checkpointState is everything needed to continue an interrupted scan. The walk over
+// the targets is deterministic for a given seed, so targets are identified by their
+// index in it: every index below Position is complete, as is every index in InFlight.
+// Results are not stored here; they are written to the output as each target completes,
+// and a resumed scan appends to the same output and continues the summary counts.
+type checkpointState struct {
+	Version      int                 `json:"version"`
+	Updated      time.Time           `json:"updated"`
+	Seed         int64               `json:"seed"`
+	Shard        uint64              `json:"shard,omitempty"`
+	Shards       uint64              `json:"shards,omitempty"`
+	ScanID       uint32              `json:"scan_id"`
+	Resolvers    []string            `json:"resolvers"`
+	Targets      []string            `json:"targets"`
+	Excludes     []string            `json:"excludes,omitempty"`
+	SkipClasses  []string            `json:"skip_classes,omitempty"`
+	OnlyClasses  []string            `json:"only_classes,omitempty"`
+	Resolved     map[string][]string `json:"resolved,omitempty"`
+	MaxAddresses uint64              `json:"max_addresses"`
+	SampleSize   uint64              `json:"sample_size"`
+	Output       string              `json:"output,omitempty"`
+	Format       string              `json:"format"`
+	Position     uint64              `json:"position"`
+	InFlight     []uint64            `json:"in_flight,omitempty"`
+	Summary      *summaryRecord      `json:"summary,omitempty"`
+}
+
+// loadCheckpoint reads a checkpoint written by save
+func loadCheckpoint(path string) (*checkpointState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &checkpointState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %s", path, err)
+	}
+	if state.Version != checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d in %s", state.Version, path)
+	}
+	return state, nil
+}
+
+// save writes the checkpoint to a temporary file and renames it over the path,
+// so an interruption while saving never leaves a truncated checkpoint behind
+func (c *checkpointState) save(path string) error {
+	c.Version = checkpointVersion
+	c.Updated = time.Now().UTC()
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// completedSet returns the indexes above Position that are already complete
+func (c *checkpointState) completedSet() map[uint64]bool {
+	done := make(map[uint64]bool, len(c.InFlight))
+	for _, index := range c.InFlight {
+		if index >= c.Position {
+			done[index] = true
+		}
+	}
+	return done
+}
+
+// scanProgress tracks which targets have results from every resolver and
+// advances the checkpoint position past the completed prefix of the walk
+type scanProgress struct {
+	state     *checkpointState
+	resolvers int
+	done      map[uint64]bool
+	partial   map[uint64][]probeResult
+}
+
+// newScanProgress continues from the position and completed indexes of the state
+func newScanProgress(state *checkpointState, resolvers int) *scanProgress {
+	return &scanProgress{
+		state:     state,
+		resolvers: resolvers,
+		done:      state.completedSet(),
+		partial:   make(map[uint64][]probeResult),
+	}
+}
+
+// record holds a result until every resolver has answered for its target, then returns
+// all of the target's results and marks it complete
+func (p *scanProgress) record(res probeResult) []probeResult {
+	results := append(p.partial[res.Index], res)
+	if len(results) < p.resolvers {
+		p.partial[res.Index] = results
+		return nil
+	}
+	delete(p.partial, res.Index)
+	p.complete(res.Index)
+	return results
+}
+
+// skip marks a target that will never have results, such as an invalid address, as complete
+func (p *scanProgress) skip(index uint64) {
+	delete(p.partial, index)
+	p.complete(index)
+}
+
+// complete marks the target complete and advances the position past the completed prefix
+func (p *scanProgress) complete(index uint64) {
+	p.done[index] = true
+	for p.done[p.state.Position] {
+		delete(p.done, p.state.Position)
+		p.state.Position++
+	}
+}
+
+// pending returns the results held for targets that some resolvers have not answered
+func (p *scanProgress) pending() []probeResult {
+	indexes := make([]uint64, 0, len(p.partial))
+	for index := range p.partial {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+
+	var results []probeResult
+	for _, index := range indexes {
+		results = append(results, p.partial[index]...)
+	}
+	return results
+}
+
+// save writes the checkpoint, which only grows with the number of targets completed out of order
+func (p *scanProgress) save(path string) error {
+	p.state.InFlight = p.state.InFlight[:0]
+	for index := range p.done {
+		p.state.InFlight = append(p.state.InFlight, index)
+	}
+	slices.Sort(p.state.InFlight)
+	return p.state.save(path)
+}
@@ -0,0 +1,111 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestScanProgressCheckpoint records results out of order across two resolvers, saves and
+// reloads the checkpoint, and checks that a resumed scan skips exactly the completed targets
+func TestScanProgressCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan.json")
+	state := &checkpointState{Seed: 1, Resolvers: []string{"a", "b"}, Targets: []string{"10.0.0.0/29"}}
+	progress := newScanProgress(state, 2)
+
+	steps := []struct {
+		index    uint64
+		resolver int
+		complete bool
+		position uint64
+	}{
+		{2, 1, false, 0},
+		{0, 1, false, 0},
+		{2, 0, true, 0},
+		{1, 0, false, 0},
+		{0, 0, true, 1},
+		{4, 1, false, 1},
+		{5, 0, false, 1},
+		{5, 1, true, 1},
+		{1, 1, true, 3},
+	}
+	for i, step := range steps {
+		results := progress.record(probeResult{Index: step.index, Resolver: step.resolver})
+		if complete := results != nil; complete != step.complete {
+			t.Fatalf("step %d: target %d complete is %v, want %v", i, step.index, complete, step.complete)
+		}
+		if step.complete && len(results) != 2 {
+			t.Fatalf("step %d: got %d results for target %d, want 2", i, len(results), step.index)
+		}
+		if state.Position != step.position {
+			t.Fatalf("step %d: position is %d, want %d", i, state.Position, step.position)
+		}
+	}
+
+	// Target 4 is waiting on resolver 0 and is left for the resumed scan
+	pending := progress.pending()
+	if len(pending) != 1 || pending[0].Index != 4 {
+		t.Fatalf("got pending %+v, want the result for target 4", pending)
+	}
+
+	if err := progress.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Position != 3 || !slices.Equal(loaded.InFlight, []uint64{5}) {
+		t.Fatalf("got position %d and in flight %v, want 3 and [5]", loaded.Position, loaded.InFlight)
+	}
+
+	// A resumed scan skips indexes below the position and those completed out of order
+	skip := loaded.completedSet()
+	var probed []uint64
+	for index := uint64(0); index < 8; index++ {
+		if index < loaded.Position || skip[index] {
+			continue
+		}
+		probed = append(probed, index)
+	}
+	if !slices.Equal(probed, []uint64{3, 4, 6, 7}) {
+		t.Errorf("resumed scan probes %v, want [3 4 6 7]", probed)
+	}
+
+	// Completing target 3 advances past the target completed before the interruption
+	resumed := newScanProgress(loaded, 2)
+	resumed.record(probeResult{Index: 3, Resolver: 0})
+	resumed.record(probeResult{Index: 3, Resolver: 1})
+	if loaded.Position != 4 {
+		t.Errorf("position after resuming is %d, want 4", loaded.Position)
+	}
+	resumed.skip(4)
+	if loaded.Position != 6 {
+		t.Errorf("position after skipping is %d, want 6", loaded.Position)
+	}
+}
+
+// TestScanProgressSkip checks that skipped targets advance the position like completed ones,
+// so an invalid address in the walk does not hold the checkpoint back
+func TestScanProgressSkip(t *testing.T) {
+	state := &checkpointState{}
+	progress := newScanProgress(state, 1)
+
+	progress.skip(1)
+	if state.Position != 0 {
+		t.Fatalf("position is %d before target 0 completes, want 0", state.Position)
+	}
+	progress.record(probeResult{Index: 0})
+	if state.Position != 2 {
+		t.Fatalf("position is %d, want 2", state.Position)
+	}
+	progress.skip(2)
+	if state.Position != 3 {
+		t.Fatalf("position is %d, want 3", state.Position)
+	}
+	if len(progress.pending()) != 0 {
+		t.Errorf("got pending results %+v", progress.pending())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Target classes assigned by a classifier
+const (
+	classAlive         = "alive"
+	classDead          = "dead"
+	classFiltered      = "filtered"
+	classIndeterminate = "indeterminate"
+)
+
+// latencyMinStdDev keeps a model with near-identical samples from rejecting everything else
+const latencyMinStdDev = 0.25
+
+// obsTimeout is the rcode category used for queries the resolver never answered
+const obsTimeout = -1
+
+// responseModel describes the rcodes and latencies seen for one calibration group
+type responseModel struct {
+	count     int
+	rcodes    map[int]int
+	latencies []float64
+	mean      float64
+	stddev    float64
+}
+
+// add records a calibration result in the model
+func (m *responseModel) add(res probeResult) {
+	if m.rcodes == nil {
+		m.rcodes = make(map[int]int)
+	}
+	m.count++
+	m.rcodes[observation(res)]++
+	if res.Err == nil {
+		m.latencies = append(m.latencies, math.Log(latencyMS(res.Latency)))
+	}
+}
+
+// fit calculates the mean and standard deviation of the log-latencies
+func (m *responseModel) fit() {
+	if len(m.latencies) == 0 {
+		return
+	}
+
+	sum := 0.0
+	for _, v := range m.latencies {
+		sum += v
+	}
+	m.mean = sum / float64(len(m.latencies))
+
+	variance := 0.0
+	for _, v := range m.latencies {
+		variance += (v - m.mean) * (v - m.mean)
+	}
+	m.stddev = math.Sqrt(variance / float64(len(m.latencies)))
+	if m.stddev < latencyMinStdDev {
+		m.stddev = latencyMinStdDev
+	}
+}
+
+// likelihood returns the probability of the observation under the model, using
+// Laplace smoothing over the categories so unseen rcodes are unlikely rather than impossible
+func (m *responseModel) likelihood(res probeResult, categories int) float64 {
+	obs := observation(res)
+	p := float64(m.rcodes[obs]+1) / float64(m.count+categories)
+
+	// Latency carries no information when the resolver never answered
+	if obs == obsTimeout || len(m.latencies) == 0 {
+		return p
+	}
+
+	z := (math.Log(latencyMS(res.Latency)) - m.mean) / m.stddev
+	return p * math.Exp(-0.5*z*z) / (m.stddev * math.Sqrt(2*math.Pi))
+}
+
+// describe summarizes the model for logging
+func (m *responseModel) describe() string {
+	top, topCount := obsTimeout, -1
+	for rcode, count := range m.rcodes {
+		if count > topCount {
+			top, topCount = rcode, count
+		}
+	}
+
+	rstr := "timeout"
+	if top != obsTimeout {
+		rstr = dns.RcodeToString[top]
+	}
+	if len(m.latencies) == 0 {
+		return fmt.Sprintf("%d samples, mostly %s", m.count, rstr)
+	}
+	return fmt.Sprintf("%d samples, mostly %s, median %.0fms", m.count, rstr, math.Exp(m.mean))
+}
+
+// classifier assigns a class and confidence to each probe result for one resolver,
+// using models built from probes of known-reachable and known-unroutable targets.
+type classifier struct {
+	reachable  responseModel
+	unroutable responseModel
+	threshold  float64
+}
+
+// calibrated returns true if both models have samples to compare against
+func (c *classifier) calibrated() bool {
+	return c.reachable.count > 0 && c.unroutable.count > 0
+}
+
+// fit finalizes the models after all calibration results are added
+func (c *classifier) fit() {
+	c.reachable.fit()
+	c.unroutable.fit()
+}
+
+// classify returns the class of the target and the confidence in that class.
+// Results that the unroutable model explains are dead if the resolver reported the
+// failure and filtered if the resolver never answered at all.
+func (c *classifier) classify(res probeResult) (string, float64) {
+	if res.Err != nil && !errors.Is(res.Err, errQueryTimeout) {
+		return classIndeterminate, 0
+	}
+	if res.Err == nil && res.Rcode == dns.RcodeRefused {
+		return classIndeterminate, 0
+	}
+
+	if !c.calibrated() {
+		switch {
+		case res.Err != nil:
+			return classFiltered, 0.5
+		case res.Rcode == dns.RcodeServerFailure:
+			return classAlive, 0.5
+		}
+		return classDead, 0.5
+	}
+
+	categories := make(map[int]bool)
+	for rcode := range c.reachable.rcodes {
+		categories[rcode] = true
+	}
+	for rcode := range c.unroutable.rcodes {
+		categories[rcode] = true
+	}
+	categories[observation(res)] = true
+
+	// A silence that neither calibration group produced is filtered somewhere past the resolver
+	if observation(res) == obsTimeout && c.reachable.rcodes[obsTimeout] == 0 && c.unroutable.rcodes[obsTimeout] == 0 {
+		return classFiltered, 1 - 1/float64(c.reachable.count+len(categories))
+	}
+
+	la := c.reachable.likelihood(res, len(categories))
+	lu := c.unroutable.likelihood(res, len(categories))
+	if la+lu == 0 {
+		return classIndeterminate, 0
+	}
+
+	pa := la / (la + lu)
+	switch {
+	case pa >= c.threshold:
+		return classAlive, pa
+	case 1-pa >= c.threshold && res.Err != nil:
+		return classFiltered, 1 - pa
+	case 1-pa >= c.threshold:
+		return classDead, 1 - pa
+	}
+	return classIndeterminate, math.Max(pa, 1-pa)
+}
+
+// observation returns the rcode of the result, or obsTimeout if there was no reply
+func observation(res probeResult) int {
+	if res.Err != nil {
+		return obsTimeout
+	}
+	return res.Rcode
+}
+
+// latencyMS converts a latency to fractional milliseconds, with a floor to keep logs finite
+func latencyMS(d time.Duration) float64 {
+	ms := float64(d) / float64(time.Millisecond)
+	if ms < 0.01 {
+		ms = 0.01
+	}
+	return ms
+}
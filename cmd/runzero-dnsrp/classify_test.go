@@ -0,0 +1,190 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reply returns a result for an answer with the rcode after the latency
+func reply(rcode int, latency time.Duration) probeResult {
+	return probeResult{Rcode: rcode, Latency: latency}
+}
+
+// noReply returns a result for a query the resolver never answered
+func noReply() probeResult {
+	return probeResult{Err: errQueryTimeout, Latency: time.Second}
+}
+
+// newTestClassifier returns a fitted classifier with the calibration results
+func newTestClassifier(threshold float64, reachable, unroutable []probeResult) *classifier {
+	c := &classifier{threshold: threshold}
+	for _, res := range reachable {
+		c.reachable.add(res)
+	}
+	for _, res := range unroutable {
+		c.unroutable.add(res)
+	}
+	c.fit()
+	return c
+}
+
+// repeat returns n copies of the result
+func repeat(res probeResult, n int) []probeResult {
+	out := make([]probeResult, n)
+	for i := range out {
+		out[i] = res
+	}
+	return out
+}
+
+// TestClassifierUncalibrated checks the fallback classes used when either calibration group
+// is empty, and the results that are never classified
+func TestClassifierUncalibrated(t *testing.T) {
+	c := newTestClassifier(0.8, repeat(reply(dns.RcodeServerFailure, 100*time.Millisecond), 4), nil)
+	tests := []struct {
+		name       string
+		res        probeResult
+		class      string
+		confidence float64
+	}{
+		{"servfail", reply(dns.RcodeServerFailure, 100*time.Millisecond), classAlive, 0.5},
+		{"nxdomain", reply(dns.RcodeNameError, 10*time.Millisecond), classDead, 0.5},
+		{"timeout", noReply(), classFiltered, 0.5},
+		{"refused", reply(dns.RcodeRefused, 10*time.Millisecond), classIndeterminate, 0},
+		{"send error", probeResult{Err: errors.New("network is unreachable")}, classIndeterminate, 0},
+	}
+	for _, tt := range tests {
+		class, confidence := c.classify(tt.res)
+		if class != tt.class || confidence != tt.confidence {
+			t.Errorf("%s: got %s (%.3f), want %s (%.3f)", tt.name, class, confidence, tt.class, tt.confidence)
+		}
+	}
+}
+
+// TestClassifierRcodes checks each class against calibration groups that differ in rcode and
+// latency, where the outcome is clear
+func TestClassifierRcodes(t *testing.T) {
+	reachable := repeat(reply(dns.RcodeServerFailure, 100*time.Millisecond), 10)
+	tests := []struct {
+		name       string
+		unroutable []probeResult
+		res        probeResult
+		class      string
+		confidence float64
+	}{
+		{
+			"alive", repeat(reply(dns.RcodeNameError, 10*time.Millisecond), 10),
+			reply(dns.RcodeServerFailure, 100*time.Millisecond), classAlive, 0.99,
+		},
+		{
+			"dead", repeat(reply(dns.RcodeNameError, 10*time.Millisecond), 10),
+			reply(dns.RcodeNameError, 10*time.Millisecond), classDead, 0.99,
+		},
+		{
+			"filtered like unroutable", append(repeat(reply(dns.RcodeNameError, 10*time.Millisecond), 5), repeat(noReply(), 5)...),
+			noReply(), classFiltered, 0.85,
+		},
+		{
+			// Neither group timed out, so the confidence is 1 - 1/(10 reachable + 3 categories)
+			"filtered unlike either", repeat(reply(dns.RcodeNameError, 10*time.Millisecond), 10),
+			noReply(), classFiltered, 1 - 1.0/13,
+		},
+		{
+			"refused", repeat(reply(dns.RcodeNameError, 10*time.Millisecond), 10),
+			reply(dns.RcodeRefused, 10*time.Millisecond), classIndeterminate, 0,
+		},
+		{
+			"send error", repeat(reply(dns.RcodeNameError, 10*time.Millisecond), 10),
+			probeResult{Err: errors.New("network is unreachable")}, classIndeterminate, 0,
+		},
+	}
+	for _, tt := range tests {
+		c := newTestClassifier(0.8, reachable, tt.unroutable)
+		class, confidence := c.classify(tt.res)
+		if class != tt.class || confidence < tt.confidence || confidence > 1 {
+			t.Errorf("%s: got %s (%.3f), want %s (at least %.3f)", tt.name, class, confidence, tt.class, tt.confidence)
+		}
+	}
+}
+
+// TestClassifierLatencyBoundaries uses calibration groups with the same rcode, so only the
+// latency separates them, and checks the class either side of the confidence boundaries.
+// Both groups have the minimum standard deviation, so the log-likelihood ratio is linear in
+// the log-latency and the boundary for a confidence p is at
+// (mean_a + mean_u)/2 + ln(p/(1-p)) * stddev^2 / (mean_a - mean_u)
+func TestClassifierLatencyBoundaries(t *testing.T) {
+	reachable := repeat(reply(dns.RcodeServerFailure, 100*time.Millisecond), 10)
+	unroutable := repeat(reply(dns.RcodeServerFailure, 10*time.Millisecond), 10)
+
+	meanA, meanU := math.Log(100), math.Log(10)
+	boundary := func(p float64) time.Duration {
+		x := (meanA+meanU)/2 + math.Log(p/(1-p))*latencyMinStdDev*latencyMinStdDev/(meanA-meanU)
+		return time.Duration(math.Exp(x) * float64(time.Millisecond))
+	}
+	above := func(d time.Duration) time.Duration { return d + d/1000 }
+	below := func(d time.Duration) time.Duration { return d - d/1000 }
+
+	tests := []struct {
+		name      string
+		threshold float64
+		latency   time.Duration
+		class     string
+	}{
+		{"reachable mean", 0.8, 100 * time.Millisecond, classAlive},
+		{"unroutable mean", 0.8, 10 * time.Millisecond, classDead},
+		{"midpoint", 0.8, boundary(0.5), classIndeterminate},
+		{"above alive boundary", 0.8, above(boundary(0.8)), classAlive},
+		{"below alive boundary", 0.8, below(boundary(0.8)), classIndeterminate},
+		{"below dead boundary", 0.8, below(boundary(0.2)), classDead},
+		{"above dead boundary", 0.8, above(boundary(0.2)), classIndeterminate},
+
+		// The -confidence threshold moves the boundaries
+		{"lower threshold", 0.6, below(boundary(0.8)), classAlive},
+		{"higher threshold", 0.95, above(boundary(0.8)), classIndeterminate},
+		{"above higher boundary", 0.95, above(boundary(0.95)), classAlive},
+		{"below lower dead boundary", 0.6, below(boundary(0.4)), classDead},
+		{"above lower dead boundary", 0.6, above(boundary(0.4)), classIndeterminate},
+	}
+	for _, tt := range tests {
+		c := newTestClassifier(tt.threshold, reachable, unroutable)
+		class, confidence := c.classify(reply(dns.RcodeServerFailure, tt.latency))
+		if class != tt.class {
+			t.Errorf("%s: %s classified as %s (%.3f), want %s", tt.name, tt.latency, class, confidence, tt.class)
+		}
+		if confidence < 0.5 || confidence > 1 {
+			t.Errorf("%s: confidence %.3f out of range", tt.name, confidence)
+		}
+	}
+}
+
+// TestResponseModelFit checks the log-latency statistics and the standard deviation floor
+func TestResponseModelFit(t *testing.T) {
+	var m responseModel
+	for _, ms := range []time.Duration{10, 1000} {
+		m.add(reply(dns.RcodeNameError, ms*time.Millisecond))
+	}
+	m.add(noReply())
+	m.fit()
+
+	if m.count != 3 || m.rcodes[dns.RcodeNameError] != 2 || m.rcodes[obsTimeout] != 1 {
+		t.Errorf("got count %d and rcodes %v", m.count, m.rcodes)
+	}
+	// The log-latencies are ln 10 either side of ln 100
+	if math.Abs(m.mean-math.Log(100)) > 1e-9 || math.Abs(m.stddev-math.Log(10)) > 1e-9 {
+		t.Errorf("got mean %.3f and stddev %.3f, want %.3f and %.3f", m.mean, m.stddev, math.Log(100), math.Log(10))
+	}
+
+	var flat responseModel
+	flat.add(reply(dns.RcodeNameError, 5*time.Millisecond))
+	flat.add(reply(dns.RcodeNameError, 5*time.Millisecond))
+	flat.fit()
+	if flat.stddev != latencyMinStdDev {
+		t.Errorf("got stddev %.3f for identical samples, want %.3f", flat.stddev, latencyMinStdDev)
+	}
+}
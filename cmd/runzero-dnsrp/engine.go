@@ -0,0 +1,355 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/runZeroInc/runzero-tools/pkg/rnd"
+)
+
+// errQueryTimeout is returned when no matching reply arrives after all retries
+var errQueryTimeout = errors.New("query timeout")
+
+// engineSocketBuffer is the requested kernel buffer size for each socket
+const engineSocketBuffer = 4 * 1024 * 1024
+
+// engineConfig controls the sockets, send rate, and retry behavior of a queryEngine
+type engineConfig struct {
+	Sockets  int
+	Rate     int
+	InFlight int
+	Timeout  time.Duration
+	Retries  int
+	// Random seeds the XIDs (nil for crypto/rand)
+	Random io.Reader
+}
+
+// queryResult is delivered exactly once for every query submitted to the engine
+type queryResult struct {
+	Query    *dns.Msg
+	Reply    *dns.Msg
+	Server   *net.UDPAddr
+	RTT      time.Duration
+	Attempts int
+	Err      error
+}
+
+// pendingQuery tracks an in-flight query until it is answered or expires
+type pendingQuery struct {
+	ctx      context.Context
+	sock     int
+	query    *dns.Msg
+	packed   []byte
+	server   *net.UDPAddr
+	sent     time.Time
+	deadline time.Time
+	attempts int
+	callback func(queryResult)
+}
+
+// queryEngine sends DNS queries from a small pool of UDP sockets at a fixed rate,
+// matching replies to queries by socket, XID, source, and question.
+type queryEngine struct {
+	cfg      engineConfig
+	conns    []*net.UDPConn
+	sendq    chan *pendingQuery
+	slots    chan struct{}
+	pending  []map[uint16]*pendingQuery
+	nextSock int
+	xids     *rand.Rand
+	mu       sync.Mutex
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newQueryEngine opens the sockets and starts the sender, readers, and timeout sweeper
+func newQueryEngine(cfg engineConfig) (*queryEngine, error) {
+	if cfg.Sockets < 1 {
+		cfg.Sockets = 1
+	}
+	if cfg.InFlight < 1 {
+		cfg.InFlight = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 5
+	}
+
+	xids, err := rnd.NewMathRand(cfg.Random)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &queryEngine{
+		cfg:   cfg,
+		sendq: make(chan *pendingQuery, cfg.InFlight),
+		slots: make(chan struct{}, cfg.InFlight),
+		xids:  xids,
+		done:  make(chan struct{}),
+	}
+
+	for i := 0; i < cfg.Sockets; i++ {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			e.closeConns()
+			return nil, err
+		}
+		// Large buffers absorb reply bursts when thousands of queries are in flight
+		conn.SetReadBuffer(engineSocketBuffer)
+		conn.SetWriteBuffer(engineSocketBuffer)
+		e.conns = append(e.conns, conn)
+		e.pending = append(e.pending, make(map[uint16]*pendingQuery))
+	}
+
+	e.wg.Add(2 + len(e.conns))
+	go e.sender()
+	go e.sweeper()
+	for i := range e.conns {
+		go e.reader(i)
+	}
+
+	return e, nil
+}
+
+// Submit queues a query to the server, blocking while the in-flight limit is reached.
+// The callback is invoked from an engine goroutine once the query completes. Queries
+// still waiting to be sent when the context is cancelled complete with its error.
+func (e *queryEngine) Submit(ctx context.Context, server *net.UDPAddr, m *dns.Msg, callback func(queryResult)) error {
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.done:
+		return net.ErrClosed
+	}
+
+	pq := &pendingQuery{ctx: ctx, query: m, server: server, callback: callback}
+
+	e.mu.Lock()
+	pq.sock = e.nextSock
+	e.nextSock = (e.nextSock + 1) % len(e.conns)
+
+	m.Id = e.newXID(pq.sock)
+	packed, err := m.Pack()
+	if err != nil {
+		e.mu.Unlock()
+		<-e.slots
+		return err
+	}
+	pq.packed = packed
+	e.pending[pq.sock][m.Id] = pq
+	e.mu.Unlock()
+
+	e.sendq <- pq
+	return nil
+}
+
+// newXID returns an XID that is not in use on the socket, with the lock held
+func (e *queryEngine) newXID(sock int) uint16 {
+	for {
+		id := uint16(e.xids.Uint32())
+		if _, ok := e.pending[sock][id]; !ok {
+			return id
+		}
+	}
+}
+
+// Close stops the engine, abandoning any queries still in flight
+func (e *queryEngine) Close() {
+	close(e.done)
+	e.closeConns()
+	e.wg.Wait()
+}
+
+func (e *queryEngine) closeConns() {
+	for _, conn := range e.conns {
+		conn.Close()
+	}
+}
+
+// sender writes queued packets, pacing them to the configured rate
+func (e *queryEngine) sender() {
+	defer e.wg.Done()
+
+	var interval time.Duration
+	if e.cfg.Rate > 0 {
+		interval = time.Second / time.Duration(e.cfg.Rate)
+	}
+
+	start := time.Now()
+	var count int64
+	for {
+		var pq *pendingQuery
+		select {
+		case <-e.done:
+			return
+		case pq = <-e.sendq:
+		}
+
+		if pq.attempts == 0 && pq.ctx.Err() != nil {
+			if e.remove(pq) {
+				e.finish(pq, queryResult{Err: pq.ctx.Err()})
+			}
+			continue
+		}
+
+		// Sleep until this packet's slot in the schedule, bursting to catch up if behind
+		if interval > 0 {
+			next := start.Add(interval * time.Duration(count))
+			if wait := time.Until(next); wait > 0 {
+				time.Sleep(wait)
+			} else if wait < -time.Second {
+				start = time.Now()
+				count = 0
+			}
+			count++
+		}
+
+		e.mu.Lock()
+		if e.pending[pq.sock][pq.query.Id] != pq {
+			// Answered while waiting for a retransmit
+			e.mu.Unlock()
+			continue
+		}
+		pq.attempts++
+		pq.sent = time.Now()
+		pq.deadline = pq.sent.Add(e.cfg.Timeout)
+		e.mu.Unlock()
+
+		if _, err := e.conns[pq.sock].WriteToUDP(pq.packed, pq.server); err != nil {
+			if e.remove(pq) {
+				e.finish(pq, queryResult{Err: err})
+			}
+		}
+	}
+}
+
+// reader matches replies received on a socket with pending queries
+func (e *queryEngine) reader(sock int) {
+	defer e.wg.Done()
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := e.conns[sock].ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-e.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		now := time.Now()
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		e.mu.Lock()
+		pq, ok := e.pending[sock][reply.Id]
+		if !ok || !pq.server.IP.Equal(from.IP) || pq.server.Port != from.Port || !sameQuestion(pq.query, reply) {
+			e.mu.Unlock()
+			continue
+		}
+		delete(e.pending[sock], reply.Id)
+		rtt := now.Sub(pq.sent)
+		e.mu.Unlock()
+
+		e.finish(pq, queryResult{Reply: reply, RTT: rtt})
+	}
+}
+
+// sweeper retransmits or fails queries whose deadline has passed
+func (e *queryEngine) sweeper() {
+	defer e.wg.Done()
+
+	tick := e.cfg.Timeout / 10
+	if tick < time.Millisecond*10 {
+		tick = time.Millisecond * 10
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		retry := []*pendingQuery{}
+		expired := []*pendingQuery{}
+
+		e.mu.Lock()
+		for _, pending := range e.pending {
+			for id, pq := range pending {
+				if pq.deadline.IsZero() || now.Before(pq.deadline) {
+					continue
+				}
+				if pq.attempts <= e.cfg.Retries {
+					pq.deadline = time.Time{}
+					retry = append(retry, pq)
+					continue
+				}
+				delete(pending, id)
+				expired = append(expired, pq)
+			}
+		}
+		e.mu.Unlock()
+
+		// The send queue holds one entry per slot, so requeueing never blocks
+		for _, pq := range retry {
+			e.sendq <- pq
+		}
+		for _, pq := range expired {
+			e.finish(pq, queryResult{Err: errQueryTimeout, RTT: now.Sub(pq.sent)})
+		}
+	}
+}
+
+// remove deletes a pending query, returning false if it already completed
+func (e *queryEngine) remove(pq *pendingQuery) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending[pq.sock][pq.query.Id] != pq {
+		return false
+	}
+	delete(e.pending[pq.sock], pq.query.Id)
+	return true
+}
+
+// finish releases the in-flight slot and delivers the result
+func (e *queryEngine) finish(pq *pendingQuery, res queryResult) {
+	<-e.slots
+	res.Query = pq.query
+	res.Server = pq.server
+	res.Attempts = pq.attempts
+	pq.callback(res)
+}
+
+// sameQuestion verifies that a reply answers the question that was asked
+func sameQuestion(query *dns.Msg, reply *dns.Msg) bool {
+	if len(query.Question) != len(reply.Question) {
+		return false
+	}
+	for i, q := range query.Question {
+		r := reply.Question[i]
+		if q.Qtype != r.Qtype || q.Qclass != r.Qclass || !strings.EqualFold(q.Name, r.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,431 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startResolver runs a stand-in resolver on 127.0.0.1 that answers every query with NXDOMAIN
+func startResolver(tb testing.TB) *net.UDPAddr {
+	tb.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %s", err)
+	}
+	// Match the engine's buffers so bursts are not dropped by the stand-in
+	pc.(*net.UDPConn).SetReadBuffer(engineSocketBuffer)
+	pc.(*net.UDPConn).SetWriteBuffer(engineSocketBuffer)
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	tb.Cleanup(func() { srv.Shutdown() })
+
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// benchmarkQuery returns a distinct query for each iteration, like the tracer names of a scan
+func benchmarkQuery(i int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(fmt.Sprintf("s0%.8x.helper.example.", i), dns.TypeA)
+	return m
+}
+
+// BenchmarkQueryEngine measures queries answered per second through the engine
+func BenchmarkQueryEngine(b *testing.B) {
+	server := startResolver(b)
+
+	engine, err := newQueryEngine(engineConfig{
+		Sockets:  4,
+		InFlight: 1024,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		b.Fatalf("engine: %s", err)
+	}
+	defer engine.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wg.Add(1)
+		err := engine.Submit(ctx, server, benchmarkQuery(i), func(qr queryResult) {
+			defer wg.Done()
+			if qr.Err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		})
+		if err != nil {
+			b.Fatalf("submit: %s", err)
+		}
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	if failed > 0 {
+		b.Logf("%d of %d queries failed", failed, b.N)
+	}
+}
+
+// BenchmarkExchange is the baseline of one blocking dns.Exchange per query, as dnsrp sent
+// them before the query engine
+func BenchmarkExchange(b *testing.B) {
+	server := startResolver(b)
+	client := &dns.Client{Timeout: time.Second * 2}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := client.Exchange(benchmarkQuery(i), server.String()); err != nil {
+			b.Fatalf("exchange: %s", err)
+		}
+	}
+}
+
+// responder is a stand-in resolver on 127.0.0.1 whose handler decides how to answer, or not
+// answer, each query it receives
+type responder struct {
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+// startResponder runs a responder, calling handle with the number of times the query name has
+// been received, including this one
+func startResponder(t *testing.T, handle func(r *responder, from *net.UDPAddr, q *dns.Msg, attempt int)) *responder {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	r := &responder{conn: conn, attempts: make(map[string]int)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil || len(q.Question) != 1 {
+				continue
+			}
+			r.mu.Lock()
+			r.attempts[q.Question[0].Name]++
+			attempt := r.attempts[q.Question[0].Name]
+			r.mu.Unlock()
+			handle(r, from, q, attempt)
+		}
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return r
+}
+
+// addr returns the address queries should be sent to
+func (r *responder) addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// received returns the number of times a query name was received
+func (r *responder) received(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts[name]
+}
+
+// answer sends an NXDOMAIN reply to a query from the responder's socket
+func (r *responder) answer(to *net.UDPAddr, q *dns.Msg) {
+	r.send(r.conn, to, nxdomain(q))
+}
+
+// send writes a reply from a socket
+func (r *responder) send(conn *net.UDPConn, to *net.UDPAddr, m *dns.Msg) {
+	if packed, err := m.Pack(); err == nil {
+		conn.WriteToUDP(packed, to)
+	}
+}
+
+// nxdomain returns an NXDOMAIN reply to a query
+func nxdomain(q *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(q, dns.RcodeNameError)
+	return m
+}
+
+// submitWait submits a query and waits for its result
+func submitWait(t *testing.T, e *queryEngine, server *net.UDPAddr, m *dns.Msg) queryResult {
+	t.Helper()
+	results := make(chan queryResult, 1)
+	if err := e.Submit(context.Background(), server, m, func(qr queryResult) { results <- qr }); err != nil {
+		t.Fatalf("submit: %s", err)
+	}
+	select {
+	case qr := <-results:
+		return qr
+	case <-time.After(time.Second * 5):
+		t.Fatal("query never completed")
+		return queryResult{}
+	}
+}
+
+// testQuery returns a query for a name
+func testQuery(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	return m
+}
+
+// newTestEngine returns an engine with a short timeout that is closed when the test ends
+func newTestEngine(t *testing.T, cfg engineConfig) *queryEngine {
+	t.Helper()
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Millisecond * 50
+	}
+	e, err := newQueryEngine(cfg)
+	if err != nil {
+		t.Fatalf("engine: %s", err)
+	}
+	t.Cleanup(e.Close)
+	return e
+}
+
+// TestQueryEngineRetransmit checks that unanswered queries are sent again until the retries run
+// out, that a slow reply within the timeout is accepted, and that the result reports the number
+// of attempts
+func TestQueryEngineRetransmit(t *testing.T) {
+	tests := []struct {
+		name     string
+		answerOn int
+		delay    time.Duration
+		retries  int
+		attempts int
+		err      error
+	}{
+		{"first.example.", 1, 0, 2, 1, nil},
+		{"slow.example.", 1, time.Millisecond * 30, 2, 1, nil},
+		{"third.example.", 3, 0, 2, 3, nil},
+		{"never.example.", 0, 0, 2, 3, errQueryTimeout},
+		{"noretry.example.", 2, 0, 0, 1, errQueryTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := startResponder(t, func(r *responder, from *net.UDPAddr, q *dns.Msg, attempt int) {
+				if attempt == tt.answerOn {
+					time.Sleep(tt.delay)
+					r.answer(from, q)
+				}
+			})
+			e := newTestEngine(t, engineConfig{Retries: tt.retries, Timeout: time.Millisecond * 100})
+
+			qr := submitWait(t, e, r.addr(), testQuery(tt.name))
+			if !errors.Is(qr.Err, tt.err) {
+				t.Fatalf("got error %v, want %v", qr.Err, tt.err)
+			}
+			if qr.Attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", qr.Attempts, tt.attempts)
+			}
+			if got := r.received(tt.name); got != tt.attempts {
+				t.Errorf("responder received %d queries, want %d", got, tt.attempts)
+			}
+			if tt.err == nil && (qr.Reply == nil || qr.Reply.Rcode != dns.RcodeNameError || qr.RTT < tt.delay) {
+				t.Errorf("got reply %v with RTT %s", qr.Reply, qr.RTT)
+			}
+			if qr.Server.String() != r.addr().String() || qr.Query.Question[0].Name != tt.name {
+				t.Errorf("result is for %s %v", qr.Server, qr.Query.Question)
+			}
+		})
+	}
+}
+
+// TestQueryEngineMismatchedReplies checks that replies with the wrong XID, source, or question
+// are dropped, and that a matching reply arriving after them is still accepted
+func TestQueryEngineMismatchedReplies(t *testing.T) {
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	tests := []struct {
+		name    string
+		reply   func(r *responder, from *net.UDPAddr, q *dns.Msg)
+		matches bool
+	}{
+		{"wrong-xid.example.", func(r *responder, from *net.UDPAddr, q *dns.Msg) {
+			m := nxdomain(q)
+			m.Id++
+			r.send(r.conn, from, m)
+		}, false},
+		{"wrong-source.example.", func(r *responder, from *net.UDPAddr, q *dns.Msg) {
+			r.send(other, from, nxdomain(q))
+		}, false},
+		{"wrong-name.example.", func(r *responder, from *net.UDPAddr, q *dns.Msg) {
+			m := nxdomain(q)
+			m.Question[0].Name = "other.example."
+			r.send(r.conn, from, m)
+		}, false},
+		{"wrong-type.example.", func(r *responder, from *net.UDPAddr, q *dns.Msg) {
+			m := nxdomain(q)
+			m.Question[0].Qtype = dns.TypeAAAA
+			r.send(r.conn, from, m)
+		}, false},
+		{"no-question.example.", func(r *responder, from *net.UDPAddr, q *dns.Msg) {
+			m := nxdomain(q)
+			m.Question = nil
+			r.send(r.conn, from, m)
+		}, false},
+		{"MIXED-Case.example.", func(r *responder, from *net.UDPAddr, q *dns.Msg) {
+			m := nxdomain(q)
+			m.Question[0].Name = "mixed-case.EXAMPLE."
+			r.send(r.conn, from, m)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, thenAnswer := range []bool{false, true} {
+				r := startResponder(t, func(r *responder, from *net.UDPAddr, q *dns.Msg, attempt int) {
+					tt.reply(r, from, q)
+					if thenAnswer {
+						r.answer(from, q)
+					}
+				})
+				e := newTestEngine(t, engineConfig{})
+
+				qr := submitWait(t, e, r.addr(), testQuery(tt.name))
+				if tt.matches || thenAnswer {
+					if qr.Err != nil || qr.Reply == nil || qr.Reply.Id != qr.Query.Id {
+						t.Errorf("answered %t: got reply %v with error %v", thenAnswer, qr.Reply, qr.Err)
+					}
+				} else if !errors.Is(qr.Err, errQueryTimeout) {
+					t.Errorf("got reply %v with error %v, want a timeout", qr.Reply, qr.Err)
+				}
+			}
+		})
+	}
+}
+
+// TestQueryEngineCancelled checks that queries still waiting to be sent when their context is
+// cancelled complete with the context's error and are never sent
+func TestQueryEngineCancelled(t *testing.T) {
+	r := startResponder(t, func(r *responder, from *net.UDPAddr, q *dns.Msg, attempt int) {
+		r.answer(from, q)
+	})
+	// At 5 queries per second, the third query is only taken from the queue after 200ms
+	e := newTestEngine(t, engineConfig{Rate: 5, InFlight: 3, Timeout: time.Second})
+
+	results := make(chan queryResult, 3)
+	callback := func(qr queryResult) { results <- qr }
+	ctx, cancel := context.WithCancel(context.Background())
+	for i, name := range []string{"first.example.", "second.example.", "cancelled.example."} {
+		qctx := context.Background()
+		if i == 2 {
+			qctx = ctx
+		}
+		if err := e.Submit(qctx, r.addr(), testQuery(name), callback); err != nil {
+			t.Fatalf("submit %s: %s", name, err)
+		}
+	}
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		var qr queryResult
+		select {
+		case qr = <-results:
+		case <-time.After(time.Second * 5):
+			t.Fatal("query never completed")
+		}
+		name := qr.Query.Question[0].Name
+		if name != "cancelled.example." {
+			if qr.Err != nil {
+				t.Errorf("%s: %s", name, qr.Err)
+			}
+			continue
+		}
+		if !errors.Is(qr.Err, context.Canceled) || qr.Attempts != 0 {
+			t.Errorf("%s: got error %v after %d attempts", name, qr.Err, qr.Attempts)
+		}
+	}
+	if got := r.received("cancelled.example."); got != 0 {
+		t.Errorf("the cancelled query was sent %d times", got)
+	}
+}
+
+// TestQueryEngineInFlightLimit checks that Submit blocks while the in-flight limit is reached and
+// continues once a query completes
+func TestQueryEngineInFlightLimit(t *testing.T) {
+	release := make(chan struct{})
+	r := startResponder(t, func(r *responder, from *net.UDPAddr, q *dns.Msg, attempt int) {
+		go func() {
+			<-release
+			r.answer(from, q)
+		}()
+	})
+	e := newTestEngine(t, engineConfig{InFlight: 2, Timeout: time.Second * 5})
+
+	var wg sync.WaitGroup
+	submit := func(ctx context.Context, name string) error {
+		wg.Add(1)
+		err := e.Submit(ctx, r.addr(), testQuery(name), func(qr queryResult) {
+			defer wg.Done()
+			if qr.Err != nil {
+				t.Errorf("%s: %s", name, qr.Err)
+			}
+		})
+		if err != nil {
+			wg.Done()
+		}
+		return err
+	}
+
+	for _, name := range []string{"one.example.", "two.example."} {
+		if err := submit(context.Background(), name); err != nil {
+			t.Fatalf("submit %s: %s", name, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := submit(ctx, "blocked.example."); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("submit beyond the limit: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	if err := submit(context.Background(), "three.example."); err != nil {
+		t.Fatalf("submit after release: %s", err)
+	}
+	wg.Wait()
+
+	if got := r.received("blocked.example."); got != 0 {
+		t.Errorf("the blocked query was sent %d times", got)
+	}
+}
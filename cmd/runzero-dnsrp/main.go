@@ -10,23 +10,89 @@ Use a runzero DNS server to identify hosts reachable by an open resolver.
 Usage:
 
 $ runzero-dnsrp -quiet 192.168.0.3 192.168.30.0/24
-192.168.30.29              alive via 192.168.0.3:53                60ms       code:2
-192.168.30.34              alive via 192.168.0.3:53                69ms       code:2
-192.168.30.143             alive via 192.168.0.3:53               267ms       code:2
+calibration: 192.168.0.3:53: reachable 5 samples, mostly SERVFAIL, median 4ms; unroutable 15 samples, mostly timeout
+192.168.30.29                alive via 192.168.0.3:53                60ms 0.97  code:2
+192.168.30.34                alive via 192.168.0.3:53                69ms 0.97  code:2
+192.168.30.143               alive via 192.168.0.3:53               267ms 0.91  code:2
+ipv4                        3/256      alive via 192.168.0.3:53
+
+Before the sweep, each resolver is calibrated by probing targets it can certainly reach
+(itself, plus -calibrate-reachable) and targets it certainly cannot (-calibrate-unroutable).
+The rcodes and latencies of those probes are modelled and every target is classified as
+alive, dead, filtered (the resolver never answered), or indeterminate, with a confidence.
+
+IPv6 targets are supported as well. Target sets larger than -max-addresses are rejected
+unless -sample is used to probe a random subset of them:
+
+$ runzero-dnsrp -quiet -sample 4096 192.168.0.3 fd00:1234::/64
+
+Targets may be CIDRs, addresses, dash ranges, or hostnames (resolved once), given as
+arguments or with -target-file. Overlapping targets are only probed once, and anything
+matching -exclude or -exclude-file is skipped:
+
+$ runzero-dnsrp -exclude 10.0.8.0/24 192.168.0.3 10.0.0.0/16,10.1.0.5-10.1.0.90
+
+Targets are also filtered by their special-purpose address class. Multicast and broadcast
+addresses are skipped unless -skip-classes is changed, and -only-classes limits probes to
+classes such as private or cgnat.
+
+Targets are probed in a random order derived from -seed. Scanners sharing a seed can
+split the targets between them with -shard, each probing a disjoint part:
+
+$ runzero-dnsrp -seed 1234 -shard 0/2 192.168.0.3 10.0.0.0/8
+$ runzero-dnsrp -seed 1234 -shard 1/2 192.168.10.3 10.0.0.0/8
+
+Several resolvers can be swept at once, either as a comma-separated list or with
+-resolver-file (one per line, in which case every argument is a target). The same
+targets are probed through each resolver and a reachability matrix is printed:
+
+$ runzero-dnsrp -quiet 192.168.0.3,192.168.10.3 192.168.30.0/24
+...
+resolvers:
+  r1 = 192.168.0.3:53
+  r2 = 192.168.10.3:53
+
+target               r1     r2
+192.168.30.29        alive  -
+192.168.30.34        alive  alive
+
+The -format flag selects text, json (one object per line), or csv output, and -output
+writes the results to a file. Structured records include the tracer name, rcode,
+latency, error class, and decode key, followed by a summary of outcome counts.
+
+Probes carry versioned tracers that include the scan ID and sequence number. A runzero-dns
+server built before the versioned format only accepts the original 28-byte tracers, and
+silently ignores the newer ones, so either upgrade the server first or use -tracer-version 0.
+
+Long sweeps can be checkpointed with -checkpoint, which saves the seed of the target
+walk, the position reached, and the summary counts. Results are written to the output
+as each target completes, so checkpointed scans should use -output. An interrupted scan
+prints a partial summary and continues from the checkpoint with -resume, which appends
+the remaining results and a final summary to the same output file. The reachability
+matrix of a resumed scan only covers the targets probed after resuming.
+
+$ runzero-dnsrp -checkpoint scan.json -format json -output scan.jsonl 192.168.0.3 10.0.0.0/8
+^C
+$ runzero-dnsrp -resume scan.json
 
 */
 
 package main
 
 import (
-	"encoding/hex"
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"math/rand"
+	"math/big"
+	"math/rand/v2"
 	"net"
 	"os"
-	"runtime"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/runZeroInc/runzero-tools/pkg/rnd"
@@ -35,21 +101,85 @@ import (
 )
 
 var (
-	port      = flag.Int("port", 53, "port number to send queries to")
-	threads   = flag.Int("threads", runtime.NumCPU(), "number of parallel threads")
-	subdomain = flag.String("subdomain", "helper.rumble.network", "subdomain handled by runzero-dns")
-	quiet     = flag.Bool("quiet", false, "quiet mode, only show positive results")
-	help      = flag.Bool("help", false, "show usage information")
-	h         = flag.Bool("h", false, "show usage information")
+	port         = flag.Int("port", 53, "port number to send queries to")
+	rate         = flag.Int("rate", 1000, "maximum queries per second, including retries (0 for unlimited)")
+	inflight     = flag.Int("inflight", 4096, "maximum number of queries awaiting a reply")
+	sockets      = flag.Int("sockets", 4, "number of UDP sockets to send queries from")
+	timeout      = flag.Duration("timeout", time.Second*5, "time to wait for each reply")
+	retries      = flag.Int("retries", 1, "number of times to resend a query that timed out")
+	resolverFile = flag.String("resolver-file", "", "file containing resolvers to sweep, one per line")
+	subdomain    = flag.String("subdomain", "helper.rumble.network", "subdomain handled by runzero-dns")
+	tracerVer    = flag.Uint("tracer-version", uint(rnd.TracerVersionCurrent), "tracer format to send (0 for runzero-dns servers older than the versioned format)")
+	quiet        = flag.Bool("quiet", false, "quiet mode, only show positive results")
+	format       = flag.String("format", "text", "output format: text, json, or csv")
+	output       = flag.String("output", "", "write results to this file instead of stdout")
+	maxAddrs     = flag.Uint64("max-addresses", 1<<24, "largest number of targets to enumerate, more are rejected unless sampled")
+	sample       = flag.Uint64("sample", 0, "probe this many random addresses when there are more targets")
+	targetFile   = flag.String("target-file", "", "file containing targets to probe, one per line")
+	exclude      = flag.String("exclude", "", "comma-separated targets to skip")
+	excludeFile  = flag.String("exclude-file", "", "file containing targets to skip, one per line")
+	skipClasses  = flag.String("skip-classes", "multicast,broadcast", "comma-separated address classes never to probe (see below)")
+	onlyClasses  = flag.String("only-classes", "", "comma-separated address classes to limit probes to")
+	seed         = flag.Int64("seed", 0, "seed for the order of the targets (0 for a random order)")
+	shard        = flag.String("shard", "", "probe only shard i of n (i/n, starting from 0), splitting the targets between scanners using the same -seed")
+
+	calibrationRounds = flag.Int("calibrate", 5, "number of calibration probes per target and resolver (0 to classify by rcode only)")
+	calibrateAlive    = flag.String("calibrate-reachable", "", "additional targets known to be reachable by the resolvers")
+	calibrateDead     = flag.String("calibrate-unroutable", "192.0.2.1,198.51.100.1,203.0.113.1", "targets known to be unroutable from the resolvers")
+	confidence        = flag.Float64("confidence", 0.8, "minimum confidence required to classify a target")
+
+	checkpointFile     = flag.String("checkpoint", "", "periodically save progress to this file")
+	checkpointInterval = flag.Duration("checkpoint-interval", time.Second*30, "time between checkpoints")
+	resume             = flag.String("resume", "", "continue the scan saved in this checkpoint file")
+	help               = flag.Bool("help", false, "show usage information")
+	h                  = flag.Bool("h", false, "show usage information")
+)
+
+var (
+	scanID     uint32
+	sequence   uint32
+	obfuscator *rnd.Obfuscator
+	prng       *rand.Rand
 )
 
+// probeResult is the outcome of probing one target through one resolver
+type probeResult struct {
+	Index    uint64
+	Target   string
+	Resolver int
+	Name     string
+	Key      uint32
+	Alive    bool
+	Rcode    int
+	Latency  time.Duration
+	Attempts int
+	Err      error
+
+	// Skipped marks a target that was numbered but not probed, so the checkpoint can move past it
+	Skipped bool
+
+	Class      string
+	Confidence float64
+}
+
 func main() {
 
+	flag.Usage = usage
 	flag.Parse()
 
-	if len(flag.Args()) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <resolver> <cidrs>\n", os.Args[0])
-		flag.PrintDefaults()
+	minArgs := 2
+	if *resolverFile != "" {
+		minArgs--
+	}
+	if *targetFile != "" {
+		minArgs--
+	}
+	if *resume != "" {
+		minArgs = 0
+	}
+
+	if len(flag.Args()) < minArgs {
+		flag.Usage()
 		os.Exit(1)
 	}
 
@@ -58,81 +188,603 @@ func main() {
 		os.Exit(1)
 	}
 
-	rnd.SeedMathRand()
-	rnd.RandomizeObfuscationKeys()
+	if *tracerVer != uint(rnd.TracerVersionLegacy) && *tracerVer != uint(rnd.TracerVersion1) {
+		fmt.Fprintf(os.Stderr, "tracer-version: unsupported version %d\n", *tracerVer)
+		os.Exit(1)
+	}
 
-	dst := flag.Args()[0]
-	resolver := net.JoinHostPort(dst, fmt.Sprintf("%d", *port))
+	var err error
+	prng, err = rnd.NewMathRand(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	obfuscator, err = rnd.NewObfuscator()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 
-	cidrs := flag.Args()[1:]
+	state := &checkpointState{}
+	resolverSpecs := []string{}
+	checkpointPath := *checkpointFile
+
+	if *resume != "" {
+		loaded, err := loadCheckpoint(*resume)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "resume: %s\n", err)
+			os.Exit(1)
+		}
+		state = loaded
+		resolverSpecs = state.Resolvers
+		if checkpointPath == "" {
+			checkpointPath = *resume
+		}
+		fmt.Fprintf(os.Stderr, "resume: continuing scan %.8x from position %d with %d targets completed ahead of it\n",
+			state.ScanID, state.Position, len(state.InFlight))
+	} else {
+		args := flag.Args()
+		if *resolverFile != "" {
+			specs, err := readResolverFile(*resolverFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "resolver-file: %s\n", err)
+				os.Exit(1)
+			}
+			resolverSpecs = specs
+		} else {
+			resolverSpecs = strings.Split(args[0], ",")
+			args = args[1:]
+		}
+
+		// The seed determines the order of the walk, which must be repeatable to resume
+		state.Seed = *seed
+		for state.Seed == 0 {
+			state.Seed = prng.Int64()
+		}
+		if *shard != "" {
+			if *seed == 0 {
+				fmt.Fprintf(os.Stderr, "shard: every scanner must use the same -seed\n")
+				os.Exit(1)
+			}
+			n, err := fmt.Sscanf(*shard, "%d/%d", &state.Shard, &state.Shards)
+			if err != nil || n != 2 || state.Shard >= state.Shards {
+				fmt.Fprintf(os.Stderr, "shard: invalid shard %s, expected i/n\n", *shard)
+				os.Exit(1)
+			}
+		}
+		state.ScanID = prng.Uint32()
+		state.Output = *output
+		state.Format = *format
+		state.MaxAddresses = *maxAddrs
+		state.SampleSize = *sample
+
+		// Files are expanded here so a resumed scan does not depend on them
+		for _, arg := range args {
+			state.Targets = append(state.Targets, splitList(arg)...)
+		}
+		state.Excludes = splitList(*exclude)
+		state.SkipClasses = splitList(*skipClasses)
+		state.OnlyClasses = splitList(*onlyClasses)
+		for _, list := range []struct {
+			path  string
+			specs *[]string
+		}{{*targetFile, &state.Targets}, {*excludeFile, &state.Excludes}} {
+			if list.path == "" {
+				continue
+			}
+			specs, err := rnd.ReadTargetFile(list.path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "targets: %s\n", err)
+				os.Exit(1)
+			}
+			*list.specs = append(*list.specs, specs...)
+		}
+	}
+	scanID = state.ScanID
+
+	targets, err := newTargetSet(state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "targets: %s\n", err)
+		os.Exit(1)
+	}
+	if targets.Count().Sign() == 0 {
+		fmt.Fprintf(os.Stderr, "targets: no addresses left to probe\n")
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "targets: %s addresses\n", targets.Count())
+
+	servers, err := parseResolvers(resolverSpecs, *port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "resolver: %s\n", err)
+		os.Exit(1)
+	}
+
+	resolvers := make([]string, len(servers))
+	for i, server := range servers {
+		resolvers[i] = server.String()
+	}
+	state.Resolvers = resolvers
+
+	// A resumed scan appends to the output of the interrupted one
+	out := os.Stdout
+	appended := false
+	if state.Output != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if *resume != "" {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		out, err = os.OpenFile(state.Output, flags, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "output: %s\n", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+		if fi, err := out.Stat(); err == nil && fi.Size() > 0 {
+			appended = true
+		}
+	}
+
+	writer, err := newResultWriter(state.Format, out, *quiet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "format: %s\n", err)
+		os.Exit(1)
+	}
+	if cw, ok := writer.(*csvWriter); ok && appended {
+		cw.header = true
+	}
+
+	engine, err := newQueryEngine(engineConfig{
+		Sockets:  *sockets,
+		Rate:     *rate,
+		InFlight: *inflight,
+		Timeout:  *timeout,
+		Retries:  *retries,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "engine: %s\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	wg := new(sync.WaitGroup)
 	ipc := make(chan string)
 	stp := make(chan int)
 
+	// Stop sending new probes on the first interrupt, waiting for those in flight; exit on the second
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Fprintf(os.Stderr, "interrupted, waiting for queries in flight (interrupt again to exit now)\n")
+		cancel()
+		close(stp)
+		<-sig
+		os.Exit(130)
+	}()
+
+	// The summary of a resumed scan continues from the counts of the interrupted one. Only the
+	// text writer prints the reachability matrix, and only when comparing several resolvers
+	var matrix *reachMatrix
+	if _, ok := writer.(*textWriter); ok && len(resolvers) > 1 {
+		matrix = newReachMatrix(resolvers)
+	}
+	summary := state.Summary
+	if summary == nil {
+		summary = newSummaryRecord(resolvers, matrix)
+	}
+	summary.Matrix = matrix
+	summary.Partial = false
+	state.Summary = summary
+
+	skip := state.completedSet()
+	position := state.Position
+	progress := newScanProgress(state, len(resolvers))
+
+	// Results are written once every resolver has answered for the target, so the output
+	// and summary hold exactly the targets the checkpoint records as complete
+	writeResults := func(results []probeResult) {
+		for _, res := range results {
+			summary.record(res)
+			if matrix != nil {
+				matrix.record(res)
+			}
+			if err := writer.WriteResult(res, resolvers[res.Resolver]); err != nil {
+				fmt.Fprintf(os.Stderr, "output: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	saveCheckpoint := func() error {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		return progress.save(checkpointPath)
+	}
+
+	go func() {
+		opts := rnd.CIDROptions{
+			MaxAddresses: state.MaxAddresses,
+			SampleSize:   state.SampleSize,
+			Seed:         state.Seed,
+			Shard:        state.Shard,
+			Shards:       state.Shards,
+		}
+		if err := targets.Addresses(opts, ipc, stp); err != nil {
+			fmt.Fprintf(os.Stderr, "input: %s\n", err)
+		}
+		close(ipc)
+	}()
+
+	results := make(chan probeResult, *inflight)
+	collected := make(chan struct{})
+
 	helperDomain := rnd.EnsureTrailingDot(*subdomain)
-	for i := 0; i < *threads; i++ {
-		go remoteSense(wg, ipc, resolver, helperDomain)
-		wg.Add(1)
+	classifiers := calibrate(engine, servers, helperDomain, splitList(*calibrateAlive), splitList(*calibrateDead))
+
+	go func() {
+		var tick <-chan time.Time
+		if checkpointPath != "" && *checkpointInterval > 0 {
+			ticker := time.NewTicker(*checkpointInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					close(collected)
+					return
+				}
+				if res.Skipped {
+					progress.skip(res.Index)
+					continue
+				}
+				res.Class, res.Confidence = classifiers[res.Resolver].classify(res)
+				res.Alive = res.Class == classAlive
+				writeResults(progress.record(res))
+			case <-tick:
+				if err := saveCheckpoint(); err != nil {
+					fmt.Fprintf(os.Stderr, "checkpoint: %s\n", err)
+				}
+			}
+		}
+	}()
+
+	wg := new(sync.WaitGroup)
+	remoteSense(ctx, engine, wg, ipc, servers, helperDomain, results, func(index uint64) bool {
+		return index < position || skip[index]
+	})
+	wg.Wait()
+	engine.Close()
+	close(results)
+	<-collected
+
+	// Targets that some resolvers did not answer are probed again by a resumed scan
+	interrupted := ctx.Err() != nil
+	if checkpointPath == "" || !interrupted {
+		writeResults(progress.pending())
+	}
+	if checkpointPath != "" {
+		if err := saveCheckpoint(); err != nil {
+			fmt.Fprintf(os.Stderr, "checkpoint: %s\n", err)
+		} else if interrupted {
+			fmt.Fprintf(os.Stderr, "checkpoint: saved to %s, continue with -resume %s\n", checkpointPath, checkpointPath)
+		}
 	}
 
-	for _, cidr := range cidrs {
-		err := rnd.AddressesFromCIDR(cidr, ipc, stp)
+	summary.Partial = interrupted
+	if err := writer.WriteSummary(summary); err != nil {
+		fmt.Fprintf(os.Stderr, "output: %s\n", err)
+		os.Exit(1)
+	}
+	if err := writer.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "output: %s\n", err)
+		os.Exit(1)
+	}
+
+	if interrupted {
+		out.Close()
+		os.Exit(130)
+	}
+}
+
+// usage prints the command line syntax, flags, and address class names
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <resolver[,resolver...]> <targets>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -resolver-file <file> <targets>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -resume <checkpoint>\n", os.Args[0])
+	flag.PrintDefaults()
+
+	classes := []string{}
+	for _, class := range rnd.AddressClasses {
+		classes = append(classes, string(class))
+	}
+	fmt.Fprintf(os.Stderr, "\nAddress classes: %s\n", strings.Join(classes, ", "))
+}
+
+// newTargetSet builds the targets of the scan, recording the addresses of any hostnames
+// in the state so that a resumed scan walks the same set
+func newTargetSet(state *checkpointState) (*rnd.TargetSet, error) {
+	targets := rnd.NewTargetSet()
+	targets.LookupIP = func(host string) ([]net.IP, error) {
+		if addrs, ok := state.Resolved[strings.ToLower(host)]; ok {
+			ips := []net.IP{}
+			for _, addr := range addrs {
+				if ip := net.ParseIP(addr); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+			return ips, nil
+		}
+		return net.LookupIP(host)
+	}
+
+	for _, spec := range state.Targets {
+		if err := targets.Add(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range state.Excludes {
+		if err := targets.Exclude(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	skip, err := rnd.ParseAddressClasses(strings.Join(state.SkipClasses, ","))
+	if err != nil {
+		return nil, err
+	}
+	only, err := rnd.ParseAddressClasses(strings.Join(state.OnlyClasses, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	// Referring a resolver to a multicast or broadcast address is never useful, so these are skipped by default
+	total := targets.Count()
+	if len(skip) > 0 {
+		targets.ExcludeSet(rnd.AddressClassSet(skip...))
+	}
+	if len(only) > 0 {
+		targets.RestrictSet(rnd.AddressClassSet(only...))
+	}
+	if skipped := new(big.Int).Sub(total, targets.Count()); skipped.Sign() > 0 {
+		fmt.Fprintf(os.Stderr, "targets: skipping %s addresses by class\n", skipped)
+	}
+
+	state.Resolved = make(map[string][]string)
+	for name, ips := range targets.Resolved() {
+		for _, ip := range ips {
+			state.Resolved[name] = append(state.Resolved[name], ip.String())
+		}
+	}
+	return targets, nil
+}
+
+// readResolverFile reads one resolver per line, skipping blank lines and comments
+func readResolverFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	specs := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		specs = append(specs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no resolvers found in %s", path)
+	}
+	return specs, nil
+}
+
+// parseResolvers resolves each resolver spec, using the default port unless one is specified
+func parseResolvers(specs []string, defaultPort int) ([]*net.UDPAddr, error) {
+	servers := []*net.UDPAddr{}
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		hostPort := spec
+		if _, _, err := net.SplitHostPort(spec); err != nil {
+			hostPort = net.JoinHostPort(strings.Trim(spec, "[]"), fmt.Sprintf("%d", defaultPort))
+		}
+
+		server, err := net.ResolveUDPAddr("udp", hostPort)
 		if err != nil {
-			fmt.Printf("input: %s\n", err)
+			return nil, err
+		}
+		if seen[server.String()] {
 			continue
 		}
+		seen[server.String()] = true
+		servers = append(servers, server)
 	}
-	close(ipc)
-	wg.Wait()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no resolvers specified")
+	}
+	return servers, nil
 }
 
-func remoteSense(wg *sync.WaitGroup, ipc chan string, resolver string, helperDomain string) {
+// remoteSense probes each target through every resolver, numbering targets by their position in the walk
+func remoteSense(ctx context.Context, engine *queryEngine, wg *sync.WaitGroup, ipc chan string, servers []*net.UDPAddr, helperDomain string, results chan probeResult, skip func(uint64) bool) {
+	index := uint64(0)
 	for addr := range ipc {
-		c := new(dns.Client)
-		m := &dns.Msg{
-			Question: make([]dns.Question, 1),
+		current := index
+		index++
+
+		if ctx.Err() != nil || skip(current) {
+			continue
 		}
-		m.RecursionDesired = true
 
 		ip := net.ParseIP(addr)
 		if ip == nil {
-			fmt.Printf("invalid address: %s\n", addr)
+			fmt.Fprintf(os.Stderr, "invalid address: %s\n", addr)
+			results <- probeResult{Index: current, Target: addr, Skipped: true}
 			continue
 		}
 
-		tracerBytes := make([]byte, 28)
-		copy(tracerBytes[0:4], rnd.ObfuscationKey32Bytes[:])
-		copy(tracerBytes[4:20], rnd.XorBytesWithBytes(ip, rnd.ObfuscationKey32Bytes[:]))
-		copy(tracerBytes[20:28], rnd.XorBytesWithBytes(rnd.TimestampToBytes(time.Now().UTC()), rnd.ObfuscationKey32Bytes[:]))
+		for idx, server := range servers {
+			submitProbe(ctx, engine, wg, server, idx, current, addr, ip, helperDomain, results)
+		}
+	}
+}
 
-		tracerName := fmt.Sprintf("%.8x.s0%s.%s", rand.Uint32(), hex.EncodeToString(tracerBytes), helperDomain)
+// submitProbe sends a referral tracer for the target through the resolver, delivering the result to the channel.
+// Nothing is delivered if the context is cancelled before the probe is sent.
+func submitProbe(ctx context.Context, engine *queryEngine, wg *sync.WaitGroup, server *net.UDPAddr, idx int, index uint64, addr string, ip net.IP, helperDomain string, results chan probeResult) {
+	tracer := &rnd.Tracer{
+		Version:   uint8(*tracerVer),
+		Key:       obfuscator.Key32(),
+		ProbeType: rnd.TracerProbeReferral,
+		IP:        ip,
+		Timestamp: time.Now().UTC(),
+		ScanID:    scanID,
+		Sequence:  sequence,
+	}
+	sequence++
 
-		m.Question[0] = dns.Question{Name: tracerName, Qtype: dns.TypeA, Qclass: dns.ClassINET}
-		start := time.Now().UTC()
-		in, _, err := c.Exchange(m, resolver)
+	res := probeResult{Index: index, Target: addr, Resolver: idx, Key: tracer.Key}
 
-		valid := false
-		rstr := ""
-		if err != nil {
-			rstr = "error:" + err.Error()
-		} else {
-			if in.MsgHdr.Rcode == 2 {
-				valid = true
-			}
+	m, err := newProbeQuery(prng, tracer, helperDomain)
+	if err != nil {
+		res.Err = err
+		results <- res
+		return
+	}
+	res.Name = m.Question[0].Name
+
+	wg.Add(1)
+	err = engine.Submit(ctx, server, m, func(qr queryResult) {
+		defer wg.Done()
+
+		// Probes abandoned before they were sent are left for a resumed scan
+		if errors.Is(qr.Err, context.Canceled) {
+			return
+		}
 
-			rstr = fmt.Sprintf("code:%d", in.MsgHdr.Rcode)
+		res.Latency = qr.RTT
+		res.Attempts = qr.Attempts
+		res.Err = qr.Err
+		if qr.Err == nil {
+			res.Rcode = qr.Reply.MsgHdr.Rcode
+		}
+		results <- res
+	})
+	if err != nil {
+		wg.Done()
+		if ctx.Err() == nil {
+			res.Err = err
+			results <- res
 		}
+	}
+}
 
-		diff := time.Now().UTC().Sub(start) / time.Millisecond
+// newProbeQuery returns the query for a tracer, prefixed with a random label from the PRNG
+// so that resolvers cannot answer repeated probes from their cache
+func newProbeQuery(prng *rand.Rand, tracer *rnd.Tracer, helperDomain string) (*dns.Msg, error) {
+	encodedName, err := rnd.EncodeTracerName("s0", tracer, helperDomain)
+	if err != nil {
+		return nil, err
+	}
 
-		if !valid {
-			if !*quiet {
-				fmt.Printf("%-20s unreachable via %-25s %6dms      %s\n", addr, resolver, diff, rstr)
+	m := &dns.Msg{
+		Question: []dns.Question{{
+			Name:   fmt.Sprintf("%.8x.%s", prng.Uint32(), encodedName),
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+	m.RecursionDesired = true
+	return m, nil
+}
+
+// calibrate probes known-reachable and known-unroutable targets through each resolver,
+// returning a classifier for each based on the rcodes and latencies observed.
+func calibrate(engine *queryEngine, servers []*net.UDPAddr, helperDomain string, reachable []string, unroutable []string) []*classifier {
+	classifiers := make([]*classifier, len(servers))
+	for i := range servers {
+		classifiers[i] = &classifier{threshold: *confidence}
+	}
+
+	if *calibrationRounds < 1 {
+		return classifiers
+	}
+
+	// The resolvers can always reach themselves
+	targets := make([][]string, len(servers))
+	groups := make(map[string]bool)
+	for idx, server := range servers {
+		targets[idx] = append([]string{server.IP.String()}, reachable...)
+		for _, addr := range targets[idx] {
+			groups[addr] = true
+		}
+	}
+
+	wg := new(sync.WaitGroup)
+	results := make(chan probeResult, *inflight)
+	done := make(chan struct{})
+
+	go func() {
+		for res := range results {
+			if groups[res.Target] {
+				classifiers[res.Resolver].reachable.add(res)
+			} else {
+				classifiers[res.Resolver].unroutable.add(res)
 			}
-		} else {
-			fmt.Printf("%-20s       alive via %-25s %6dms       %s\n", addr, resolver, diff, rstr)
+		}
+		close(done)
+	}()
+
+	for round := 0; round < *calibrationRounds; round++ {
+		for idx, server := range servers {
+			probes := append(append([]string{}, targets[idx]...), unroutable...)
+			for _, addr := range probes {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					fmt.Fprintf(os.Stderr, "calibration: invalid address: %s\n", addr)
+					continue
+				}
+				submitProbe(context.Background(), engine, wg, server, idx, 0, addr, ip, helperDomain, results)
+			}
+		}
+	}
+	wg.Wait()
+	close(results)
+	<-done
+
+	for i, c := range classifiers {
+		c.fit()
+		if !c.calibrated() {
+			fmt.Fprintf(os.Stderr, "calibration: %s: not enough samples, classifying by rcode only\n", servers[i])
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "calibration: %s: reachable %s; unroutable %s\n", servers[i], c.reachable.describe(), c.unroutable.describe())
+	}
+	return classifiers
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(v string) []string {
+	items := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
-	wg.Done()
+	return items
 }
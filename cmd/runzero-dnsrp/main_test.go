@@ -0,0 +1,59 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/runZeroInc/runzero-tools/pkg/rnd"
+)
+
+// TestProbeQueryFixedSeed builds a probe from fixed random sources and checks the exact bytes
+// sent, so any change to the tracer name, prefix, or XID generation is noticed
+func TestProbeQueryFixedSeed(t *testing.T) {
+	prng, err := rnd.NewMathRand(bytes.NewReader(bytes.Repeat([]byte{0x42}, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := newQueryEngine(engineConfig{Sockets: 1, Random: bytes.NewReader(bytes.Repeat([]byte{0x24}, 16))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	tracer := &rnd.Tracer{
+		Version:   rnd.TracerVersion1,
+		Key:       0x01020304,
+		ProbeType: rnd.TracerProbeReferral,
+		IP:        net.ParseIP("192.0.2.1"),
+		Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		ScanID:    0xa1b2c3d4,
+		Sequence:  7,
+	}
+	m, err := newProbeQuery(prng, tracer, "helper.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.mu.Lock()
+	m.Id = engine.newXID(0)
+	engine.mu.Unlock()
+
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first label is the random prefix and the next two are the encoded tracer
+	name := ""
+	for _, label := range []string{"6382732e", "s001020304000303040102030401020304fefdc304030316e1f3d7eb22", "3302a2b6c2d603040105", "helper", "example", ""} {
+		name += hex.EncodeToString(append([]byte{byte(len(label))}, label...))
+	}
+	want := "cf50" + "0100" + "0001000000000000" + name + "00010001"
+	if got := hex.EncodeToString(packed); got != want {
+		t.Errorf("probe query:\n got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// reachMatrix records the reachability of each target through each resolver
+type reachMatrix struct {
+	resolvers []string
+	rows      map[string][]string
+}
+
+// newReachMatrix returns an empty matrix for the resolvers
+func newReachMatrix(resolvers []string) *reachMatrix {
+	return &reachMatrix{resolvers: resolvers, rows: make(map[string][]string)}
+}
+
+// record stores a probe result in the target's row
+func (m *reachMatrix) record(res probeResult) {
+	row, ok := m.rows[res.Target]
+	if !ok {
+		row = make([]string, len(m.resolvers))
+		m.rows[res.Target] = row
+	}
+	row[res.Resolver] = res.Class
+}
+
+// print writes the resolver legend and the matrix sorted by address, skipping unreachable targets if onlyAlive is set
+func (m *reachMatrix) print(w io.Writer, onlyAlive bool) {
+	fmt.Fprintln(w, "resolvers:")
+	for i, resolver := range m.resolvers {
+		fmt.Fprintf(w, "  r%d = %s\n", i+1, resolver)
+	}
+	fmt.Fprintln(w)
+
+	header := []string{}
+	for i := range m.resolvers {
+		header = append(header, fmt.Sprintf("r%d", i+1))
+	}
+	printMatrixRow(w, "target", header)
+
+	for _, target := range m.sortedTargets() {
+		row := m.rows[target]
+		if onlyAlive && !rowHasAlive(row) {
+			continue
+		}
+
+		labels := []string{}
+		for _, cell := range row {
+			labels = append(labels, cellLabel(cell))
+		}
+		printMatrixRow(w, target, labels)
+	}
+}
+
+// printMatrixRow writes a row of fixed-width columns
+func printMatrixRow(w io.Writer, first string, cols []string) {
+	line := fmt.Sprintf("%-20s", first)
+	for _, col := range cols {
+		line += fmt.Sprintf(" %-6s", col)
+	}
+	fmt.Fprintln(w, strings.TrimRight(line, " "))
+}
+
+// sortedTargets returns the targets ordered by address, with IPv4 before IPv6
+func (m *reachMatrix) sortedTargets() []string {
+	targets := make([]string, 0, len(m.rows))
+	for target := range m.rows {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		a, b := net.ParseIP(targets[i]), net.ParseIP(targets[j])
+		a4, b4 := a.To4() != nil, b.To4() != nil
+		if a4 != b4 {
+			return a4
+		}
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+	return targets
+}
+
+func rowHasAlive(row []string) bool {
+	for _, cell := range row {
+		if cell == classAlive {
+			return true
+		}
+	}
+	return false
+}
+
+func cellLabel(class string) string {
+	switch class {
+	case classAlive:
+		return "alive"
+	case classDead:
+		return "-"
+	case classFiltered:
+		return "filt"
+	case classIndeterminate:
+		return "?"
+	}
+	return ""
+}
@@ -0,0 +1,355 @@
+package main
+
+// Copyright (C) 2018-2020 runZero, Inc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Probe outcomes, counted in the summary
+const (
+	outcomeAlive       = "alive"
+	outcomeUnreachable = "unreachable"
+	outcomeRefused     = "refused"
+	outcomeTimeout     = "timeout"
+	outcomeError       = "error"
+)
+
+// Error classes reported for probes that did not receive a usable reply
+const (
+	errorClassTimeout = "timeout"
+	errorClassRefused = "refused"
+	errorClassNetwork = "network"
+)
+
+// resultRecord is the structured form of a probeResult
+type resultRecord struct {
+	Type       string  `json:"type"`
+	Target     string  `json:"target"`
+	Family     string  `json:"family"`
+	Resolver   string  `json:"resolver"`
+	Tracer     string  `json:"tracer"`
+	Rcode      *int    `json:"rcode"`
+	RcodeName  string  `json:"rcode_name,omitempty"`
+	LatencyMS  float64 `json:"latency_ms"`
+	Attempts   int     `json:"attempts"`
+	Outcome    string  `json:"outcome"`
+	Class      string  `json:"class"`
+	Confidence float64 `json:"confidence"`
+	ErrorClass string  `json:"error_class,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DecodeKey  string  `json:"decode_key"`
+}
+
+// familyStats tracks reachability through a resolver for one address family
+type familyStats struct {
+	Total uint64 `json:"total"`
+	Alive uint64 `json:"alive"`
+}
+
+// resolverSummary tracks the outcomes of all probes sent through a resolver
+type resolverSummary struct {
+	Resolver string            `json:"resolver"`
+	IPv4     familyStats       `json:"ipv4"`
+	IPv6     familyStats       `json:"ipv6"`
+	Outcomes map[string]uint64 `json:"outcomes"`
+	Classes  map[string]uint64 `json:"classes"`
+}
+
+// summaryRecord is written after all results
+type summaryRecord struct {
+	Type      string             `json:"type"`
+	ScanID    string             `json:"scan_id"`
+	Total     uint64             `json:"total"`
+	Outcomes  map[string]uint64  `json:"outcomes"`
+	Classes   map[string]uint64  `json:"classes"`
+	Resolvers []*resolverSummary `json:"resolvers"`
+	Partial   bool               `json:"partial,omitempty"`
+	Matrix    *reachMatrix       `json:"-"`
+}
+
+// newSummaryRecord returns an empty summary for the resolvers
+func newSummaryRecord(resolvers []string, matrix *reachMatrix) *summaryRecord {
+	s := &summaryRecord{
+		Type:     "summary",
+		ScanID:   fmt.Sprintf("%.8x", scanID),
+		Outcomes: make(map[string]uint64),
+		Classes:  make(map[string]uint64),
+		Matrix:   matrix,
+	}
+	for _, resolver := range resolvers {
+		s.Resolvers = append(s.Resolvers, &resolverSummary{
+			Resolver: resolver,
+			Outcomes: make(map[string]uint64),
+			Classes:  make(map[string]uint64),
+		})
+	}
+	return s
+}
+
+// record counts a probe result
+func (s *summaryRecord) record(res probeResult) {
+	outcome := res.outcome()
+	s.Total++
+	s.Outcomes[outcome]++
+	s.Classes[res.Class]++
+
+	r := s.Resolvers[res.Resolver]
+	r.Outcomes[outcome]++
+	r.Classes[res.Class]++
+
+	f := &r.IPv6
+	if ip := net.ParseIP(res.Target); ip != nil && ip.To4() != nil {
+		f = &r.IPv4
+	}
+	f.Total++
+	if res.Alive {
+		f.Alive++
+	}
+}
+
+// outcome summarizes the result as one of the outcome constants
+func (res probeResult) outcome() string {
+	switch {
+	case errors.Is(res.Err, errQueryTimeout):
+		return outcomeTimeout
+	case res.Err != nil:
+		return outcomeError
+	case res.Alive:
+		return outcomeAlive
+	case res.Rcode == dns.RcodeRefused:
+		return outcomeRefused
+	}
+	return outcomeUnreachable
+}
+
+// errorClass returns the error class for results without a usable reply
+func (res probeResult) errorClass() string {
+	switch {
+	case errors.Is(res.Err, errQueryTimeout):
+		return errorClassTimeout
+	case res.Err != nil:
+		return errorClassNetwork
+	case res.Rcode == dns.RcodeRefused:
+		return errorClassRefused
+	}
+	return ""
+}
+
+// record converts the result to its structured form
+func (res probeResult) record(resolver string) resultRecord {
+	rec := resultRecord{
+		Type:       "result",
+		Target:     res.Target,
+		Family:     "ipv6",
+		Resolver:   resolver,
+		Tracer:     res.Name,
+		LatencyMS:  float64(res.Latency) / float64(time.Millisecond),
+		Attempts:   res.Attempts,
+		Outcome:    res.outcome(),
+		Class:      res.Class,
+		Confidence: res.Confidence,
+		ErrorClass: res.errorClass(),
+		DecodeKey:  fmt.Sprintf("%.8x", res.Key),
+	}
+	if ip := net.ParseIP(res.Target); ip != nil && ip.To4() != nil {
+		rec.Family = "ipv4"
+	}
+	if res.Err != nil {
+		rec.Error = res.Err.Error()
+	} else {
+		rcode := res.Rcode
+		rec.Rcode = &rcode
+		rec.RcodeName = dns.RcodeToString[rcode]
+	}
+	return rec
+}
+
+// resultWriter writes probe results and the final summary in a specific format
+type resultWriter interface {
+	WriteResult(res probeResult, resolver string) error
+	WriteSummary(s *summaryRecord) error
+	Flush() error
+	Close() error
+}
+
+// newResultWriter returns a writer for the named format
+func newResultWriter(format string, w io.Writer, quiet bool) (resultWriter, error) {
+	switch strings.ToLower(format) {
+	case "text", "":
+		return &textWriter{w: w, quiet: quiet}, nil
+	case "json", "jsonl":
+		return &jsonWriter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return newCSVWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// textWriter writes the human-readable output
+type textWriter struct {
+	w     io.Writer
+	quiet bool
+}
+
+func (t *textWriter) WriteResult(res probeResult, resolver string) error {
+	rstr := ""
+	if res.Err != nil {
+		rstr = "error:" + res.Err.Error()
+	} else {
+		rstr = fmt.Sprintf("code:%d", res.Rcode)
+	}
+
+	if !res.Alive && t.quiet {
+		return nil
+	}
+
+	diff := res.Latency / time.Millisecond
+	_, err := fmt.Fprintf(t.w, "%-20s %13s via %-25s %6dms %4.2f  %s\n", res.Target, res.Class, resolver, diff, res.Confidence, rstr)
+	return err
+}
+
+func (t *textWriter) WriteSummary(s *summaryRecord) error {
+	for _, r := range s.Resolvers {
+		for _, f := range []struct {
+			name  string
+			stats familyStats
+		}{{"ipv4", r.IPv4}, {"ipv6", r.IPv6}} {
+			if f.stats.Total == 0 {
+				continue
+			}
+			fmt.Fprintf(t.w, "%-20s %8d/%-8d alive via %-25s\n", f.name, f.stats.Alive, f.stats.Total, r.Resolver)
+		}
+	}
+
+	if len(s.Resolvers) > 1 && s.Matrix != nil {
+		fmt.Fprintln(t.w)
+		s.Matrix.print(t.w, t.quiet)
+	}
+
+	if s.Partial {
+		fmt.Fprintf(t.w, "\nscan interrupted, partial results for %d probes\n", s.Total)
+	}
+	return nil
+}
+
+func (t *textWriter) Flush() error {
+	return nil
+}
+
+func (t *textWriter) Close() error {
+	return nil
+}
+
+// jsonWriter writes one JSON object per line
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonWriter) WriteResult(res probeResult, resolver string) error {
+	return j.enc.Encode(res.record(resolver))
+}
+
+func (j *jsonWriter) WriteSummary(s *summaryRecord) error {
+	return j.enc.Encode(s)
+}
+
+func (j *jsonWriter) Flush() error {
+	return nil
+}
+
+func (j *jsonWriter) Close() error {
+	return nil
+}
+
+// csvColumns are the columns written by csvWriter
+var csvColumns = []string{
+	"type", "target", "family", "resolver", "tracer", "rcode", "rcode_name",
+	"latency_ms", "attempts", "outcome", "class", "confidence", "error_class", "error", "decode_key", "counts",
+}
+
+// csvWriter writes a header followed by one row per result and a final summary row,
+// which lists the outcome and class counts as name=count pairs in the counts column.
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) writeRow(row []string) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvColumns); err != nil {
+			return err
+		}
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) WriteResult(res probeResult, resolver string) error {
+	rec := res.record(resolver)
+	rcode := ""
+	if rec.Rcode != nil {
+		rcode = strconv.Itoa(*rec.Rcode)
+	}
+	return c.writeRow([]string{
+		rec.Type, rec.Target, rec.Family, rec.Resolver, rec.Tracer, rcode, rec.RcodeName,
+		strconv.FormatFloat(rec.LatencyMS, 'f', 3, 64), strconv.Itoa(rec.Attempts),
+		rec.Outcome, rec.Class, strconv.FormatFloat(rec.Confidence, 'f', 3, 64),
+		rec.ErrorClass, rec.Error, rec.DecodeKey, "",
+	})
+}
+
+func (c *csvWriter) WriteSummary(s *summaryRecord) error {
+	outcomes := make([]string, 0, len(s.Outcomes))
+	for outcome := range s.Outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+
+	classes := make([]string, 0, len(s.Classes))
+	for class := range s.Classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	counts := []string{fmt.Sprintf("total=%d", s.Total)}
+	for _, outcome := range outcomes {
+		counts = append(counts, fmt.Sprintf("%s=%d", outcome, s.Outcomes[outcome]))
+	}
+	for _, class := range classes {
+		counts = append(counts, fmt.Sprintf("class.%s=%d", class, s.Classes[class]))
+	}
+
+	if s.Partial {
+		counts = append(counts, "partial=true")
+	}
+
+	row := make([]string, len(csvColumns))
+	row[0] = s.Type
+	row[len(row)-1] = strings.Join(counts, ";")
+	return c.writeRow(row)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	return c.Flush()
+}
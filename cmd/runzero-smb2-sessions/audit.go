@@ -0,0 +1,296 @@
+package main
+
+// Copyright (C) 2020 runZero, Inc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/runZeroInc/runzero-tools/pkg/rnd"
+)
+
+// Severities of audit findings, from most to least serious
+const (
+	severityHigh   = "high"
+	severityMedium = "medium"
+	severityLow    = "low"
+	severityInfo   = "info"
+)
+
+// severityRank orders severities for sorting and summaries
+var severityRank = map[string]int{
+	severityHigh:   0,
+	severityMedium: 1,
+	severityLow:    2,
+	severityInfo:   3,
+}
+
+// auditCiphers are offered one at a time to find the ciphers a SMB 3.1.1 host accepts
+var auditCiphers = []uint16{rnd.SMB2CipherAES128CCM, rnd.SMB2CipherAES128GCM, rnd.SMB2CipherAES256CCM, rnd.SMB2CipherAES256GCM}
+
+// smbGhostBuilds are the Windows builds affected by CVE-2020-0796 before the March 2020 update
+var smbGhostBuilds = map[uint16]bool{18362: true, 18363: true}
+
+// auditFinding is a single issue found on a host
+type auditFinding struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Detail   string `json:"detail"`
+}
+
+// auditResult is the record written for each SMB host found in audit mode
+type auditResult struct {
+	Host           string            `json:"host"`
+	Product        string            `json:"product,omitempty"`
+	Signing        string            `json:"signing,omitempty"`
+	SMB1           bool              `json:"smb1"`
+	SMB1Signing    string            `json:"smb1_signing,omitempty"`
+	Dialects       []string          `json:"dialects,omitempty"`
+	LowestDialect  string            `json:"lowest_dialect,omitempty"`
+	HighestDialect string            `json:"highest_dialect,omitempty"`
+	Ciphers        []string          `json:"ciphers,omitempty"`
+	Compression    []string          `json:"compression,omitempty"`
+	SessionIDs     rnd.SequenceClass `json:"session_ids,omitempty"`
+	Findings       []auditFinding    `json:"findings"`
+	Info           map[string]string `json:"info,omitempty"`
+	Error          string            `json:"error,omitempty"`
+
+	// Parsed replies used to derive the findings
+	negotiate *rnd.NegotiateInfo
+	dialects  []uint16
+	build     uint16
+}
+
+// doAudit checks the SMB configuration of every target, writing one JSON object per SMB host
+// to stdout and a summary of the findings to stderr
+func doAudit(addrs chan string, workers int, samples int) {
+	results := scanHosts(addrs, workers, func(dst string) *auditResult {
+		return auditHost(dst, samples)
+	})
+
+	hosts := 0
+	bySeverity := make(map[string]int)
+	byFinding := make(map[string]int)
+	enc := json.NewEncoder(os.Stdout)
+	for res := range results {
+		hosts++
+		ids := make([]string, 0, len(res.Findings))
+		for _, f := range res.Findings {
+			bySeverity[f.Severity]++
+			byFinding[f.ID]++
+			ids = append(ids, fmt.Sprintf("%s (%s)", f.ID, f.Severity))
+		}
+		if err := enc.Encode(res); err != nil {
+			log.Fatalf("output: %s", err)
+		}
+
+		if len(ids) == 0 && res.Error != "" {
+			log.Printf("%s: no findings (%s)", res.Host, res.Error)
+			continue
+		}
+		if len(ids) == 0 {
+			log.Printf("%s: no findings", res.Host)
+			continue
+		}
+		log.Printf("%s: %s", res.Host, strings.Join(ids, ", "))
+	}
+
+	log.Printf("audit: %d SMB hosts: %d high, %d medium, %d low, %d info findings", hosts,
+		bySeverity[severityHigh], bySeverity[severityMedium], bySeverity[severityLow], bySeverity[severityInfo])
+
+	ids := make([]string, 0, len(byFinding))
+	for id := range byFinding {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		log.Printf("audit: %s: %d hosts", id, byFinding[id])
+	}
+}
+
+// auditHost gathers the negotiate, session setup, SMB1, dialect, cipher, and session ID data
+// for a host and derives its findings, returning nil if the host did not accept a connection
+func auditHost(dst string, samples int) *auditResult {
+	ar := &auditResult{Host: dst, Findings: []auditFinding{}}
+
+	res, err := probe(dst, 0)
+	if err != nil {
+		if isDialError(err) {
+			return nil
+		}
+		ar.Error = err.Error()
+	} else {
+		ar.negotiate = res.negotiate
+		ar.Info = res.info()
+		ar.Signing = res.negotiate.Signing
+		for _, alg := range res.negotiate.CompressionAlgorithms {
+			if alg != rnd.SMB2CompressionNone {
+				ar.Compression = append(ar.Compression, rnd.SMB2CompressionName(alg))
+			}
+		}
+		if res.challenge != nil {
+			ar.Product = res.challenge.Product
+			ar.build = res.challenge.Version.Build
+		}
+	}
+
+	// SMB1-only hosts fail the SMB2 probe, so check SMB1 regardless
+	if smb1, _ := probeSMB1(dst); smb1 != nil && smb1.negotiate != nil && smb1.negotiate.Enabled() {
+		ar.SMB1 = true
+		ar.SMB1Signing = smb1.negotiate.Signing
+		if ar.Product == "" && smb1.setup != nil {
+			ar.Product = smb1.setup.NativeOS
+		}
+	}
+	if ar.negotiate == nil && !ar.SMB1 {
+		if ar.Error == "" {
+			return nil
+		}
+		return ar
+	}
+
+	if ar.negotiate != nil {
+		auditDialectRange(ar)
+		auditCipherSupport(ar)
+		// Report hosts whose session IDs could not be sampled rather than omitting the field
+		ar.SessionIDs = rnd.SequenceUnknown
+		if sr := surveyHost(dst, samples); sr != nil {
+			ar.SessionIDs = sr.Class
+		}
+	}
+
+	ar.Findings = auditFindings(ar)
+	return ar
+}
+
+// auditDialectRange negotiates each dialect on its own to find those the host accepts
+func auditDialectRange(ar *auditResult) {
+	for _, d := range rnd.SMB2DialectsAll {
+		opts := rnd.DefaultSMB2NegotiateOptions(ar.Host)
+		opts.Dialects = []uint16{d}
+		ni, err := negotiate(ar.Host, opts)
+		if err != nil || ni.Dialect != d {
+			continue
+		}
+		ar.dialects = append(ar.dialects, d)
+		ar.Dialects = append(ar.Dialects, fmt.Sprintf("0x%.4x", d))
+	}
+	if len(ar.dialects) > 0 {
+		ar.LowestDialect = ar.Dialects[0]
+		ar.HighestDialect = ar.Dialects[len(ar.Dialects)-1]
+	}
+}
+
+// auditCipherSupport finds the ciphers the host accepts. SMB 3.1.1 hosts are offered each
+// cipher on its own, while SMB 3.0 hosts only support AES-128-CCM.
+func auditCipherSupport(ar *auditResult) {
+	for _, d := range ar.dialects {
+		if d == rnd.SMB2Dialect311 {
+			for _, c := range auditCiphers {
+				opts := rnd.DefaultSMB2NegotiateOptions(ar.Host)
+				opts.Ciphers = []uint16{c}
+				ni, err := negotiate(ar.Host, opts)
+				if err != nil || len(ni.Ciphers) != 1 || ni.Ciphers[0] != c {
+					continue
+				}
+				ar.Ciphers = append(ar.Ciphers, rnd.SMB2CipherName(c))
+			}
+			return
+		}
+	}
+
+	if ar.negotiate.Capabilities&rnd.SMB2CapEncryption != 0 {
+		ar.Ciphers = []string{rnd.SMB2CipherName(rnd.SMB2CipherAES128CCM)}
+	}
+}
+
+// auditFindings derives the findings for a host, most serious first
+func auditFindings(ar *auditResult) []auditFinding {
+	findings := []auditFinding{}
+	add := func(id, severity, format string, args ...interface{}) {
+		findings = append(findings, auditFinding{ID: id, Severity: severity, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	switch ar.Signing {
+	case "disabled":
+		add("signing-disabled", severityHigh, "SMB2 signing is disabled, so sessions can be relayed and tampered with")
+	case "enabled":
+		add("signing-not-required", severityMedium, "SMB2 signing is enabled but not required, so NTLM authentication can be relayed to this host")
+	}
+
+	if ar.SMB1 {
+		add("smb1-enabled", severityHigh, "SMB1 is enabled (signing %s)", ar.SMB1Signing)
+	}
+
+	if len(ar.dialects) > 0 {
+		highest := ar.dialects[len(ar.dialects)-1]
+		switch {
+		case highest < rnd.SMB2Dialect300:
+			add("no-smb3", severityMedium, "the highest dialect accepted is %s, which does not support encryption", ar.HighestDialect)
+		case highest < rnd.SMB2Dialect311:
+			add("no-smb311", severityLow, "the highest dialect accepted is %s, which lacks preauth integrity protection against downgrades", ar.HighestDialect)
+		}
+		if ar.dialects[0] == rnd.SMB2Dialect202 {
+			add("smb202-accepted", severityLow, "SMB 2.0.2 is accepted")
+		}
+	}
+
+	// Dialects before SMB 3.0 have no encryption, which no-smb3 already reports
+	smb3 := len(ar.dialects) == 0 || ar.dialects[len(ar.dialects)-1] >= rnd.SMB2Dialect300
+	if ar.negotiate != nil && smb3 {
+		switch {
+		case len(ar.Ciphers) == 0:
+			add("no-encryption", severityMedium, "no encryption cipher is supported")
+		case !strings.Contains(strings.Join(ar.Ciphers, " "), "gcm"):
+			add("no-gcm-cipher", severityLow, "only %s is supported", strings.Join(ar.Ciphers, ", "))
+		}
+	}
+
+	if len(ar.Compression) > 0 {
+		if smbGhostBuilds[ar.build] {
+			add("compression-enabled", severityHigh, "SMB 3.1.1 compression (%s) is enabled on build %d, which is affected by SMBGhost (CVE-2020-0796) unless patched",
+				strings.Join(ar.Compression, ", "), ar.build)
+		} else {
+			add("compression-enabled", severityInfo, "SMB 3.1.1 compression (%s) is enabled", strings.Join(ar.Compression, ", "))
+		}
+	}
+
+	switch ar.SessionIDs {
+	case rnd.SequenceCycle:
+		add("predictable-session-ids", severityMedium, "session IDs follow a predictable cycle, exposing session activity and existing sessions to binding probes")
+	case rnd.SequenceIncrement:
+		add("predictable-session-ids", severityLow, "session IDs increment, exposing session activity")
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank[findings[i].Severity] < severityRank[findings[j].Severity]
+	})
+	return findings
+}
+
+// isDialError returns true if an error came from connecting to the host
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// negotiate sends a single SMB2 NEGOTIATE request built from the options and parses the reply
+func negotiate(dip string, opts rnd.SMB2NegotiateOptions) (*rnd.NegotiateInfo, error) {
+	copts := clientOptions()
+	copts.MultiProtocol = false
+
+	ctx := context.Background()
+	c, err := rnd.DialSMB2(ctx, dip, copts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Negotiate(ctx, opts)
+}
@@ -3,42 +3,135 @@ package main
 // Copyright (C) 2020 runZero, Inc
 
 import (
-	"encoding/binary"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/runZeroInc/runzero-tools/pkg/rnd"
 )
 
+var (
+	targetFile    = flag.String("target-file", "", "file containing targets, one per line")
+	exclude       = flag.String("exclude", "", "comma-separated targets to skip")
+	excludeFile   = flag.String("exclude-file", "", "file containing targets to skip, one per line")
+	surveyWorkers = flag.Int("workers", 32, "number of hosts to survey concurrently")
+	surveySamples = flag.Int("samples", 250, "maximum number of session IDs (or SMB1 UIDs) to collect from each host when surveying")
+	smbPort       = flag.Int("port", rnd.SMBDefaultPort, "SMB port to connect to")
+	smbTimeout    = flag.Duration("timeout", rnd.SMBReadTimeout, "timeout for connecting and for each request")
+)
+
 func main() {
-	usage := fmt.Sprintf("Usage: "+
-		"\t%s <target> watch\n"+
-		"\t%s <target> hunt\n",
-		"\t%s <target> sample\n", os.Args[0], os.Args[0], os.Args[0],
-	)
-
-	if len(os.Args) < 3 {
-		fmt.Fprintln(os.Stderr, usage)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n"+
+			"\t%s [options] <targets> watch\n"+
+			"\t%s [options] <targets> hunt\n"+
+			"\t%s [options] <targets> sample\n"+
+			"\t%s [options] <targets> survey\n"+
+			"\t%s [options] <targets> smb1\n"+
+			"\t%s [options] <targets> audit\n\n"+
+			"Targets may be CIDRs, addresses, dash ranges, or hostnames, separated by commas.\n"+
+			"Survey mode probes every host concurrently, classifies how predictable its session IDs\n"+
+			"are, and writes one JSON object per SMB host to stdout. SMB1 mode does the same for\n"+
+			"SMB1, reporting whether it is enabled and classifying the UIDs of hosts that allow it.\n"+
+			"Audit mode combines these checks with the signing, dialect, cipher, and compression\n"+
+			"settings of each host into a list of findings with severities.\n\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	minArgs := 2
+	if *targetFile != "" {
+		minArgs = 1
+	}
+	if len(args) < minArgs {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	dst := os.Args[1]
-	mod := os.Args[2]
-	switch mod {
+	var mode func(string)
+	var scan func(chan string, int, int)
+	switch args[len(args)-1] {
 	case "watch":
-		doMonitor(dst)
+		mode = doMonitor
 	case "hunt":
-		doHunt(dst)
+		mode = doHunt
 	case "sample":
-		doSample(dst)
+		mode = doSample
+	case "survey":
+		scan = doSurvey
+	case "smb1":
+		scan = doSMB1
+	case "audit":
+		scan = doAudit
 	default:
-		fmt.Fprintln(os.Stderr, usage)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	targets, err := loadTargets(args[:len(args)-1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "targets: %s\n", err)
+		os.Exit(1)
+	}
+
+	addrs := make(chan string)
+	go func() {
+		if err := targets.Addresses(rnd.CIDROptions{}, addrs, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "targets: %s\n", err)
+		}
+		close(addrs)
+	}()
+
+	if scan != nil {
+		scan(addrs, *surveyWorkers, *surveySamples)
+		return
+	}
+
+	for dst := range addrs {
+		mode(dst)
+	}
+}
+
+// loadTargets builds the target set from the arguments and flags
+func loadTargets(args []string) (*rnd.TargetSet, error) {
+	targets := rnd.NewTargetSet()
+	for _, arg := range args {
+		for _, spec := range strings.Split(arg, ",") {
+			if err := targets.Add(spec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *targetFile != "" {
+		if err := targets.AddFile(*targetFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if *exclude != "" {
+		for _, spec := range strings.Split(*exclude, ",") {
+			if err := targets.Exclude(spec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *excludeFile != "" {
+		if err := targets.ExcludeFile(*excludeFile); err != nil {
+			return nil, err
+		}
 	}
+	return targets, nil
 }
 
 func doMonitor(dst string) {
@@ -46,23 +139,23 @@ func doMonitor(dst string) {
 
 	c := rnd.NewCounterPredictor(3, 10)
 	for {
-		info, err := probe(dst, "")
+		res, err := probe(dst, 0)
 		if err != nil {
 			log.Printf("%s: %s", dst, err)
 			break
 		}
 
-		if info["smb.SessionID"] == "" {
-			log.Printf("%s: no sid: %#v", dst, info)
+		if res.setup.SessionID == 0 {
+			log.Printf("%s: no sid: %#v", dst, res.info())
 			break
 		}
 
 		if !showInfo {
-			log.Printf("%s: determining the session cycle for %v", dst, info)
+			log.Printf("%s: determining the session cycle for %v", dst, res.info())
 			showInfo = true
 		}
 
-		newSID := decodeSessionID(info["smb.SessionID"])
+		newSID := res.setup.SessionID
 		if !c.Ready() {
 
 			if c.GetSampleCount() > 250 {
@@ -87,24 +180,25 @@ func doMonitor(dst string) {
 		}
 
 		for _, found := range foundSessions {
-			res, _ := probe(dst, fmt.Sprintf("0x%.16x", found))
-			sig := ""
-			if res["smb.Signature"] != "" {
-				sig = "sig:" + res["smb.Signature"]
+			res, err := probe(dst, found)
+			if err != nil {
+				log.Printf("%s: SESSION 0x%.16x: %s", dst, found, err)
+				continue
 			}
 
-			status := res["smb.Status"]
-
-			switch status {
-			case "0xc0000203":
+			var status string
+			switch res.setup.Status {
+			case rnd.SMBStatusUserSessionDeleted:
 				status = "EXPIRED"
-			case "0xc0000022":
-				status = fmt.Sprintf("ACTIVE dialect:%s", res["smb.Dialect"])
-			case "0xc000000d":
-				status = fmt.Sprintf("ACTIVE dialect:!%s", res["smb.Dialect"])
+			case rnd.SMBStatusAccessDenied:
+				status = fmt.Sprintf("ACTIVE dialect:0x%.4x", res.negotiate.Dialect)
+			case rnd.SMBStatusInvalidParameter:
+				status = fmt.Sprintf("ACTIVE dialect:!0x%.4x", res.negotiate.Dialect)
+			default:
+				status = fmt.Sprintf("0x%.8x", res.setup.Status)
 			}
 
-			log.Printf("%s: SESSION 0x%.16x is %s %s", dst, found, status, sig)
+			log.Printf("%s: SESSION 0x%.16x is %s %s", dst, found, status, res.signature())
 		}
 
 		time.Sleep(time.Second)
@@ -119,23 +213,23 @@ func doHunt(dst string) {
 
 Predict:
 	for {
-		info, err := probe(dst, "")
+		res, err := probe(dst, 0)
 		if err != nil {
 			log.Printf("%s: %s", dst, err)
 			break
 		}
 
-		if info["smb.SessionID"] == "" {
-			log.Printf("%s: no sid: %#v", dst, info)
+		if res.setup.SessionID == 0 {
+			log.Printf("%s: no sid: %#v", dst, res.info())
 			break
 		}
 
 		if !showInfo {
-			log.Printf("%s: determining the session cycle for %v", dst, info)
+			log.Printf("%s: determining the session cycle for %v", dst, res.info())
 			showInfo = true
 		}
 
-		newSID := decodeSessionID(info["smb.SessionID"])
+		newSID := res.setup.SessionID
 		if !c.Ready() {
 
 			if c.GetSampleCount() > 250 {
@@ -167,7 +261,7 @@ Predict:
 				break Predict
 			}
 
-			res, err := probe(dst, fmt.Sprintf("0x%.16x", sid))
+			res, err := probe(dst, sid)
 			if err != nil {
 				log.Printf("%s: %s, exiting...", dst, err)
 				break Predict
@@ -178,25 +272,19 @@ Predict:
 				log.Printf("%s: sent %d requests (%x)", dst, cnt, sid)
 			}
 
-			sig := ""
-			if res["smb.Signature"] != "" {
-				sig = "sig:" + res["smb.Signature"]
-			}
-
-			status := res["smb.Status"]
-
-			switch status {
-			case "0xc0000203":
+			var status string
+			switch res.setup.Status {
+			case rnd.SMBStatusUserSessionDeleted:
 				continue
-			case "0xc0000022":
-				status = fmt.Sprintf("ACTIVE dialect:%s", res["smb.Dialect"])
-			case "0xc000000d":
-				status = fmt.Sprintf("ACTIVE dialect:!%s", res["smb.Dialect"])
+			case rnd.SMBStatusAccessDenied:
+				status = fmt.Sprintf("ACTIVE dialect:0x%.4x", res.negotiate.Dialect)
+			case rnd.SMBStatusInvalidParameter:
+				status = fmt.Sprintf("ACTIVE dialect:!0x%.4x", res.negotiate.Dialect)
 			default:
-				status = fmt.Sprintf("UNKNOWN %v", res)
+				status = fmt.Sprintf("UNKNOWN %v", res.info())
 			}
 
-			log.Printf("%s: SESSION 0x%.16x is %s %s", dst, sid, status, sig)
+			log.Printf("%s: SESSION 0x%.16x is %s %s", dst, sid, status, res.signature())
 		}
 	}
 }
@@ -205,89 +293,435 @@ func doSample(dst string) {
 	showInfo := false
 
 	for x := 0; x <= 100; x++ {
-		info, err := probe(dst, "")
+		res, err := probe(dst, 0)
 		if err != nil {
 			log.Printf("%s: %s", dst, err)
 			break
 		}
 
-		if info["smb.SessionID"] == "" {
-			log.Printf("%s: no sid: %#v", dst, info)
+		if res.setup.SessionID == 0 {
+			log.Printf("%s: no sid: %#v", dst, res.info())
 			break
 		}
 
 		if !showInfo {
-			log.Printf("%s: sample 100 session IDs for %v", dst, info)
+			log.Printf("%s: sample 100 session IDs for %v", dst, res.info())
 			showInfo = true
 		}
 
-		log.Printf("%s", info["smb.SessionID"])
+		log.Printf("0x%.16x", res.setup.SessionID)
 	}
 }
 
-func probe(dip string, patchSID string) (map[string]string, error) {
+// surveyResult is the record written for each SMB host found in survey mode
+type surveyResult struct {
+	Host       string            `json:"host"`
+	Class      rnd.SequenceClass `json:"class"`
+	Cycle      string            `json:"cycle,omitempty"`
+	Samples    int               `json:"samples"`
+	SessionIDs []string          `json:"session_ids"`
+	Info       map[string]string `json:"info"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// scanHosts calls fn for each target using a pool of workers, returning the results that are
+// not nil on a channel that is closed once every target is done
+func scanHosts[T any](addrs chan string, workers int, fn func(string) *T) chan *T {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make(chan *T)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dst := range addrs {
+				if res := fn(dst); res != nil {
+					results <- res
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// doSurvey classifies the session IDs of every target that speaks SMB, writing JSONL to stdout
+func doSurvey(addrs chan string, workers int, samples int) {
+	results := scanHosts(addrs, workers, func(dst string) *surveyResult {
+		return surveyHost(dst, samples)
+	})
+
+	counts := make(map[rnd.SequenceClass]int)
+	enc := json.NewEncoder(os.Stdout)
+	for res := range results {
+		counts[res.Class]++
+		if err := enc.Encode(res); err != nil {
+			log.Fatalf("output: %s", err)
+		}
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	log.Printf("survey: %d SMB hosts: %d cycle, %d increment, %d random, %d unknown", total,
+		counts[rnd.SequenceCycle], counts[rnd.SequenceIncrement], counts[rnd.SequenceRandom], counts[rnd.SequenceUnknown])
+}
+
+// surveyHost collects up to samples session IDs from a host and classifies them, returning
+// nil if the host did not respond with a session ID
+func surveyHost(dst string, samples int) *surveyResult {
+	sr := &surveyResult{Host: dst, SessionIDs: []string{}}
+	ids := []uint64{}
+
+	c := newCycleFinder()
+	for len(ids) < samples {
+		res, err := probe(dst, 0)
+		if err == nil && res.setup.SessionID == 0 {
+			err = fmt.Errorf("no session ID")
+		}
+		if err != nil {
+			if len(ids) == 0 {
+				return nil
+			}
+			sr.Error = err.Error()
+			break
+		}
+		if sr.Info == nil {
+			sr.Info = res.info()
+		}
+
+		sid := res.setup.SessionID
+		ids = append(ids, sid)
+		sr.SessionIDs = append(sr.SessionIDs, fmt.Sprintf("0x%.16x", sid))
+
+		// Stop once the cycle is known, since more samples only confirm it
+		if c.add(sid) {
+			break
+		}
+	}
+
+	class, cycle := rnd.ClassifySequence(ids)
+	sr.Class = class
+	sr.Samples = len(ids)
+	if len(cycle) > 0 {
+		sr.Cycle = rnd.U64SliceToSeq(cycle)
+	}
+	return sr
+}
+
+// smb1Result is the record written for each SMB host found in SMB1 mode
+type smb1Result struct {
+	Host    string            `json:"host"`
+	Enabled bool              `json:"enabled"`
+	Class   rnd.SequenceClass `json:"class,omitempty"`
+	Cycle   string            `json:"cycle,omitempty"`
+	Samples int               `json:"samples,omitempty"`
+	UIDs    []string          `json:"uids,omitempty"`
+	Info    map[string]string `json:"info,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// doSMB1 reports whether every target that accepts connections allows SMB1, and classifies
+// the UIDs of those that do, writing JSONL to stdout
+func doSMB1(addrs chan string, workers int, samples int) {
+	results := scanHosts(addrs, workers, func(dst string) *smb1Result {
+		return smb1Host(dst, samples)
+	})
+
+	total, enabled := 0, 0
+	counts := make(map[rnd.SequenceClass]int)
+	enc := json.NewEncoder(os.Stdout)
+	for res := range results {
+		total++
+		if res.Enabled {
+			enabled++
+		}
+		if res.Class != "" {
+			counts[res.Class]++
+		}
+		if err := enc.Encode(res); err != nil {
+			log.Fatalf("output: %s", err)
+		}
+	}
+
+	log.Printf("smb1: %d SMB hosts, %d with SMB1 enabled: %d cycle, %d increment, %d random, %d unknown UIDs", total, enabled,
+		counts[rnd.SequenceCycle], counts[rnd.SequenceIncrement], counts[rnd.SequenceRandom], counts[rnd.SequenceUnknown])
+}
+
+// smb1Host checks whether a host allows SMB1 and, if it does, collects up to samples UIDs and
+// classifies them, returning nil if the host did not accept the connection
+func smb1Host(dst string, samples int) *smb1Result {
+	res, err := probeSMB1(dst)
+	if res == nil {
+		return nil
+	}
+
+	sr := &smb1Result{Host: dst}
+	if res.negotiate != nil {
+		sr.Enabled = res.negotiate.Enabled()
+		sr.Info = res.info()
+	}
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+	if res.setup == nil || res.setup.UID == 0 {
+		return sr
+	}
+
+	ids := []uint64{}
+	c := newCycleFinder()
+	for {
+		uid := uint64(res.setup.UID)
+		ids = append(ids, uid)
+		sr.UIDs = append(sr.UIDs, fmt.Sprintf("0x%.4x", uid))
+
+		// Stop once the cycle is known, since more samples only confirm it
+		if c.add(uid) || len(ids) >= samples {
+			break
+		}
+
+		res, err = probeSMB1(dst)
+		if err == nil && (res.setup == nil || res.setup.UID == 0) {
+			err = fmt.Errorf("no UID")
+		}
+		if err != nil {
+			sr.Error = err.Error()
+			break
+		}
+	}
+
+	class, cycle := rnd.ClassifySequence(ids)
+	sr.Class = class
+	sr.Samples = len(ids)
+	if len(cycle) > 0 {
+		sr.Cycle = rnd.U64SliceToSeq(cycle)
+	}
+	return sr
+}
+
+// smb1ProbeResult holds the replies parsed from a single SMB1 probe
+type smb1ProbeResult struct {
+	negotiate *rnd.SMB1NegotiateInfo
+	setup     *rnd.SMB1SessionSetupInfo
+	challenge *rnd.NTLMChallengeInfo
+	// warnings describes the parts of the replies that could not be decoded
+	warnings []string
+}
+
+// info returns the parsed fields using the smb1.*, smb.Native*, and ntlmssp.* keys
+func (r *smb1ProbeResult) info() map[string]string {
 	info := make(map[string]string)
-	dst := dip + ":445"
+	if r.negotiate != nil {
+		r.negotiate.Fields(info)
+	}
+	if r.setup != nil {
+		r.setup.Fields(info)
+	}
+	var warnings []string
+	if r.challenge != nil {
+		r.challenge.Fields(info)
+		warnings = append(warnings, r.challenge.Warnings...)
+	}
+	addWarnings(info, append(warnings, r.warnings...))
+	return info
+}
 
-	conn, err := net.DialTimeout("tcp", dst, rnd.SMBReadTimeout)
+// probeSMB1 negotiates SMB1 only and, if the server allows it with extended security, starts
+// a NTLMSSP session setup. The result is nil only if the connection failed; servers that have
+// SMB1 disabled usually drop the connection after the negotiate request.
+func probeSMB1(dip string) (*smb1ProbeResult, error) {
+	conn, err := net.DialTimeout("tcp", rnd.SMBAddress(dip, *smbPort), *smbTimeout)
 	if err != nil {
-		return info, err
+		return nil, err
 	}
 	defer conn.Close()
 
-	err = rnd.SMBSendData(conn, rnd.SMB1NegotiateProtocolRequest)
+	res := &smb1ProbeResult{}
+	err = rnd.SMBSendData(conn, rnd.SMB1OnlyNegotiateProtocolRequest)
+	if err != nil {
+		return res, err
+	}
+
+	data, err := rnd.SMBReadFrame(conn, *smbTimeout)
+	if err != nil {
+		return res, fmt.Errorf("negotiate: %w", err)
+	}
+
+	// Closing the connection or replying with SMB2 means SMB1 is disabled
+	res.negotiate, err = rnd.ParseSMB1NegotiateReply(data)
+	if len(data) == 0 || errors.Is(err, rnd.ErrNoSMB1Header) {
+		return res, nil
+	}
+	if err != nil {
+		return res, fmt.Errorf("negotiate: %w", err)
+	}
+	if !res.negotiate.Enabled() || res.negotiate.Capabilities&rnd.SMB1CapExtendedSecurity == 0 {
+		return res, nil
+	}
+
+	err = rnd.SMBSendData(conn, rnd.SMB1SessionSetupNTLMSSP)
 	if err != nil {
-		return info, err
+		return res, err
 	}
 
-	data, err := rnd.SMBReadFrame(conn, rnd.SMBReadTimeout)
+	data, err = rnd.SMBReadFrame(conn, *smbTimeout)
 	if err != nil {
-		return info, err
+		return res, fmt.Errorf("session setup: %w", err)
 	}
 
-	err = rnd.SMBSendData(conn, rnd.SMB2NegotiateProtocolRequest(dip))
+	res.setup, err = rnd.ParseSMB1SessionSetupReply(data)
 	if err != nil {
-		return info, err
+		return res, fmt.Errorf("session setup: %w", err)
 	}
 
-	data, _ = rnd.SMBReadFrame(conn, rnd.SMBReadTimeout)
-	rnd.SMB2ExtractFieldsFromNegotiateReply(data, info)
+	// A challenge that cannot be decoded leaves the negotiate and session setup results intact
+	if res.setup.Status == rnd.SMBStatusMoreProcessingRequired {
+		res.challenge, err = rnd.ParseNTLMChallenge(res.setup.SecurityBlob)
+		if err != nil {
+			res.warnings = append(res.warnings, "session setup: "+err.Error())
+		}
+	}
+	return res, nil
+}
 
-	setup := make([]byte, len(rnd.SMB2SessionSetupNTLMSSP))
-	copy(setup, rnd.SMB2SessionSetupNTLMSSP)
+// cycleFinder feeds identifiers to a CounterPredictor, but only once one of their differences
+// repeats, since a cycle cannot be found before then and the search is costly for random ones
+type cycleFinder struct {
+	values []uint64
+	diffs  map[uint64]bool
+	c      *rnd.CounterPredictor
+}
 
-	// Set the ProcessID
-	binary.LittleEndian.PutUint16(setup[4+32:], 0xfeff)
+// newCycleFinder returns a cycle finder using the same settings as watch mode
+func newCycleFinder() *cycleFinder {
+	return &cycleFinder{diffs: make(map[uint64]bool)}
+}
 
-	if patchSID != "" {
-		// Set the SMB2_SESSION_FLAG_BINDING flag
-		setup[4+66] = 1
+// add records the next identifier, returning true once a cycle is found
+func (f *cycleFinder) add(v uint64) bool {
+	if n := len(f.values); n > 0 {
+		diff := v - f.values[n-1]
+		if f.diffs[diff] && f.c == nil {
+			f.c = rnd.NewCounterPredictor(3, 10)
+			for _, prev := range f.values {
+				f.c.SubmitSample(prev)
+			}
+		}
+		f.diffs[diff] = true
+	}
+	f.values = append(f.values, v)
 
-		// Set the Signed PDU flag
-		binary.LittleEndian.PutUint16(setup[4+16:], 0x08)
+	if f.c == nil {
+		return false
+	}
+	return f.c.SubmitSample(v)
+}
+
+// probeResult holds the replies parsed from a single probe
+type probeResult struct {
+	negotiate *rnd.NegotiateInfo
+	setup     *rnd.SessionSetupInfo
+	challenge *rnd.NTLMChallengeInfo
+	// received is the local time the negotiate response arrived, for measuring clock skew
+	received time.Time
+	// warnings describes the parts of the replies that could not be decoded
+	warnings []string
+}
 
-		// Set the SessionID
-		sid := decodeSessionID(patchSID)
-		binary.LittleEndian.PutUint64(setup[4+40:], sid)
+// info returns the parsed fields using the smb.* and ntlmssp.* keys
+func (r *probeResult) info() map[string]string {
+	info := rnd.SMBInfoMap(r.negotiate, r.setup, r.challenge)
+	if r.negotiate != nil {
+		if skew, ok := r.negotiate.ClockSkew(r.received); ok {
+			info["smb.ClockSkew"] = skew.Round(time.Second).String()
+		}
 	}
 
-	err = rnd.SMBSendData(conn, setup)
-	if err != nil {
-		return info, err
+	var warnings []string
+	if r.negotiate != nil {
+		warnings = append(warnings, r.negotiate.Warnings...)
 	}
+	if r.setup != nil {
+		warnings = append(warnings, r.setup.Warnings...)
+	}
+	if r.challenge != nil {
+		warnings = append(warnings, r.challenge.Warnings...)
+	}
+	addWarnings(info, append(warnings, r.warnings...))
+	return info
+}
 
-	data, err = rnd.SMBReadFrame(conn, rnd.SMBReadTimeout)
-	rnd.SMB2ExtractSIDFromSessionSetupReply(data, info)
-	rnd.SMBExtractFieldsFromSecurityBlob(data, info)
+// addWarnings adds the warnings to the tab-separated smb.Warnings field
+func addWarnings(info map[string]string, warnings []string) {
+	if len(warnings) > 0 {
+		info["smb.Warnings"] = strings.Join(warnings, "\t")
+	}
+}
 
-	return info, err
+// signature returns the session setup signature for logging, if there was one
+func (r *probeResult) signature() string {
+	if r.setup.Signature == nil {
+		return ""
+	}
+	return fmt.Sprintf("sig:%x", r.setup.Signature)
+}
+
+// clientOptions returns the SMB2 client settings from the flags
+func clientOptions() rnd.SMB2ClientOptions {
+	return rnd.SMB2ClientOptions{
+		Port:          *smbPort,
+		DialTimeout:   *smbTimeout,
+		Timeout:       *smbTimeout,
+		MultiProtocol: true,
+	}
 }
 
-func decodeSessionID(sid string) uint64 {
-	sid = strings.Replace(sid, "0x", "", -1)
-	sidV, err := strconv.ParseUint(sid, 16, 64)
+// probe negotiates with the host and starts a NTLMSSP session setup, binding to an existing
+// session instead if patchSID is not zero
+func probe(dip string, patchSID uint64) (*probeResult, error) {
+	ctx := context.Background()
+	c, err := rnd.DialSMB2(ctx, dip, clientOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	res := &probeResult{}
+	res.negotiate, err = c.Negotiate(ctx, rnd.DefaultSMB2NegotiateOptions(dip))
+	if err != nil {
+		return nil, err
+	}
+	res.received = time.Now()
+
+	req := &rnd.SMB2SessionSetupReq{
+		SecurityMode:   rnd.SMB2SigningEnabled,
+		Capabilities:   rnd.SMB2CapDFS,
+		SecurityBuffer: rnd.SPNEGONTLMSSPNegotiate(),
+	}
+	if patchSID != 0 {
+		// Bind to the existing session
+		req.Flags = rnd.SMB2SessionFlagBinding
+	}
+
+	res.setup, err = c.SessionSetup(ctx, patchSID, req)
 	if err != nil {
-		return 0
+		return nil, err
+	}
+
+	// A challenge that cannot be decoded leaves the negotiate and session setup results intact
+	if res.setup.Status == rnd.SMBStatusMoreProcessingRequired {
+		res.challenge, err = rnd.ParseNTLMChallenge(res.setup.SecurityBlob)
+		if err != nil {
+			res.warnings = append(res.warnings, "session setup: "+err.Error())
+		}
 	}
-	return sidV
+	return res, nil
 }
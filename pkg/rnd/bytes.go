@@ -3,13 +3,53 @@ package rnd
 import (
 	crand "crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"math/rand"
+	randv2 "math/rand/v2"
 )
 
-// RandomBytes generates a random byte sequence of the requested length
-func RandomBytes(numbytes int) []byte {
+//
+// Functions that need randomness have a variant that takes the source as an io.Reader, so
+// callers can substitute a deterministic reader and produce byte-exact output. A nil source
+// means crypto/rand. Failures reading the source are returned rather than hidden.
+//
+
+// randomSource returns the source to use, defaulting to crypto/rand
+func randomSource(src io.Reader) io.Reader {
+	if src == nil {
+		return crand.Reader
+	}
+	return src
+}
+
+// RandomBytesFrom reads a random byte sequence of the requested length from a source
+func RandomBytesFrom(src io.Reader, numbytes int) ([]byte, error) {
 	randBytes := make([]byte, numbytes)
-	binary.Read(crand.Reader, binary.BigEndian, &randBytes)
+	if _, err := io.ReadFull(randomSource(src), randBytes); err != nil {
+		return nil, fmt.Errorf("random source: %w", err)
+	}
+	return randBytes, nil
+}
+
+// RandomUint64From reads a random 64-bit integer from a source
+func RandomUint64From(src io.Reader) (uint64, error) {
+	b, err := RandomBytesFrom(src, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// RandomBytes generates a random byte sequence of the requested length. It panics if
+// crypto/rand fails, rather than returning predictable bytes.
+//
+// Deprecated: use RandomBytesFrom, which accepts a source and returns errors.
+func RandomBytes(numbytes int) []byte {
+	randBytes, err := RandomBytesFrom(nil, numbytes)
+	if err != nil {
+		panic(err)
+	}
 	return randBytes
 }
 
@@ -23,9 +63,27 @@ func XorBytesWithBytes(src []byte, key []byte) []byte {
 	return dst
 }
 
-// SeedMathRand seeds the PRNG for things like transaction IDs
+// NewMathRand returns a PRNG for things like transaction IDs, seeded from a source
+func NewMathRand(src io.Reader) (*randv2.Rand, error) {
+	b, err := RandomBytesFrom(src, 16)
+	if err != nil {
+		return nil, err
+	}
+	return randv2.New(randv2.NewPCG(binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16]))), nil
+}
+
+// SeedMathRandFrom seeds the global math/rand PRNG from a source
+func SeedMathRandFrom(src io.Reader) error {
+	seed, err := RandomUint64From(src)
+	if err != nil {
+		return err
+	}
+	rand.Seed(int64(seed))
+	return nil
+}
+
+// SeedMathRand seeds the PRNG for things like transaction IDs from crypto/rand, ignoring
+// errors (see SeedMathRandFrom)
 func SeedMathRand() {
-	var randomSeed int64
-	binary.Read(crand.Reader, binary.BigEndian, &randomSeed)
-	rand.Seed(randomSeed)
+	SeedMathRandFrom(nil)
 }
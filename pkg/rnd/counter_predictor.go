@@ -191,3 +191,62 @@ func (c *CounterPredictor) calculateCycleIndex() {
 func NewCounterPredictor(rep int, len int) *CounterPredictor {
 	return &CounterPredictor{MinRep: rep, MinLen: len}
 }
+
+// SequenceClass describes how predictable a series of identifiers is
+type SequenceClass string
+
+// Sequence classes returned by ClassifySequence
+const (
+	// SequenceCycle identifiers advance by a repeating cycle of differences (Windows)
+	SequenceCycle SequenceClass = "cycle"
+	// SequenceIncrement identifiers advance by one, skipping any handed to other clients (macOS smbd)
+	SequenceIncrement SequenceClass = "increment"
+	// SequenceRandom identifiers show no repeated differences (Samba)
+	SequenceRandom SequenceClass = "random"
+	// SequenceUnknown identifiers repeat some differences without a detectable cycle, or are too few to judge
+	SequenceUnknown SequenceClass = "unknown"
+)
+
+// ClassifySequence classifies a series of identifiers collected in order, returning the
+// cycle of differences for SequenceCycle
+func ClassifySequence(values []uint64) (SequenceClass, []uint64) {
+	if len(values) < 3 {
+		return SequenceUnknown, nil
+	}
+
+	ones := 0
+	increasing := true
+	seen := make(map[uint64]bool)
+	repeats := false
+	for i := 1; i < len(values); i++ {
+		diff := values[i] - values[i-1]
+		if diff == 1 {
+			ones++
+		}
+		if diff == 0 || diff > 0xff {
+			increasing = false
+		}
+		if seen[diff] {
+			repeats = true
+		}
+		seen[diff] = true
+	}
+
+	// Other clients take some of the identifiers, so allow a few larger steps
+	if increasing && ones*10 >= (len(values)-1)*9 {
+		return SequenceIncrement, nil
+	}
+
+	// A cycle repeats its differences, so skip the costly search when none repeat
+	if !repeats {
+		return SequenceRandom, nil
+	}
+
+	c := NewCounterPredictor(3, 10)
+	for _, v := range values {
+		if c.SubmitSample(v) {
+			return SequenceCycle, c.GetCycle()
+		}
+	}
+	return SequenceUnknown, nil
+}
@@ -1,120 +1,175 @@
 package rnd
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
-	"math/big"
-	"math/rand"
+	"io"
+	"iter"
+	"math/bits"
+	"math/rand/v2"
 	"net"
+	"net/netip"
 	"regexp"
 	"strings"
 )
 
+// AddrToUint32 converts an IPv4 address to an unsigned integer
+func AddrToUint32(addr netip.Addr) (uint32, error) {
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return 0, errors.New("invalid IPv4 address")
+	}
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// Uint32ToAddr converts an unsigned integer to an IPv4 address
+func Uint32ToAddr(v uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b)
+}
+
 // IPv42UInt converts IPv4 addresses to unsigned integers
 func IPv42UInt(ips string) (uint32, error) {
-	ip := net.ParseIP(ips)
-	if ip == nil {
+	addr, err := netip.ParseAddr(ips)
+	if err != nil {
 		return 0, errors.New("invalid IPv4 address")
 	}
-	ip = ip.To4()
-	return binary.BigEndian.Uint32(ip), nil
+	return AddrToUint32(addr)
 }
 
 // IPv42UIntLE converts IPv4 addresses to unsigned integers (little endian)
 func IPv42UIntLE(ips string) (uint32, error) {
-	ip := net.ParseIP(ips)
-	if ip == nil {
-		return 0, errors.New("invalid IPv4 address")
-	}
-	ip = ip.To4()
-	return binary.LittleEndian.Uint32(ip), nil
+	v, err := IPv42UInt(ips)
+	return bits.ReverseBytes32(v), err
 }
 
 // UInt2IPv4 converts unsigned integers to IPv4 addresses
 func UInt2IPv4(ipi uint32) string {
-	ipb := make([]byte, 4)
-	binary.BigEndian.PutUint32(ipb, ipi)
-	ip := net.IP(ipb)
-	return ip.String()
+	return Uint32ToAddr(ipi).String()
 }
 
 // IPv42Bytes converts an IPv4 address to a byte array
 func IPv42Bytes(ips string) ([]byte, error) {
 	ipBytes := make([]byte, 4)
-	ip := net.ParseIP(ips)
-	if ip == nil {
-		return ipBytes, errors.New("invalid IPv4 address")
+	v, err := IPv42UInt(ips)
+	if err != nil {
+		return ipBytes, err
 	}
-	ip = ip.To4()
-	ipInt := binary.BigEndian.Uint32(ip)
-	binary.BigEndian.PutUint32(ipBytes, ipInt)
+	binary.BigEndian.PutUint32(ipBytes, v)
 	return ipBytes, nil
 }
 
 // Bytes2IPv4 converts a byte array to an IPv4 addresse
 func Bytes2IPv4(ipb []byte) string {
-	ip := net.IP(ipb)
-	return ip.String()
+	if addr, ok := netip.AddrFromSlice(ipb); ok {
+		return addr.Unmap().String()
+	}
+	return net.IP(ipb).String()
 }
 
 // ObfuscationKey32 provides an XOR key for encoding
+//
+// Deprecated: the package keys are shared by every caller in the process; use an Obfuscator.
 var ObfuscationKey32 uint32 = 0x50505050
 
 // ObfuscationKey32Bytes are the 32-bit XOR key as a byte array
-var ObfuscationKey32Bytes = [4]byte{}
+//
+// Deprecated: use Obfuscator.Key32Bytes, which cannot drift from the 32-bit key.
+var ObfuscationKey32Bytes = [4]byte{0x50, 0x50, 0x50, 0x50}
 
 // ObfuscationKey64 provides an XOR key for encoding
+//
+// Deprecated: the package keys are shared by every caller in the process; use an Obfuscator.
 var ObfuscationKey64 uint64 = 0x5050505050505050
 
 // ObfuscationKey64Bytes are the 64-bit XOR key as a byte array
-var ObfuscationKey64Bytes = [8]byte{}
+//
+// Deprecated: use Obfuscator.Key64Bytes, which cannot drift from the 64-bit key.
+var ObfuscationKey64Bytes = [8]byte{0x50, 0x50, 0x50, 0x50, 0x50, 0x50, 0x50, 0x50}
+
+// packageObfuscator returns an obfuscator using the current package keys
+func packageObfuscator() *Obfuscator {
+	return NewObfuscatorWithKeys(ObfuscationKey32, ObfuscationKey64)
+}
 
 // ObfuscateIPv4FromBytesToBytes XORs an IPv4 byte array with the obfuscation key
+//
+// Deprecated: use Obfuscator.Addr.
 func ObfuscateIPv4FromBytesToBytes(ipb []byte) []byte {
 	return ObfuscateBytes4(ipb)
 }
 
 // ObfuscateBytes4 XORs a 4-byte array with the obfuscation key
+//
+// Deprecated: use Obfuscator.Uint32.
 func ObfuscateBytes4(b []byte) []byte {
 	resp := make([]byte, 4)
-	ival := binary.BigEndian.Uint32(b)
-	binary.BigEndian.PutUint32(resp, ival^ObfuscationKey32)
+	binary.BigEndian.PutUint32(resp, packageObfuscator().Uint32(binary.BigEndian.Uint32(b)))
 	return resp
 }
 
 // ObfuscateBytes8 XORs a 8-byte array with the obfuscation key
+//
+// Deprecated: use Obfuscator.Bytes.
 func ObfuscateBytes8(b []byte) []byte {
-	resp := make([]byte, 8)
-	ival := binary.BigEndian.Uint64(b)
-	binary.BigEndian.PutUint64(resp, ival^ObfuscationKey64)
-	return resp
+	return packageObfuscator().Bytes(b[:8])
 }
 
 // ObfuscateIPv4FromStringToBytes XORs an IPv4 string with the obfuscation key, returning bytes
+//
+// Deprecated: use Obfuscator.Addr.
 func ObfuscateIPv4FromStringToBytes(ip string) []byte {
 	ipb, _ := IPv42Bytes(ip)
 	return ObfuscateIPv4FromBytesToBytes(ipb)
 }
 
 // ObfuscateIPv4FromStringToString XORs an IPv4 string with the obfuscation key, returning a string
+//
+// Deprecated: use Obfuscator.IPv4.
 func ObfuscateIPv4FromStringToString(ip string) string {
 	ipb, _ := IPv42Bytes(ip)
 	return Bytes2IPv4(ObfuscateIPv4FromBytesToBytes(ipb))
 }
 
 // ObfuscateIPv4FromBytesToString XORs an IPv4 string with the obfuscation key, returning a string
+//
+// Deprecated: use Obfuscator.Addr.
 func ObfuscateIPv4FromBytesToString(ipb []byte) string {
 	return Bytes2IPv4(ObfuscateIPv4FromBytesToBytes(ipb))
 }
 
-// RandomizeObfuscationKeys resets the default obfuscation keys
+// RandomizeObfuscationKeys resets the default obfuscation keys from crypto/rand, keeping the
+// byte arrays in step. It panics if crypto/rand fails, rather than using predictable keys.
+//
+// Deprecated: use NewObfuscator to give each scan its own keys.
 func RandomizeObfuscationKeys() {
-	ObfuscationKey32 = rand.Uint32()
-	binary.BigEndian.PutUint32(ObfuscationKey32Bytes[:], ObfuscationKey32)
-	ObfuscationKey64 = rand.Uint64()
-	binary.BigEndian.PutUint64(ObfuscationKey64Bytes[:], ObfuscationKey64)
+	if err := RandomizeObfuscationKeysFrom(nil); err != nil {
+		panic(err)
+	}
+}
+
+// RandomizeObfuscationKeysFrom resets the default obfuscation keys from a random source (nil for crypto/rand)
+//
+// Deprecated: use NewObfuscatorFrom to give each scan its own keys.
+func RandomizeObfuscationKeysFrom(src io.Reader) error {
+	o, err := NewObfuscatorFrom(src)
+	if err != nil {
+		return err
+	}
+	setPackageObfuscator(o)
+	return nil
+}
+
+// setPackageObfuscator replaces the package keys with those of an obfuscator
+func setPackageObfuscator(o *Obfuscator) {
+	ObfuscationKey32 = o.Key32()
+	ObfuscationKey32Bytes = o.Key32Bytes()
+	ObfuscationKey64 = o.Key64()
+	ObfuscationKey64Bytes = o.Key64Bytes()
 }
 
 // MatchIPv6 is a regular expression for validating IPv6 addresses
@@ -148,134 +203,288 @@ var EgressDestinationIPv4 = "1.1.1.1"
 var EgressDestinationIPv6 = "[2606:4700:4700::1111]"
 
 // GetEgressAddress return the IPv4 or IPv6 address used to route to the specified destination
+//
+// Deprecated: use EgressFor, which reports why no source address was found instead of
+// returning 127.0.0.1.
 func GetEgressAddress(dst string) string {
-	conn, err := net.Dial("udp", dst+":53")
+	host := strings.Trim(dst, "[]")
+	addr, err := netip.ParseAddr(host)
 	if err != nil {
-		return "127.0.0.1"
+		// Host names are resolved and the first address used, as dialing them did
+		addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil || len(addrs) == 0 {
+			return "127.0.0.1"
+		}
+		addr = addrs[0]
 	}
-
-	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
-	conn.Close()
+	egress, err := EgressFor(addr)
 	if err != nil {
 		return "127.0.0.1"
 	}
+	return egress.Source.String()
+}
 
-	bits := strings.Split(host, "%")
+// DefaultMaxAddresses is the largest range that AddressesFromCIDR will enumerate
+var DefaultMaxAddresses uint64 = 1 << 32
+
+// CIDROptions controls how AddressesFromCIDRWithOptions handles large ranges
+type CIDROptions struct {
+	// MaxAddresses rejects ranges with more addresses than this, unless sampling (0 for DefaultMaxAddresses)
+	MaxAddresses uint64
+	// SampleSize emits this many random addresses from ranges that are larger (0 to disable)
+	SampleSize uint64
+	// Seed makes the iteration order repeatable for the same range and options (0 for a random order)
+	Seed int64
+	// Random supplies the seed when Seed is 0 (nil for crypto/rand)
+	Random io.Reader
+	// Shard selects one of Shards disjoint parts of the order, starting from zero, so that
+	// several scanners using the same Seed can split a range (0 Shards for a single part)
+	Shard  uint64
+	Shards uint64
+}
 
-	return bits[0]
+// shard validates the sharding options, returning the shard and the number of shards
+func (o CIDROptions) shard() (uint64, uint64, error) {
+	if o.Shards <= 1 {
+		if o.Shard != 0 {
+			return 0, 0, fmt.Errorf("invalid shard %d of %d", o.Shard, o.Shards)
+		}
+		return 0, 1, nil
+	}
+	if o.Shard >= o.Shards {
+		return 0, 0, fmt.Errorf("invalid shard %d of %d", o.Shard, o.Shards)
+	}
+	if o.Seed == 0 {
+		return 0, 0, errors.New("sharding requires a seed")
+	}
+	return o.Shard, o.Shards, nil
 }
 
-// AddressesFromCIDR parses a CIDR and writes individual IPs to a channel
-func AddressesFromCIDR(cidr string, out chan string, quit chan int) error {
+// seed returns the seed for the iteration order, reading a random one if none was set
+func (o CIDROptions) seed() (uint64, error) {
+	if o.Seed != 0 {
+		return uint64(o.Seed), nil
+	}
+	return RandomUint64From(o.Random)
+}
+
+// shardCount returns the part of a sample of count addresses that belongs to a shard
+func shardCount(count, shard, shards uint64) uint64 {
+	n := count / shards
+	if shard < count%shards {
+		n++
+	}
+	return n
+}
+
+// parsePrefix parses a CIDR or bare address, returning the prefix with its host bits cleared
+func parsePrefix(cidr string) (netip.Prefix, error) {
 	if len(cidr) == 0 {
-		return fmt.Errorf("invalid CIDR: empty")
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR: empty")
 	}
 
 	// We may receive bare IP addresses, add a mask if needed
 	if !strings.Contains(cidr, "/") {
-		if strings.Contains(cidr, ":") {
-			cidr = cidr + "/128"
-		} else {
-			cidr = cidr + "/32"
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR: %s %s", cidr, err.Error())
 		}
+		addr = addr.WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
 	}
 
-	// Parse CIDR into base address + mask
-	_, net, err := net.ParseCIDR(cidr)
+	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return fmt.Errorf("invalid CIDR: %s %s", cidr, err.Error())
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR: %s %s", cidr, err.Error())
 	}
+	return prefix.Masked(), nil
+}
+
+// prefixHostBits returns the number of host bits in a prefix
+func prefixHostBits(prefix netip.Prefix) int {
+	return prefix.Addr().BitLen() - prefix.Bits()
+}
 
-	// Verify IPv4 for now
-	ip4 := net.IP.To4()
-	if ip4 == nil {
-		return fmt.Errorf("invalid IPv4 CIDR: %s", cidr)
+// AddrsFromPrefix returns the addresses of an IPv4 or IPv6 prefix in random order, applying the
+// size limits, sampling, seed, and shard of the options. Iteration stops early if the context
+// is cancelled. Ranging over the sequence again repeats the same order.
+func AddrsFromPrefix(ctx context.Context, prefix netip.Prefix, opts CIDROptions) (iter.Seq[netip.Addr], error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid CIDR: %s", prefix)
 	}
+	prefix = prefix.Masked()
 
-	netBase, err := IPv42UInt(net.IP.String())
+	shard, shards, err := opts.shard()
 	if err != nil {
-		return fmt.Errorf("invalid IPv4: %s %s", cidr, err)
+		return nil, err
 	}
 
-	maskOnes, maskTotal := net.Mask.Size()
+	maxAddresses := opts.MaxAddresses
+	if maxAddresses == 0 {
+		maxAddresses = DefaultMaxAddresses
+	}
 
-	// Does not work for IPv6 due to cast to uint32
-	netSize := uint32(math.Pow(2, float64(maskTotal-maskOnes)))
-	curBase := netBase
-	endBase := netBase + netSize
+	base := uint128FromAddr(prefix.Addr())
+	hostBits := prefixHostBits(prefix)
 
-	// Iterate the range semi-randomly
-	randomWalkIPv4Range(curBase, endBase, out, quit)
+	// Ranges too large to permute can only be sampled
+	if hostBits >= 63 {
+		if opts.SampleSize == 0 {
+			return nil, fmt.Errorf("CIDR too large: %s has 2^%d addresses", prefix, hostBits)
+		}
+		offsets, err := sampleRange(opts, hostMask128(hostBits), shardCount(opts.SampleSize, shard, shards))
+		if err != nil {
+			return nil, err
+		}
+		return mapOffsets(ctx, offsets, func(off uint128) uint128 { return base.or(off) }), nil
+	}
 
-	return nil
-}
+	netSize := uint64(1) << uint(hostBits)
+	count := uint64(0)
+	if opts.SampleSize > 0 && netSize > opts.SampleSize {
+		count = shardCount(opts.SampleSize, shard, shards)
+	} else if netSize > maxAddresses {
+		return nil, fmt.Errorf("CIDR too large: %s has %d addresses (limit %d)", prefix, netSize, maxAddresses)
+	}
 
-// AddressCountFromCIDR parses a CIDR and returns the numnber of included IP addresses
-func AddressCountFromCIDR(cidr string) (uint64, error) {
-	var count uint64
-	if len(cidr) == 0 {
-		return count, fmt.Errorf("invalid CIDR: empty")
+	offsets, err := walkRange(opts, netSize, count)
+	if err != nil {
+		return nil, err
 	}
+	return mapOffsets(ctx, offsets, func(off uint128) uint128 { return base.add(off) }), nil
+}
 
-	// We may receive bare IP addresses, not CIDRs sometimes
-	if !strings.Contains(cidr, "/") {
-		if strings.Contains(cidr, ":") {
-			cidr = cidr + "/128"
-		} else {
-			cidr = cidr + "/32"
-		}
+// AddressesFromCIDR parses a CIDR and writes individual IPs to a channel
+func AddressesFromCIDR(cidr string, out chan string, quit chan int) error {
+	return AddressesFromCIDRWithOptions(cidr, CIDROptions{}, out, quit)
+}
+
+// AddressesFromCIDRWithOptions parses an IPv4 or IPv6 CIDR and writes individual IPs to a channel in random order
+func AddressesFromCIDRWithOptions(cidr string, opts CIDROptions, out chan string, quit chan int) error {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return err
 	}
 
-	// Parse CIDR into base address + mask
-	_, net, err := net.ParseCIDR(cidr)
+	addrs, err := AddrsFromPrefix(context.Background(), prefix, opts)
 	if err != nil {
-		return count, fmt.Errorf("invalid CIDR: %s %s", cidr, err.Error())
+		return err
 	}
+	sendAddrs(addrs, out, quit)
+	return nil
+}
 
-	// Verify IPv4 for now
-	ip4 := net.IP.To4()
-	if ip4 == nil {
-		return count, fmt.Errorf("invalid IPv4 CIDR: %s", cidr)
+// sendAddrs writes each address in the sequence to a channel as a string, until quit is closed
+func sendAddrs(addrs iter.Seq[netip.Addr], out chan string, quit chan int) {
+	for addr := range addrs {
+		select {
+		case <-quit:
+			return
+		case out <- addr.String():
+		}
 	}
+}
 
-	maskOnes, maskTotal := net.Mask.Size()
+// AddressCountFromCIDR parses a CIDR and returns the numnber of included IP addresses
+func AddressCountFromCIDR(cidr string) (uint64, error) {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return 0, err
+	}
 
-	// Does not work for IPv6 due to cast to uint32
-	netSize := uint64(math.Pow(2, float64(maskTotal-maskOnes)))
+	hostBits := prefixHostBits(prefix)
+	if hostBits >= 64 {
+		return 0, fmt.Errorf("CIDR too large: %s has 2^%d addresses", cidr, hostBits)
+	}
 
-	return netSize, nil
+	return uint64(1) << uint(hostBits), nil
 }
 
-// findPrimeOverMin returns a prime int64 of at least min
-func findPrimeOverMin(min int64) int64 {
-	var randomSeed int64
-	for i := 0; ; i++ {
-		randomSeed = rand.Int63()
-		// ProbablyPrime is 100% accurate for inputs less than 2⁶⁴
-		if big.NewInt(randomSeed).ProbablyPrime(1) {
-			if randomSeed > min {
-				return randomSeed
+// mapOffsets converts a sequence of offsets to addresses, stopping once the context is cancelled
+func mapOffsets(ctx context.Context, offsets iter.Seq[uint128], address func(uint128) uint128) iter.Seq[netip.Addr] {
+	return func(yield func(netip.Addr) bool) {
+		done := ctx.Done()
+		for off := range offsets {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if !yield(address(off).addr()) {
+				return
 			}
 		}
 	}
 }
 
-// randomWalkIPv4Range iterates over an IPv4 range using a prime, writing IPs to the output channel
-func randomWalkIPv4Range(min uint32, max uint32, out chan string, quit chan int) {
-	s := int64(max - min)
-	p := findPrimeOverMin(int64(s))
-	if s == 0 {
-		return
+// walkRange returns count offsets (or all of them if count is zero) of a range of size
+// addresses, in the order of the permutation for the seed and limited to the shard
+func walkRange(opts CIDROptions, size uint64, count uint64) (iter.Seq[uint128], error) {
+	shard, shards, err := opts.shard()
+	if err != nil {
+		return nil, err
 	}
 
-	q := p % s
-	for v := int64(0); v < s; v++ {
-		ip := UInt2IPv4(min + uint32(q))
-		select {
-		case <-quit:
-			return
-		case out <- ip:
-			q = (q + p) % s
+	seed, err := opts.seed()
+	if err != nil {
+		return nil, err
+	}
+	perm, err := NewPermutation(size, seed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := perm.Shard(shard, shards); err != nil {
+		return nil, err
+	}
+
+	return func(yield func(uint128) bool) {
+		it, _ := perm.Shard(shard, shards)
+		for n := uint64(0); count == 0 || n < count; n++ {
+			v, ok := it.Next()
+			if !ok || !yield(uint128{lo: v}) {
+				return
+			}
 		}
+	}, nil
+}
+
+// sampleRange returns count random, distinct offsets from zero to maxOffset, limited to the
+// offsets of the shard, which are those that leave the shard number when divided by shards
+func sampleRange(opts CIDROptions, maxOffset uint128, count uint64) (iter.Seq[uint128], error) {
+	shard, shards, err := opts.shard()
+	if err != nil {
+		return nil, err
+	}
+	seed, err := opts.seed()
+	if err != nil {
+		return nil, err
 	}
+
+	return func(yield func(uint128) bool) {
+		if maxOffset.cmp(uint128{lo: shard}) < 0 {
+			return
+		}
+		maxK := maxOffset.sub(uint128{lo: shard}).div64(shards)
+		want := count
+		if maxK.hi == 0 && maxK.lo < want {
+			want = maxK.lo + 1
+		}
+
+		r := rand.New(rand.NewPCG(seed, permutationStream))
+		mask := hostMask128(maxK.bitLen())
+		seen := make(map[uint128]struct{})
+		for uint64(len(seen)) < want {
+			k := uint128{hi: r.Uint64(), lo: r.Uint64()}.and(mask)
+			if k.cmp(maxK) > 0 {
+				continue
+			}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			if !yield(k.mul64(shards).add64(shard)) {
+				return
+			}
+		}
+	}, nil
 }
@@ -0,0 +1,94 @@
+package rnd
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+// benchmarkPrefix is large enough that no benchmark restarts the walk for typical b.N
+var benchmarkPrefix = netip.MustParsePrefix("10.0.0.0/8")
+
+// benchmarkOptions fixes the walk order so runs are comparable
+var benchmarkOptions = CIDROptions{Seed: 1}
+
+// BenchmarkAddrsFromPrefix measures the cost per address of the netip iterator
+func BenchmarkAddrsFromPrefix(b *testing.B) {
+	addrs, err := AddrsFromPrefix(context.Background(), benchmarkPrefix, benchmarkOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		for range addrs {
+			if n++; n == b.N {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkAddrsFromPrefixString includes converting each address to a string, which
+// is what callers of the channel API receive
+func BenchmarkAddrsFromPrefixString(b *testing.B) {
+	addrs, err := AddrsFromPrefix(context.Background(), benchmarkPrefix, benchmarkOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		for addr := range addrs {
+			_ = addr.String()
+			if n++; n == b.N {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkIPv4UIntStrings measures walking addresses as integers converted to and
+// from strings with UInt2IPv4 and IPv42UInt
+func BenchmarkIPv4UIntStrings(b *testing.B) {
+	base, err := AddrToUint32(benchmarkPrefix.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	mask := uint32(1)<<(32-benchmarkPrefix.Bits()) - 1
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := UInt2IPv4(base | uint32(i)&mask)
+		if _, err := IPv42UInt(ip); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAddressesFromCIDR measures the cost per address of the channel API
+func BenchmarkAddressesFromCIDR(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		out := make(chan string)
+		quit := make(chan int)
+		done := make(chan error, 1)
+		go func() {
+			done <- AddressesFromCIDRWithOptions(benchmarkPrefix.String(), benchmarkOptions, out, quit)
+			close(out)
+		}()
+		for range out {
+			if n++; n == b.N {
+				close(quit)
+				break
+			}
+		}
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
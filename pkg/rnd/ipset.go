@@ -0,0 +1,505 @@
+package rnd
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// addrRange is an inclusive range of addresses
+type addrRange struct {
+	first uint128
+	last  uint128
+}
+
+// IPRange is an inclusive range of addresses from the same family
+type IPRange struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// String returns the range as first-last, or as a single address
+func (r IPRange) String() string {
+	if r.First == r.Last {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// Prefixes returns the smallest list of prefixes that covers exactly the range
+func (r IPRange) Prefixes() []netip.Prefix {
+	prefixes, _ := SummarizeRange(r.First, r.Last)
+	return prefixes
+}
+
+// SummarizeRange returns the smallest list of prefixes that covers exactly the range from first to last
+func SummarizeRange(first, last netip.Addr) ([]netip.Prefix, error) {
+	ar, err := newAddrRange(first, last)
+	if err != nil {
+		return nil, err
+	}
+	return ar.prefixes(nil), nil
+}
+
+// IPSetBuilder collects additions and removals of addresses, applied in order, to build an IPSet
+type IPSetBuilder struct {
+	ranges   []addrRange
+	pending  []addrRange
+	removing bool
+}
+
+// Add adds a single address
+func (b *IPSetBuilder) Add(addr netip.Addr) {
+	if addr.IsValid() {
+		v := uint128FromAddr(addr)
+		b.add(addrRange{first: v, last: v})
+	}
+}
+
+// AddPrefix adds every address in a prefix
+func (b *IPSetBuilder) AddPrefix(prefix netip.Prefix) {
+	if prefix.IsValid() {
+		b.add(prefixRange(prefix))
+	}
+}
+
+// AddRange adds every address in a range, returning an error if the range is invalid
+func (b *IPSetBuilder) AddRange(first, last netip.Addr) error {
+	r, err := newAddrRange(first, last)
+	if err != nil {
+		return err
+	}
+	b.add(r)
+	return nil
+}
+
+// AddSet adds every address in another set
+func (b *IPSetBuilder) AddSet(s *IPSet) {
+	b.add(s.ranges...)
+}
+
+// Remove removes a single address
+func (b *IPSetBuilder) Remove(addr netip.Addr) {
+	if addr.IsValid() {
+		v := uint128FromAddr(addr)
+		b.remove(addrRange{first: v, last: v})
+	}
+}
+
+// RemovePrefix removes every address in a prefix
+func (b *IPSetBuilder) RemovePrefix(prefix netip.Prefix) {
+	if prefix.IsValid() {
+		b.remove(prefixRange(prefix))
+	}
+}
+
+// RemoveRange removes every address in a range, returning an error if the range is invalid
+func (b *IPSetBuilder) RemoveRange(first, last netip.Addr) error {
+	r, err := newAddrRange(first, last)
+	if err != nil {
+		return err
+	}
+	b.remove(r)
+	return nil
+}
+
+// RemoveSet removes every address in another set
+func (b *IPSetBuilder) RemoveSet(s *IPSet) {
+	b.remove(s.ranges...)
+}
+
+// Parse adds a CIDR, a bare address, or a dash range (10.0.0.5-10.0.0.90 or 10.0.0.5-90)
+func (b *IPSetBuilder) Parse(spec string) error {
+	r, ok, err := parseRangeSpec(spec)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid address range: %s", spec)
+	}
+	b.add(r)
+	return nil
+}
+
+// IPSet returns the set of addresses added so far. The builder can continue to be used.
+func (b *IPSetBuilder) IPSet() *IPSet {
+	b.flush()
+	return &IPSet{ranges: append([]addrRange{}, b.ranges...)}
+}
+
+// add queues ranges to add, applying any queued removals first
+func (b *IPSetBuilder) add(ranges ...addrRange) {
+	if b.removing {
+		b.flush()
+		b.removing = false
+	}
+	b.pending = append(b.pending, ranges...)
+}
+
+// remove queues ranges to remove, applying any queued additions first
+func (b *IPSetBuilder) remove(ranges ...addrRange) {
+	if !b.removing {
+		b.flush()
+		b.removing = true
+	}
+	b.pending = append(b.pending, ranges...)
+}
+
+// flush applies the queued ranges, so consecutive additions or removals are merged in one pass
+func (b *IPSetBuilder) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+	if b.removing {
+		b.ranges = subtractRanges(b.ranges, mergeRanges(b.pending))
+	} else {
+		b.ranges = mergeRanges(append(b.ranges, b.pending...))
+	}
+	b.pending = nil
+}
+
+// IPSet is an immutable set of IPv4 and IPv6 addresses. IPv4 addresses are stored as their
+// IPv4-mapped IPv6 form, so 10.0.0.1 and ::ffff:10.0.0.1 are the same member. The zero value
+// is an empty set.
+type IPSet struct {
+	ranges []addrRange
+}
+
+// ParseIPSet returns the set of addresses in CIDRs, bare addresses, and dash ranges
+func ParseIPSet(specs ...string) (*IPSet, error) {
+	b := &IPSetBuilder{}
+	for _, spec := range specs {
+		if err := b.Parse(spec); err != nil {
+			return nil, err
+		}
+	}
+	return b.IPSet(), nil
+}
+
+// Union returns the addresses in either set
+func (s *IPSet) Union(o *IPSet) *IPSet {
+	return &IPSet{ranges: mergeRanges(append(append([]addrRange{}, s.ranges...), o.ranges...))}
+}
+
+// Intersect returns the addresses in both sets
+func (s *IPSet) Intersect(o *IPSet) *IPSet {
+	result := []addrRange{}
+	i, j := 0, 0
+	for i < len(s.ranges) && j < len(o.ranges) {
+		a, b := s.ranges[i], o.ranges[j]
+		first, last := a.first, a.last
+		if b.first.cmp(first) > 0 {
+			first = b.first
+		}
+		if b.last.cmp(last) < 0 {
+			last = b.last
+		}
+		if first.cmp(last) <= 0 {
+			result = append(result, addrRange{first: first, last: last})
+		}
+		if a.last.cmp(b.last) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return &IPSet{ranges: result}
+}
+
+// Subtract returns the addresses in the set that are not in the other set
+func (s *IPSet) Subtract(o *IPSet) *IPSet {
+	return &IPSet{ranges: subtractRanges(s.ranges, o.ranges)}
+}
+
+// Equal returns true if both sets contain the same addresses
+func (s *IPSet) Equal(o *IPSet) bool {
+	if len(s.ranges) != len(o.ranges) {
+		return false
+	}
+	for i := range s.ranges {
+		if s.ranges[i] != o.ranges[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// IsEmpty returns true if the set contains no addresses
+func (s *IPSet) IsEmpty() bool {
+	return len(s.ranges) == 0
+}
+
+// Contains returns true if the address is in the set
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	v := uint128FromAddr(addr)
+	i := s.search(v)
+	return i < len(s.ranges) && s.ranges[i].first.cmp(v) <= 0
+}
+
+// ContainsPrefix returns true if every address in the prefix is in the set
+func (s *IPSet) ContainsPrefix(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	r := prefixRange(prefix)
+	i := s.search(r.first)
+	return i < len(s.ranges) && s.ranges[i].first.cmp(r.first) <= 0 && s.ranges[i].last.cmp(r.last) >= 0
+}
+
+// OverlapsPrefix returns true if any address in the prefix is in the set
+func (s *IPSet) OverlapsPrefix(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	r := prefixRange(prefix)
+	i := s.search(r.first)
+	return i < len(s.ranges) && s.ranges[i].first.cmp(r.last) <= 0
+}
+
+// Overlaps returns true if the sets have any address in common
+func (s *IPSet) Overlaps(o *IPSet) bool {
+	return !s.Intersect(o).IsEmpty()
+}
+
+// Count returns the number of addresses in the set
+func (s *IPSet) Count() *big.Int {
+	count := new(big.Int)
+	for _, r := range s.ranges {
+		count.Add(count, r.last.sub(r.first).big())
+		count.Add(count, big.NewInt(1))
+	}
+	return count
+}
+
+// Ranges returns the set as a sorted list of non-overlapping ranges, with IPv4 before IPv6
+func (s *IPSet) Ranges() []IPRange {
+	ranges := []IPRange{}
+	for _, r := range s.ranges {
+		// A range spanning the IPv4-mapped block is split so each range has a single family
+		for _, part := range r.splitFamilies() {
+			ranges = append(ranges, IPRange{First: part.first.addr(), Last: part.last.addr()})
+		}
+	}
+	sortIPv4First(ranges)
+	return ranges
+}
+
+// Prefixes returns the smallest list of prefixes that covers exactly the set, with IPv4 before IPv6
+func (s *IPSet) Prefixes() []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	for _, r := range s.ranges {
+		prefixes = r.prefixes(prefixes)
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return prefixes[i].Addr().Is4() && !prefixes[j].Addr().Is4()
+	})
+	return prefixes
+}
+
+// String returns the prefixes of the set separated by commas
+func (s *IPSet) String() string {
+	parts := []string{}
+	for _, prefix := range s.Prefixes() {
+		parts = append(parts, prefix.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// search returns the index of the first range that ends at or after v
+func (s *IPSet) search(v uint128) int {
+	return sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].last.cmp(v) >= 0
+	})
+}
+
+// ipv4Mapped is the range of IPv4-mapped IPv6 addresses used to store IPv4 addresses
+var ipv4Mapped = addrRange{
+	first: uint128{lo: 0xffff << 32},
+	last:  uint128{lo: 0xffff<<32 | 0xffffffff},
+}
+
+// newAddrRange converts two addresses of the same family to a range
+func newAddrRange(first, last netip.Addr) (addrRange, error) {
+	if !first.IsValid() || !last.IsValid() {
+		return addrRange{}, fmt.Errorf("invalid address range: %s-%s", first, last)
+	}
+	r := addrRange{first: uint128FromAddr(first), last: uint128FromAddr(last)}
+	if r.first.isIPv4() != r.last.isIPv4() {
+		return addrRange{}, fmt.Errorf("invalid address range: %s-%s mixes address families", first, last)
+	}
+	if r.first.cmp(r.last) > 0 {
+		return addrRange{}, fmt.Errorf("invalid address range: %s-%s ends before it starts", first, last)
+	}
+	return r, nil
+}
+
+// prefixRange returns the range of addresses in a prefix
+func prefixRange(prefix netip.Prefix) addrRange {
+	prefix = prefix.Masked()
+	first := uint128FromAddr(prefix.Addr())
+	return addrRange{first: first, last: first.or(hostMask128(prefixHostBits(prefix)))}
+}
+
+// parseRangeSpec parses a CIDR, a bare address, or a dash range, returning false if the
+// specification is not in any of these forms and may be a hostname instead
+func parseRangeSpec(spec string) (addrRange, bool, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return addrRange{}, false, fmt.Errorf("invalid target: empty")
+	}
+
+	if strings.Contains(spec, "/") {
+		prefix, err := parsePrefix(spec)
+		if err != nil {
+			return addrRange{}, true, err
+		}
+		return prefixRange(prefix), true, nil
+	}
+
+	if addr, err := netip.ParseAddr(spec); err == nil {
+		v := uint128FromAddr(addr)
+		return addrRange{first: v, last: v}, true, nil
+	}
+
+	// Hostnames may contain dashes, so only treat this as a range if it starts with an address
+	if i := strings.Index(spec, "-"); i > 0 {
+		if start, err := netip.ParseAddr(spec[:i]); err == nil {
+			r, err := parseDashRange(spec, start, spec[i+1:])
+			return r, true, err
+		}
+	}
+	return addrRange{}, false, nil
+}
+
+// parseDashRange parses the end of a range, which is either a full address of the same
+// family as the start or, for IPv4, the last octet of the end address
+func parseDashRange(spec string, start netip.Addr, endSpec string) (addrRange, error) {
+	end, err := netip.ParseAddr(endSpec)
+	if err != nil && start.Unmap().Is4() {
+		if octet, err2 := strconv.ParseUint(endSpec, 10, 8); err2 == nil {
+			b := start.Unmap().As4()
+			b[3] = byte(octet)
+			end, err = netip.AddrFrom4(b), nil
+		}
+	}
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid target range: %s", spec)
+	}
+
+	first, last := uint128FromAddr(start), uint128FromAddr(end)
+	if first.isIPv4() != last.isIPv4() {
+		return addrRange{}, fmt.Errorf("invalid target range: %s mixes address families", spec)
+	}
+	if first.cmp(last) > 0 {
+		return addrRange{}, fmt.Errorf("invalid target range: %s ends before it starts", spec)
+	}
+	return addrRange{first: first, last: last}, nil
+}
+
+// splitFamilies splits the range at the edges of the IPv4-mapped block
+func (r addrRange) splitFamilies() []addrRange {
+	parts := []addrRange{}
+	if r.first.cmp(ipv4Mapped.first) < 0 && r.last.cmp(ipv4Mapped.first) >= 0 {
+		parts = append(parts, addrRange{first: r.first, last: ipv4Mapped.first.sub(uint128{lo: 1})})
+		r.first = ipv4Mapped.first
+	}
+	if r.first.cmp(ipv4Mapped.last) <= 0 && r.last.cmp(ipv4Mapped.last) > 0 {
+		parts = append(parts, addrRange{first: r.first, last: ipv4Mapped.last})
+		r.first = ipv4Mapped.last.add64(1)
+	}
+	return append(parts, r)
+}
+
+// prefixes appends the largest aligned blocks that exactly cover the range. Blocks within the
+// IPv4-mapped block are IPv4 prefixes, and any block containing more than that is IPv6.
+func (r addrRange) prefixes(dst []netip.Prefix) []netip.Prefix {
+	first := r.first
+	for {
+		// The block is limited by the alignment of its start and by the addresses left in the range
+		size := first.trailingZeros()
+		if left := r.last.sub(first); !left.isMax() {
+			if n := left.add64(1).bitLen() - 1; n < size {
+				size = n
+			}
+		}
+
+		addr := first.addr()
+		bits := 128 - size
+		if addr.Is4() {
+			bits -= 96
+		}
+		dst = append(dst, netip.PrefixFrom(addr, bits))
+
+		last := first.or(hostMask128(size))
+		if last.cmp(r.last) >= 0 {
+			return dst
+		}
+		first = last.add64(1)
+	}
+}
+
+// mergeRanges returns the ranges sorted by address with overlapping and adjacent ranges combined
+func mergeRanges(ranges []addrRange) []addrRange {
+	sorted := append([]addrRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].first.cmp(sorted[j].first) < 0
+	})
+
+	merged := []addrRange{}
+	for _, r := range sorted {
+		if n := len(merged); n > 0 {
+			cur := &merged[n-1]
+			if cur.last.isMax() || r.first.cmp(cur.last.add64(1)) <= 0 {
+				if r.last.cmp(cur.last) > 0 {
+					cur.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// subtractRanges removes the excluded ranges from the included ones, both of which must be merged
+func subtractRanges(include, exclude []addrRange) []addrRange {
+	result := []addrRange{}
+	j := 0
+	for _, r := range include {
+		// Exclusions that end before this range cannot affect it or any later one
+		for j < len(exclude) && exclude[j].last.cmp(r.first) < 0 {
+			j++
+		}
+
+		cur := r
+		covered := false
+		for k := j; k < len(exclude) && exclude[k].first.cmp(cur.last) <= 0; k++ {
+			ex := exclude[k]
+			if ex.first.cmp(cur.first) > 0 {
+				result = append(result, addrRange{first: cur.first, last: ex.first.sub(uint128{lo: 1})})
+			}
+			if ex.last.cmp(cur.last) >= 0 {
+				covered = true
+				break
+			}
+			cur.first = ex.last.add64(1)
+		}
+		if !covered {
+			result = append(result, cur)
+		}
+	}
+	return result
+}
+
+// sortIPv4First moves IPv4 ranges ahead of IPv6 ranges, keeping the order within each family
+func sortIPv4First(ranges []IPRange) {
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].First.Is4() && !ranges[j].First.Is4()
+	})
+}
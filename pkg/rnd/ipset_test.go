@@ -0,0 +1,185 @@
+package rnd
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+// mustParseIPSet returns the set of addresses in specs or fails the test
+func mustParseIPSet(t *testing.T, specs ...string) *IPSet {
+	t.Helper()
+	s, err := ParseIPSet(specs...)
+	if err != nil {
+		t.Fatalf("%v: %s", specs, err)
+	}
+	return s
+}
+
+// TestParseIPSet checks that overlapping and adjacent inputs are merged and that the count is exact
+func TestParseIPSet(t *testing.T) {
+	tests := []struct {
+		specs  []string
+		ranges string
+		count  string
+	}{
+		{[]string{"10.0.0.1"}, "10.0.0.1", "1"},
+		{[]string{"10.0.0.0/24"}, "10.0.0.0-10.0.0.255", "256"},
+		{[]string{"10.0.0.5-90"}, "10.0.0.5-10.0.0.90", "86"},
+		{[]string{"10.0.0.5-10.0.1.4"}, "10.0.0.5-10.0.1.4", "256"},
+		{[]string{"10.0.0.7-7"}, "10.0.0.7", "1"},
+		// Overlapping
+		{[]string{"10.0.0.0/24", "10.0.0.128/25"}, "10.0.0.0-10.0.0.255", "256"},
+		{[]string{"10.0.0.0-100", "10.0.0.50-150"}, "10.0.0.0-10.0.0.150", "151"},
+		// Adjacent
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.0.0-10.0.0.255", "256"},
+		{[]string{"10.0.0.0-9", "10.0.0.10-19"}, "10.0.0.0-10.0.0.19", "20"},
+		{[]string{"10.0.0.255", "10.0.1.0"}, "10.0.0.255-10.0.1.0", "2"},
+		// One address apart is not adjacent
+		{[]string{"10.0.0.0-9", "10.0.0.11-19"}, "10.0.0.0-10.0.0.9,10.0.0.11-10.0.0.19", "19"},
+		// Mixed families, with IPv4 reported first
+		{[]string{"2001:db8::/126", "192.0.2.0/30"}, "192.0.2.0-192.0.2.3,2001:db8::-2001:db8::3", "8"},
+		{[]string{"::ffff:10.0.0.1", "10.0.0.1"}, "10.0.0.1", "1"},
+		{[]string{"2001:db8::ffff-2001:db8::1:0"}, "2001:db8::ffff-2001:db8::1:0", "2"},
+		{[]string{"0.0.0.0/0", "::/0"}, "0.0.0.0-255.255.255.255,::-::fffe:ffff:ffff,::1:0:0:0-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "340282366920938463463374607431768211456"},
+	}
+	for _, tt := range tests {
+		s := mustParseIPSet(t, tt.specs...)
+		ranges := ""
+		for i, r := range s.Ranges() {
+			if i > 0 {
+				ranges += ","
+			}
+			ranges += r.String()
+		}
+		if ranges != tt.ranges {
+			t.Errorf("%v: got %s, want %s", tt.specs, ranges, tt.ranges)
+		}
+		if got := s.Count().String(); got != tt.count {
+			t.Errorf("%v: count is %s, want %s", tt.specs, got, tt.count)
+		}
+	}
+}
+
+// TestParseIPSetInvalid checks that malformed ranges are rejected
+func TestParseIPSetInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"example.com",
+		"10.0.0.0/33",
+		"10.0.0.90-5",
+		"10.0.0.5-256",
+		"10.0.0.5-2001:db8::1",
+		"2001:db8::1-5",
+		"2001:db8::2-2001:db8::1",
+	} {
+		if _, err := ParseIPSet(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+// TestIPSetBuilderOrder checks that additions and removals apply in the order they are made
+func TestIPSetBuilderOrder(t *testing.T) {
+	b := &IPSetBuilder{}
+	b.AddPrefix(netip.MustParsePrefix("10.0.0.0/24"))
+	b.Remove(netip.MustParseAddr("10.0.0.10"))
+	if err := b.RemoveRange(netip.MustParseAddr("10.0.0.100"), netip.MustParseAddr("10.0.0.255")); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.IPSet().String(); got != "10.0.0.0/29,10.0.0.8/31,10.0.0.11/32,10.0.0.12/30,10.0.0.16/28,10.0.0.32/27,10.0.0.64/27,10.0.0.96/30" {
+		t.Errorf("after removals: got %s", got)
+	}
+
+	// Adding back after a removal restores the addresses
+	b.Add(netip.MustParseAddr("10.0.0.10"))
+	b.AddPrefix(netip.MustParsePrefix("10.0.0.128/25"))
+	if err := b.AddRange(netip.MustParseAddr("10.0.0.100"), netip.MustParseAddr("10.0.0.127")); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.IPSet().String(); got != "10.0.0.0/24" {
+		t.Errorf("after additions: got %s", got)
+	}
+
+	if err := b.AddRange(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")); err == nil {
+		t.Errorf("reversed range: expected an error")
+	}
+	if err := b.AddRange(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")); err == nil {
+		t.Errorf("mixed range: expected an error")
+	}
+}
+
+// TestIPSetOperations checks union, intersection, and subtraction across both families
+func TestIPSetOperations(t *testing.T) {
+	a := mustParseIPSet(t, "10.0.0.0/24", "2001:db8::/120")
+	b := mustParseIPSet(t, "10.0.0.128/25", "10.0.1.0/24", "2001:db8::80-2001:db8::1ff")
+
+	tests := []struct {
+		name string
+		got  *IPSet
+		want *IPSet
+	}{
+		{"union", a.Union(b), mustParseIPSet(t, "10.0.0.0/23", "2001:db8::/119")},
+		{"intersect", a.Intersect(b), mustParseIPSet(t, "10.0.0.128/25", "2001:db8::80/121")},
+		{"subtract", a.Subtract(b), mustParseIPSet(t, "10.0.0.0/25", "2001:db8::/121")},
+		{"subtract reversed", b.Subtract(a), mustParseIPSet(t, "10.0.1.0/24", "2001:db8::100/120")},
+		{"subtract all", a.Subtract(a), &IPSet{}},
+		{"intersect empty", a.Intersect(&IPSet{}), &IPSet{}},
+		{"subtract v4 only", a.Subtract(mustParseIPSet(t, "0.0.0.0/0")), mustParseIPSet(t, "2001:db8::/120")},
+	}
+	for _, tt := range tests {
+		if !tt.got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if !a.Overlaps(b) || a.Overlaps(mustParseIPSet(t, "10.0.2.0/24")) {
+		t.Errorf("Overlaps is wrong")
+	}
+	if !a.ContainsPrefix(netip.MustParsePrefix("10.0.0.64/26")) || a.ContainsPrefix(netip.MustParsePrefix("10.0.0.0/23")) {
+		t.Errorf("ContainsPrefix is wrong")
+	}
+	if !a.OverlapsPrefix(netip.MustParsePrefix("10.0.0.0/23")) || a.OverlapsPrefix(netip.MustParsePrefix("10.0.1.0/24")) {
+		t.Errorf("OverlapsPrefix is wrong")
+	}
+	for addr, want := range map[string]bool{
+		"10.0.0.0":         true,
+		"10.0.0.255":       true,
+		"10.0.1.0":         false,
+		"::ffff:10.0.0.1":  true,
+		"2001:db8::ff":     true,
+		"2001:db8::100":    false,
+		"2001:db8::a00:1":  false,
+		"::a00:1":          false,
+		"9.255.255.255":    false,
+		"2001:db7:ffff::1": false,
+	} {
+		if got := a.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) is %t", addr, got)
+		}
+	}
+}
+
+// TestSummarizeRange checks that ranges are covered by the fewest aligned prefixes
+func TestSummarizeRange(t *testing.T) {
+	tests := []struct {
+		first, last string
+		want        string
+	}{
+		{"10.0.0.0", "10.0.0.255", "[10.0.0.0/24]"},
+		{"10.0.0.1", "10.0.0.6", "[10.0.0.1/32 10.0.0.2/31 10.0.0.4/31 10.0.0.6/32]"},
+		{"0.0.0.0", "255.255.255.255", "[0.0.0.0/0]"},
+		{"2001:db8::", "2001:db8::ffff:ffff:ffff:ffff", "[2001:db8::/64]"},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "[::/0]"},
+	}
+	for _, tt := range tests {
+		prefixes, err := SummarizeRange(netip.MustParseAddr(tt.first), netip.MustParseAddr(tt.last))
+		if err != nil {
+			t.Errorf("%s-%s: %s", tt.first, tt.last, err)
+			continue
+		}
+		if got := fmt.Sprint(prefixes); got != tt.want {
+			t.Errorf("%s-%s: got %s, want %s", tt.first, tt.last, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package rnd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+// NTLMSSP messages are carried the same way by SMB, HTTP, SMTP, LDAP, MSSQL, and RPC, usually
+// inside a SPNEGO token. The decoder below locates the message by its signature, so it accepts
+// a raw reply, a security blob, or a decoded authentication header from any of them.
+//
+
+// ErrNoNTLMChallenge is returned when a reply does not contain a NTLMSSP CHALLENGE message
+var ErrNoNTLMChallenge = errors.New("no NTLMSSP challenge found")
+
+// ntlmChallengeSignature marks the start of a NTLMSSP CHALLENGE (type 2) message
+var ntlmChallengeSignature = []byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00, 0x02, 0x00, 0x00, 0x00}
+
+// NTLMSSP negotiate flags (MS-NLMP 2.2.2.5)
+const (
+	NTLMNegotiateUnicode                 = 0x00000001
+	NTLMNegotiateOEM                     = 0x00000002
+	NTLMRequestTarget                    = 0x00000004
+	NTLMNegotiateSign                    = 0x00000010
+	NTLMNegotiateSeal                    = 0x00000020
+	NTLMNegotiateDatagram                = 0x00000040
+	NTLMNegotiateLMKey                   = 0x00000080
+	NTLMNegotiateNTLM                    = 0x00000200
+	NTLMNegotiateAnonymous               = 0x00000800
+	NTLMNegotiateOEMDomainSupplied       = 0x00001000
+	NTLMNegotiateOEMWorkstationSupplied  = 0x00002000
+	NTLMNegotiateAlwaysSign              = 0x00008000
+	NTLMTargetTypeDomain                 = 0x00010000
+	NTLMTargetTypeServer                 = 0x00020000
+	NTLMNegotiateExtendedSessionSecurity = 0x00080000
+	NTLMNegotiateIdentify                = 0x00100000
+	NTLMRequestNonNTSessionKey           = 0x00400000
+	NTLMNegotiateTargetInfo              = 0x00800000
+	NTLMNegotiateVersion                 = 0x02000000
+	NTLMNegotiate128                     = 0x20000000
+	NTLMNegotiateKeyExchange             = 0x40000000
+	NTLMNegotiate56                      = 0x80000000
+)
+
+// ntlmNegotiateFlagNames names each negotiate flag, in bit order
+var ntlmNegotiateFlagNames = []bitName{
+	{NTLMNegotiateUnicode, "unicode"},
+	{NTLMNegotiateOEM, "oem"},
+	{NTLMRequestTarget, "request-target"},
+	{NTLMNegotiateSign, "sign"},
+	{NTLMNegotiateSeal, "seal"},
+	{NTLMNegotiateDatagram, "datagram"},
+	{NTLMNegotiateLMKey, "lm-key"},
+	{NTLMNegotiateNTLM, "ntlm"},
+	{NTLMNegotiateAnonymous, "anonymous"},
+	{NTLMNegotiateOEMDomainSupplied, "oem-domain-supplied"},
+	{NTLMNegotiateOEMWorkstationSupplied, "oem-workstation-supplied"},
+	{NTLMNegotiateAlwaysSign, "always-sign"},
+	{NTLMTargetTypeDomain, "target-type-domain"},
+	{NTLMTargetTypeServer, "target-type-server"},
+	{NTLMNegotiateExtendedSessionSecurity, "extended-session-security"},
+	{NTLMNegotiateIdentify, "identify"},
+	{NTLMRequestNonNTSessionKey, "request-non-nt-session-key"},
+	{NTLMNegotiateTargetInfo, "target-info"},
+	{NTLMNegotiateVersion, "version"},
+	{NTLMNegotiate128, "128"},
+	{NTLMNegotiateKeyExchange, "key-exchange"},
+	{NTLMNegotiate56, "56"},
+}
+
+// NTLMNegotiateFlagNames returns the names of the flags that are set, with any reserved bits
+// reported as hex values
+func NTLMNegotiateFlagNames(flags uint32) []string {
+	return bitNames(flags, ntlmNegotiateFlagNames)
+}
+
+// NTLMSSP AV_PAIR attribute IDs (MS-NLMP 2.2.2.1)
+const (
+	NTLMAvEOL             = 0x0000
+	NTLMAvNbComputerName  = 0x0001
+	NTLMAvNbDomainName    = 0x0002
+	NTLMAvDNSComputerName = 0x0003
+	NTLMAvDNSDomainName   = 0x0004
+	NTLMAvDNSTreeName     = 0x0005
+	NTLMAvFlags           = 0x0006
+	NTLMAvTimestamp       = 0x0007
+	NTLMAvSingleHost      = 0x0008
+	NTLMAvTargetName      = 0x0009
+	NTLMAvChannelBindings = 0x000a
+)
+
+// NTLMSSP MsvAvFlags values
+const (
+	NTLMAvFlagConstrained  = 0x00000001
+	NTLMAvFlagMIC          = 0x00000002
+	NTLMAvFlagUntrustedSPN = 0x00000004
+)
+
+// NTLMAvFlagNames returns the names of the MsvAvFlags that are set
+func NTLMAvFlagNames(flags uint32) []string {
+	return bitNames(flags, []bitName{
+		{NTLMAvFlagConstrained, "constrained"},
+		{NTLMAvFlagMIC, "mic"},
+		{NTLMAvFlagUntrustedSPN, "untrusted-spn"},
+	})
+}
+
+// NTLMAVPair is a single attribute from the target info of a NTLMSSP message
+type NTLMAVPair struct {
+	Type  uint16 `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// NTLMSingleHost holds the Single_Host_Data attribute
+type NTLMSingleHost struct {
+	CustomData []byte `json:"custom_data"`
+	MachineID  []byte `json:"machine_id"`
+}
+
+// NTLMChallengeInfo holds the fields of a NTLMSSP CHALLENGE message
+type NTLMChallengeInfo struct {
+	TargetName      string          `json:"target_name"`
+	NegotiateFlags  uint32          `json:"negotiate_flags"`
+	FlagNames       []string        `json:"negotiate_flag_names,omitempty"`
+	Challenge       []byte          `json:"challenge"`
+	Reserved        []byte          `json:"reserved"`
+	Version         NTLMVersion     `json:"version"`
+	Product         string          `json:"product,omitempty"`
+	NTLMRevision    uint32          `json:"ntlm_revision"`
+	NetbiosComputer string          `json:"netbios_computer,omitempty"`
+	NetbiosDomain   string          `json:"netbios_domain,omitempty"`
+	DNSComputer     string          `json:"dns_computer,omitempty"`
+	DNSDomain       string          `json:"dns_domain,omitempty"`
+	DNSTree         string          `json:"dns_tree,omitempty"`
+	AvFlags         *uint32         `json:"av_flags,omitempty"`
+	Timestamp       *time.Time      `json:"timestamp,omitempty"`
+	SingleHost      *NTLMSingleHost `json:"single_host,omitempty"`
+	TargetSPN       string          `json:"target_spn,omitempty"`
+	ChannelBindings []byte          `json:"channel_bindings,omitempty"`
+	// AVPairs holds every attribute of the target info in order, including unknown types
+	AVPairs []NTLMAVPair `json:"-"`
+	// Warnings describes the parts of the target name and target info that could not be decoded
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// warn records a problem with optional data in the message
+func (ci *NTLMChallengeInfo) warn(err error) {
+	ci.Warnings = append(ci.Warnings, err.Error())
+}
+
+// NTLMVersion is the operating system version reported in a NTLMSSP message
+type NTLMVersion struct {
+	Major uint8  `json:"major"`
+	Minor uint8  `json:"minor"`
+	Build uint16 `json:"build"`
+}
+
+// String returns the version as major.minor.build
+func (v NTLMVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Build)
+}
+
+// ntlmWindows10Builds maps the builds of Windows 10, 11, and Server 2016 and later to releases
+var ntlmWindows10Builds = map[uint16]string{
+	10240: "Windows 10 1507",
+	10586: "Windows 10 1511",
+	14393: "Windows 10 1607 / Server 2016",
+	15063: "Windows 10 1703",
+	16299: "Windows 10 1709 / Server 1709",
+	17134: "Windows 10 1803 / Server 1803",
+	17763: "Windows 10 1809 / Server 2019",
+	18362: "Windows 10 1903 / Server 1903",
+	18363: "Windows 10 1909 / Server 1909",
+	19041: "Windows 10 2004 / Server 2004",
+	19042: "Windows 10 20H2 / Server 20H2",
+	19043: "Windows 10 21H1",
+	19044: "Windows 10 21H2",
+	19045: "Windows 10 22H2",
+	20348: "Windows Server 2022",
+	22000: "Windows 11 21H2",
+	22621: "Windows 11 22H2",
+	22631: "Windows 11 23H2",
+	25398: "Windows Server 23H2",
+	26100: "Windows 11 24H2 / Server 2025",
+}
+
+// Product returns the Windows release matching the version, or an empty string if unknown.
+// The same build is shared by client and server releases, so both are named where they exist.
+func (v NTLMVersion) Product() string {
+	switch {
+	case v.Major == 5 && v.Minor == 0:
+		return "Windows 2000"
+	case v.Major == 5 && v.Minor == 1:
+		return "Windows XP"
+	case v.Major == 5 && v.Minor == 2:
+		return "Windows XP x64 / Server 2003"
+	case v.Major == 6 && v.Minor == 0:
+		return "Windows Vista / Server 2008"
+	case v.Major == 6 && v.Minor == 1:
+		return "Windows 7 / Server 2008 R2"
+	case v.Major == 6 && v.Minor == 2:
+		return "Windows 8 / Server 2012"
+	case v.Major == 6 && v.Minor == 3:
+		return "Windows 8.1 / Server 2012 R2"
+	case v.Major == 10 && v.Minor == 0:
+		if name, ok := ntlmWindows10Builds[v.Build]; ok {
+			return name
+		}
+		if v.Build >= 22000 {
+			return fmt.Sprintf("Windows 11 / Server (build %d)", v.Build)
+		}
+		return fmt.Sprintf("Windows 10 / Server (build %d)", v.Build)
+	}
+	return ""
+}
+
+// ParseNTLMChallenge decodes the NTLMSSP CHALLENGE message found in a reply, security blob,
+// or SPNEGO token. An error is only returned if the message or its fixed fields are missing;
+// problems with the target name or target info are recorded in Warnings.
+func ParseNTLMChallenge(blob []byte) (*NTLMChallengeInfo, error) {
+	ntlmsspOffset := bytes.Index(blob, ntlmChallengeSignature)
+	if ntlmsspOffset < 0 {
+		return nil, ErrNoNTLMChallenge
+	}
+	data := blob[ntlmsspOffset:]
+
+	// The fixed fields run through the target info descriptor
+	if len(data) < 48 {
+		return nil, smbTruncated("NTLMSSP challenge", "fixed fields", 0, 48, len(data))
+	}
+
+	ci := &NTLMChallengeInfo{
+		NegotiateFlags: binary.LittleEndian.Uint32(data[20:]),
+		Challenge:      append([]byte{}, data[24:32]...),
+		Reserved:       append([]byte{}, data[32:40]...),
+	}
+	// The target name uses the OEM code page unless Unicode was negotiated; the AV pairs of
+	// the target info are always UTF-16
+	if targetName, err := readSecurityBuffer("NTLMSSP challenge", "target name", data, 12); err != nil {
+		ci.warn(err)
+	} else if ci.NegotiateFlags&NTLMNegotiateUnicode != 0 {
+		ci.TargetName = TrimName(utf16LEToString(targetName))
+	} else {
+		ci.TargetName = TrimName(string(targetName))
+	}
+	ci.FlagNames = NTLMNegotiateFlagNames(ci.NegotiateFlags)
+
+	// The version is only present when negotiated, otherwise the payload may start in its place
+	if len(data) >= 56 && (ci.NegotiateFlags&NTLMNegotiateVersion != 0 || ntlmPayloadStart(data) >= 56) {
+		ci.Version = NTLMVersion{
+			Major: data[48],
+			Minor: data[49],
+			Build: binary.LittleEndian.Uint16(data[50:]),
+		}
+		ci.NTLMRevision = binary.BigEndian.Uint32(data[52:])
+
+		// macOS reverses the endian order of this field for some reason
+		if ci.NTLMRevision == 251658240 {
+			ci.NTLMRevision = binary.LittleEndian.Uint32(data[52:])
+		}
+		ci.Product = ci.Version.Product()
+	}
+
+	if targetInfo, err := readSecurityBuffer("NTLMSSP challenge", "target info", data, 40); err != nil {
+		ci.warn(err)
+	} else {
+		ci.parseTargetInfo(targetInfo)
+	}
+	return ci, nil
+}
+
+// ParseNTLMChallengeHeader decodes the NTLMSSP CHALLENGE message in the value of a HTTP
+// WWW-Authenticate header (or a similar SMTP, POP3, or IMAP reply), such as "NTLM TlRMTVNT..."
+// or "Negotiate oYIB...". A value without a scheme is treated as the base64 token alone.
+func ParseNTLMChallengeHeader(value string) (*NTLMChallengeInfo, error) {
+	token := strings.TrimSpace(value)
+	if scheme, rest, ok := strings.Cut(token, " "); ok && (strings.EqualFold(scheme, "NTLM") || strings.EqualFold(scheme, "Negotiate")) {
+		token = strings.TrimSpace(rest)
+	}
+	blob, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("NTLMSSP challenge header: %w", err)
+	}
+	return ParseNTLMChallenge(blob)
+}
+
+// ntlmPayloadStart returns the offset of the first value referenced by the target name or
+// target info descriptors, or the message length if neither has a value
+func ntlmPayloadStart(data []byte) int {
+	start := len(data)
+	for _, idx := range []int{12, 40} {
+		length := binary.LittleEndian.Uint16(data[idx:])
+		offset := binary.LittleEndian.Uint32(data[idx+4:])
+		if length > 0 && int64(offset) < int64(start) {
+			start = int(offset)
+		}
+	}
+	return start
+}
+
+// parseTargetInfo decodes the AV pairs of the target info, skipping values that are too short
+// for their type and stopping at one that runs past the end
+func (ci *NTLMChallengeInfo) parseTargetInfo(targetInfo []byte) {
+	idx := 0
+	for idx+4 <= len(targetInfo) {
+		attrType := binary.LittleEndian.Uint16(targetInfo[idx:])
+		attrLen := int(binary.LittleEndian.Uint16(targetInfo[idx+2:]))
+		idx += 4
+
+		if attrType == NTLMAvEOL {
+			break
+		}
+		if idx+attrLen > len(targetInfo) {
+			ci.warn(smbTruncated("NTLMSSP target info", fmt.Sprintf("attribute %d", attrType), idx, attrLen, len(targetInfo)))
+			return
+		}
+		attrVal := targetInfo[idx : idx+attrLen]
+		ci.AVPairs = append(ci.AVPairs, NTLMAVPair{Type: attrType, Value: append([]byte{}, attrVal...)})
+
+		switch attrType {
+		case NTLMAvNbComputerName:
+			ci.NetbiosComputer = TrimName(utf16LEToString(attrVal))
+		case NTLMAvNbDomainName:
+			ci.NetbiosDomain = TrimName(utf16LEToString(attrVal))
+		case NTLMAvDNSComputerName:
+			ci.DNSComputer = TrimName(utf16LEToString(attrVal))
+		case NTLMAvDNSDomainName:
+			ci.DNSDomain = TrimName(utf16LEToString(attrVal))
+		case NTLMAvDNSTreeName:
+			ci.DNSTree = TrimName(utf16LEToString(attrVal))
+		case NTLMAvFlags:
+			if len(attrVal) < 4 {
+				ci.warn(smbTruncated("NTLMSSP target info", "flags", idx, 4, idx+attrLen))
+				break
+			}
+			flags := binary.LittleEndian.Uint32(attrVal)
+			ci.AvFlags = &flags
+		case NTLMAvTimestamp:
+			if len(attrVal) < 8 {
+				ci.warn(smbTruncated("NTLMSSP target info", "timestamp", idx, 8, idx+attrLen))
+				break
+			}
+			ts := FiletimeToTime(binary.LittleEndian.Uint64(attrVal))
+			ci.Timestamp = &ts
+		case NTLMAvSingleHost:
+			// Size (4), Z4 (4), CustomData (8), MachineID (32)
+			if len(attrVal) < 48 {
+				ci.warn(smbTruncated("NTLMSSP target info", "single host", idx, 48, idx+attrLen))
+				break
+			}
+			ci.SingleHost = &NTLMSingleHost{
+				CustomData: append([]byte{}, attrVal[8:16]...),
+				MachineID:  append([]byte{}, attrVal[16:48]...),
+			}
+		case NTLMAvTargetName:
+			ci.TargetSPN = TrimName(utf16LEToString(attrVal))
+		case NTLMAvChannelBindings:
+			ci.ChannelBindings = append([]byte{}, attrVal...)
+		}
+		idx += attrLen
+	}
+}
+
+// Fields adds the challenge info to a map using the ntlmssp.* keys
+func (ci *NTLMChallengeInfo) Fields(info map[string]string) {
+	info["ntlmssp.NegotiationFlags"] = fmt.Sprintf("0x%.8x", ci.NegotiateFlags)
+	info["ntlmssp.NegotiationFlagNames"] = strings.Join(ci.FlagNames, "\t")
+	info["ntlmssp.Version"] = ci.Version.String()
+	info["ntlmssp.NTLMRevision"] = fmt.Sprintf("%d", ci.NTLMRevision)
+	info["ntlmssp.TargetName"] = ci.TargetName
+	if ci.Product != "" {
+		info["ntlmssp.Product"] = ci.Product
+	}
+	if ci.NetbiosComputer != "" {
+		info["ntlmssp.NetbiosComputer"] = ci.NetbiosComputer
+	}
+	if ci.NetbiosDomain != "" {
+		info["ntlmssp.NetbiosDomain"] = ci.NetbiosDomain
+	}
+	if ci.DNSComputer != "" {
+		info["ntlmssp.DNSComputer"] = ci.DNSComputer
+	}
+	if ci.DNSDomain != "" {
+		info["ntlmssp.DNSDomain"] = ci.DNSDomain
+	}
+	if ci.DNSTree != "" {
+		info["ntlmssp.DNSTree"] = ci.DNSTree
+	}
+	if ci.AvFlags != nil {
+		info["ntlmssp.AvFlags"] = fmt.Sprintf("0x%.8x", *ci.AvFlags)
+	}
+	if ci.Timestamp != nil {
+		info["ntlmssp.Timestamp"] = fmt.Sprintf("0x%.16x", TimeToFiletime(*ci.Timestamp))
+	}
+	if ci.TargetSPN != "" {
+		info["ntlmssp.TargetSPN"] = ci.TargetSPN
+	}
+}
@@ -0,0 +1,83 @@
+package rnd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"unicode/utf16"
+)
+
+// windows7600Challenge is the NTLMSSP CHALLENGE sent by a Windows 6.1.7600 server, from the test
+// suite of github.com/hirochachacha/go-smb2
+const windows7600Challenge = "4e544c4d5353500002000000100010003800000035828962a9d9c92cf4152e98000000000000000066006600480000000601b01d0f000000460041004b004500520055004e00450001001000460041004b004500520055004e00450002001000460041004b004500520055004e00450003001c00660061006b006500720075006e0065002e006c006f00630061006c0004000a006c006f00630061006c00070008000076b91516c2d10100000000"
+
+// testNTLMChallenge returns a CHALLENGE message with the flags and raw target name, and target info
+// holding the NetBIOS domain name DOMAIN
+func testNTLMChallenge(flags uint32, targetName []byte) []byte {
+	var info []byte
+	domain := utf16.Encode([]rune("DOMAIN"))
+	info = binary.LittleEndian.AppendUint16(info, NTLMAvNbDomainName)
+	info = binary.LittleEndian.AppendUint16(info, uint16(len(domain)*2))
+	for _, c := range domain {
+		info = binary.LittleEndian.AppendUint16(info, c)
+	}
+	info = append(info, 0, 0, 0, 0)
+
+	msg := append([]byte("NTLMSSP\x00"), 2, 0, 0, 0)
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(targetName)))
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(targetName)))
+	msg = binary.LittleEndian.AppendUint32(msg, 56)
+	msg = binary.LittleEndian.AppendUint32(msg, flags|NTLMNegotiateVersion)
+	msg = append(msg, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(info)))
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(info)))
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(56+len(targetName)))
+	msg = append(msg, 6, 1, 0xb0, 0x1d, 0, 0, 0, 0x0f)
+	msg = append(msg, targetName...)
+	return append(msg, info...)
+}
+
+// TestParseNTLMChallengeTargetName checks that the target name is decoded as UTF-16 only when
+// Unicode was negotiated, while the target info is always UTF-16
+func TestParseNTLMChallengeTargetName(t *testing.T) {
+	capture, _ := hex.DecodeString(windows7600Challenge)
+	tests := []struct {
+		name   string
+		blob   []byte
+		target string
+		domain string
+	}{
+		{"windows 6.1.7600", capture, "FAKERUNE", "FAKERUNE"},
+		{"unicode", testNTLMChallenge(NTLMNegotiateUnicode, []byte("W\x00O\x00R\x00K\x00G\x00R\x00O\x00U\x00P\x00")), "WORKGROUP", "DOMAIN"},
+		{"oem", testNTLMChallenge(NTLMNegotiateOEM, []byte("WORKGROUP")), "WORKGROUP", "DOMAIN"},
+		{"oem padded", testNTLMChallenge(NTLMNegotiateOEM, []byte("WORKGROUP\x00\x00 ")), "WORKGROUP", "DOMAIN"},
+		{"oem odd length", testNTLMChallenge(NTLMNegotiateOEM, []byte("LAB")), "LAB", "DOMAIN"},
+		{"no charset", testNTLMChallenge(0, []byte("LAB")), "LAB", "DOMAIN"},
+	}
+	for _, tt := range tests {
+		ci, err := ParseNTLMChallenge(tt.blob)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if ci.TargetName != tt.target || ci.NetbiosDomain != tt.domain {
+			t.Errorf("%s: got target name %q and domain %q, want %q and %q", tt.name, ci.TargetName, ci.NetbiosDomain, tt.target, tt.domain)
+		}
+		if len(ci.Warnings) != 0 {
+			t.Errorf("%s: got warnings %v", tt.name, ci.Warnings)
+		}
+	}
+}
+
+// FuzzParseNTLMChallenge checks that the challenge parser never panics and returns either
+// the challenge info or an error
+func FuzzParseNTLMChallenge(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ci, err := ParseNTLMChallenge(data)
+		if (ci == nil) == (err == nil) {
+			t.Fatalf("got info %v with error %v", ci, err)
+		}
+		if ci != nil {
+			ci.Fields(make(map[string]string))
+		}
+	})
+}
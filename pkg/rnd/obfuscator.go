@@ -0,0 +1,116 @@
+package rnd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Obfuscator XORs addresses and data with its own pair of keys. IPv4 addresses and other
+// 32-bit values use the 32-bit key, while IPv6 addresses and data of any other length use the
+// 64-bit key, repeated as needed. The keys never change once created, so an Obfuscator is
+// safe for concurrent use, and applying it twice returns the original value.
+type Obfuscator struct {
+	key32 uint32
+	key64 uint64
+}
+
+// NewObfuscator returns an obfuscator with random keys
+func NewObfuscator() (*Obfuscator, error) {
+	return NewObfuscatorFrom(nil)
+}
+
+// NewObfuscatorFrom returns an obfuscator with keys read from a random source (nil for crypto/rand)
+func NewObfuscatorFrom(src io.Reader) (*Obfuscator, error) {
+	b, err := RandomBytesFrom(src, 12)
+	if err != nil {
+		return nil, fmt.Errorf("obfuscator keys: %w", err)
+	}
+	return NewObfuscatorWithKeys(binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint64(b[4:12])), nil
+}
+
+// NewObfuscatorWithKeys returns an obfuscator with the specified keys, such as those of a previous scan
+func NewObfuscatorWithKeys(key32 uint32, key64 uint64) *Obfuscator {
+	return &Obfuscator{key32: key32, key64: key64}
+}
+
+// Key32 returns the 32-bit key
+func (o *Obfuscator) Key32() uint32 {
+	return o.key32
+}
+
+// Key64 returns the 64-bit key
+func (o *Obfuscator) Key64() uint64 {
+	return o.key64
+}
+
+// Key32Bytes returns the 32-bit key in network byte order
+func (o *Obfuscator) Key32Bytes() [4]byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], o.key32)
+	return b
+}
+
+// Key64Bytes returns the 64-bit key in network byte order
+func (o *Obfuscator) Key64Bytes() [8]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], o.key64)
+	return b
+}
+
+// Uint32 XORs a value with the 32-bit key
+func (o *Obfuscator) Uint32(v uint32) uint32 {
+	return v ^ o.key32
+}
+
+// Uint64 XORs a value with the 64-bit key
+func (o *Obfuscator) Uint64(v uint64) uint64 {
+	return v ^ o.key64
+}
+
+// Bytes XORs data of any length with the repeated 64-bit key, returning a new slice
+func (o *Obfuscator) Bytes(b []byte) []byte {
+	key := o.Key64Bytes()
+	return XorBytesWithBytes(b, key[:])
+}
+
+// Addr XORs an address with the key for its family. IPv4-mapped IPv6 addresses are treated
+// as IPv4, and the zone of an IPv6 address is preserved.
+func (o *Obfuscator) Addr(addr netip.Addr) netip.Addr {
+	if !addr.IsValid() {
+		return addr
+	}
+	if addr.Is4() || addr.Is4In6() {
+		v, _ := AddrToUint32(addr)
+		return Uint32ToAddr(o.Uint32(v))
+	}
+
+	b := addr.As16()
+	copy(b[:], o.Bytes(b[:]))
+	return netip.AddrFrom16(b).WithZone(addr.Zone())
+}
+
+// IPv4 XORs an IPv4 address string with the 32-bit key
+func (o *Obfuscator) IPv4(ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	if !addr.Unmap().Is4() {
+		return "", fmt.Errorf("not an IPv4 address: %s", ip)
+	}
+	return o.Addr(addr).String(), nil
+}
+
+// IPv6 XORs an IPv6 address string with the 64-bit key
+func (o *Obfuscator) IPv6(ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	if !addr.Is6() || addr.Is4In6() {
+		return "", fmt.Errorf("not an IPv6 address: %s", ip)
+	}
+	return o.Addr(addr).String(), nil
+}
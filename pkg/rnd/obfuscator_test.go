@@ -0,0 +1,151 @@
+package rnd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+)
+
+// testObfuscator returns an obfuscator with the keys 0x01020304 and 0x05060708090a0b0c
+func testObfuscator(t *testing.T) *Obfuscator {
+	t.Helper()
+	o, err := NewObfuscatorFrom(bytes.NewReader([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// TestObfuscatorKeys checks that keys are read from the random source in network byte order
+func TestObfuscatorKeys(t *testing.T) {
+	o := testObfuscator(t)
+	if o.Key32() != 0x01020304 || o.Key64() != 0x05060708090a0b0c {
+		t.Errorf("got keys %08x and %016x", o.Key32(), o.Key64())
+	}
+	if k := o.Key32Bytes(); hex.EncodeToString(k[:]) != "01020304" {
+		t.Errorf("got 32-bit key bytes %x", k)
+	}
+	if k := o.Key64Bytes(); hex.EncodeToString(k[:]) != "05060708090a0b0c" {
+		t.Errorf("got 64-bit key bytes %x", k)
+	}
+
+	if _, err := NewObfuscatorFrom(bytes.NewReader(make([]byte, 11))); err == nil {
+		t.Errorf("expected an error for a short random source")
+	}
+	if o, err := NewObfuscator(); err != nil || o == nil {
+		t.Errorf("got %v, %v from crypto/rand", o, err)
+	}
+}
+
+// TestObfuscatorAddr checks the obfuscated form of addresses in each family and that applying
+// the obfuscator again restores them
+func TestObfuscatorAddr(t *testing.T) {
+	o := testObfuscator(t)
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "193.2.1.5"},
+		{"0.0.0.0", "1.2.3.4"},
+		{"255.255.255.255", "254.253.252.251"},
+		{"2001:db8::1", "2507:ab0:90a:b0c:506:708:90a:b0d"},
+		{"::", "506:708:90a:b0c:506:708:90a:b0c"},
+		{"fe80::1%eth0", "fb86:708:90a:b0c:506:708:90a:b0d%eth0"},
+	}
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		got := o.Addr(addr)
+		if got.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+		}
+		if got.Is4() != addr.Is4() {
+			t.Errorf("%s: family changed to %s", tt.addr, got)
+		}
+		if back := o.Addr(got); back != addr {
+			t.Errorf("%s: round trip returned %s", tt.addr, back)
+		}
+	}
+
+	// IPv4-mapped addresses use the 32-bit key and come back as IPv4
+	if got := o.Addr(netip.MustParseAddr("::ffff:192.0.2.1")); got != netip.MustParseAddr("193.2.1.5") {
+		t.Errorf("IPv4-mapped: got %s", got)
+	}
+	if got := o.Addr(netip.Addr{}); got.IsValid() {
+		t.Errorf("invalid address: got %s", got)
+	}
+	if zero := NewObfuscatorWithKeys(0, 0); zero.Addr(netip.MustParseAddr("2001:db8::1")).String() != "2001:db8::1" {
+		t.Errorf("zero keys changed the address")
+	}
+}
+
+// TestObfuscatorBytes checks that data of any length is XORed with the repeated 64-bit key
+// without changing the input
+func TestObfuscatorBytes(t *testing.T) {
+	o := testObfuscator(t)
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"", ""},
+		{"000000", "050607"},
+		{"0000000000000000", "05060708090a0b0c"},
+		{"ffffffffffffffffffffffffff", "faf9f8f7f6f5f4f3faf9f8f7f6"},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.data)
+		orig := append([]byte{}, data...)
+		got := o.Bytes(data)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s: got %x, want %s", tt.data, got, tt.want)
+		}
+		if !bytes.Equal(data, orig) {
+			t.Errorf("%s: input changed to %x", tt.data, data)
+		}
+		if back := o.Bytes(got); !bytes.Equal(back, orig) {
+			t.Errorf("%s: round trip returned %x", tt.data, back)
+		}
+	}
+
+	if got := o.Uint32(o.Uint32(0xdeadbeef)); got != 0xdeadbeef {
+		t.Errorf("32-bit round trip returned %08x", got)
+	}
+	if got := o.Uint64(0); got != o.Key64() {
+		t.Errorf("got %016x for zero", got)
+	}
+}
+
+// TestObfuscatorStrings checks the string forms and their family checks
+func TestObfuscatorStrings(t *testing.T) {
+	o := testObfuscator(t)
+	tests := []struct {
+		fn   func(string) (string, error)
+		ip   string
+		want string
+	}{
+		{o.IPv4, "192.0.2.1", "193.2.1.5"},
+		{o.IPv4, "::ffff:192.0.2.1", "193.2.1.5"},
+		{o.IPv4, "2001:db8::1", ""},
+		{o.IPv4, "192.0.2", ""},
+		{o.IPv6, "2001:db8::1", "2507:ab0:90a:b0c:506:708:90a:b0d"},
+		{o.IPv6, "::ffff:192.0.2.1", ""},
+		{o.IPv6, "192.0.2.1", ""},
+		{o.IPv6, "2001:db8::g", ""},
+	}
+	for _, tt := range tests {
+		got, err := tt.fn(tt.ip)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tt.ip, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %s, %v, want %s", tt.ip, got, err, tt.want)
+			continue
+		}
+		if back, err := tt.fn(got); err != nil || netip.MustParseAddr(back) != netip.MustParseAddr(tt.ip).Unmap() {
+			t.Errorf("%s: round trip returned %s, %v", tt.ip, back, err)
+		}
+	}
+}
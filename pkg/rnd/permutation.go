@@ -0,0 +1,137 @@
+package rnd
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// MaxPermutationSize is the largest range that a Permutation can order
+const MaxPermutationSize = 1 << 62
+
+// permutationStream is the PCG stream used to derive a permutation from its seed
+const permutationStream = 0x72756e5a65726f21
+
+// Permutation orders the integers from zero to size-1 by walking the multiplicative group of
+// integers modulo a prime larger than size, skipping values outside the range. The generator
+// and starting point of the walk are derived from a seed, so the same seed and size always
+// produce the same order, and the walk can be split into shards that never overlap.
+type Permutation struct {
+	size  uint64
+	prime uint64
+	gen   uint64
+	start uint64
+}
+
+// NewPermutation returns the permutation of a range of size integers for a seed
+func NewPermutation(size uint64, seed uint64) (*Permutation, error) {
+	if size == 0 || size > MaxPermutationSize {
+		return nil, fmt.Errorf("invalid permutation size %d", size)
+	}
+
+	// A safe prime p=2q+1 has a group of order 2q, so g is a generator unless g^2 or g^q is 1
+	p, q := safePrimeOver(size)
+	r := rand.New(rand.NewPCG(seed, permutationStream))
+
+	var g uint64
+	for {
+		g = 2 + r.Uint64N(p-3)
+		if powmod(g, 2, p) != 1 && powmod(g, q, p) != 1 {
+			break
+		}
+	}
+
+	return &Permutation{
+		size:  size,
+		prime: p,
+		gen:   g,
+		start: 1 + r.Uint64N(p-1),
+	}, nil
+}
+
+// Size returns the number of integers in the permutation
+func (p *Permutation) Size() uint64 {
+	return p.size
+}
+
+// Iterator returns an iterator over the entire permutation
+func (p *Permutation) Iterator() *PermutationIterator {
+	it, _ := p.Shard(0, 1)
+	return it
+}
+
+// Shard returns an iterator over shard i (starting from zero) of n. Each shard takes every
+// nth step of the walk, so the shards of a permutation are disjoint and cover the range.
+func (p *Permutation) Shard(i, n uint64) (*PermutationIterator, error) {
+	if n == 0 || i >= n {
+		return nil, fmt.Errorf("invalid shard %d of %d", i, n)
+	}
+
+	it := &PermutationIterator{size: p.size, prime: p.prime}
+	positions := p.prime - 1
+	if i >= positions {
+		return it, nil
+	}
+
+	it.steps = (positions-i-1)/n + 1
+	it.cur = mulmod(p.start, powmod(p.gen, i, p.prime), p.prime)
+	it.step = powmod(p.gen, n, p.prime)
+	return it, nil
+}
+
+// PermutationIterator returns the integers of one shard of a permutation in order
+type PermutationIterator struct {
+	size  uint64
+	prime uint64
+	cur   uint64
+	step  uint64
+	steps uint64
+}
+
+// Next returns the next integer, or false once the shard is exhausted
+func (it *PermutationIterator) Next() (uint64, bool) {
+	for it.steps > 0 {
+		v := it.cur - 1
+		it.cur = mulmod(it.cur, it.step, it.prime)
+		it.steps--
+		if v < it.size {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// safePrimeOver returns the smallest safe prime p=2q+1 larger than min, along with q
+func safePrimeOver(min uint64) (uint64, uint64) {
+	for q := min / 2; ; q++ {
+		p := 2*q + 1
+		if p <= min || p < 5 {
+			continue
+		}
+		// ProbablyPrime is 100% accurate for inputs less than 2⁶⁴
+		if new(big.Int).SetUint64(q).ProbablyPrime(0) && new(big.Int).SetUint64(p).ProbablyPrime(0) {
+			return p, q
+		}
+	}
+}
+
+// mulmod returns a*b mod m without overflowing
+func mulmod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return bits.Rem64(hi, lo, m)
+}
+
+// powmod returns b^e mod m
+func powmod(b, e, m uint64) uint64 {
+	result := uint64(1) % m
+	b %= m
+	for e > 0 {
+		if e&1 == 1 {
+			result = mulmod(result, b, m)
+		}
+		b = mulmod(b, b, m)
+		e >>= 1
+	}
+	return result
+}
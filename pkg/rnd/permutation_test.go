@@ -0,0 +1,123 @@
+package rnd
+
+import (
+	"slices"
+	"testing"
+)
+
+// permutationOrder returns every integer an iterator yields, in order
+func permutationOrder(it *PermutationIterator) []uint64 {
+	var order []uint64
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		order = append(order, v)
+	}
+	return order
+}
+
+// checkCovers fails unless order holds every integer in [0,size) exactly once
+func checkCovers(t *testing.T, order []uint64, size uint64) {
+	t.Helper()
+	if uint64(len(order)) != size {
+		t.Errorf("got %d integers, want %d", len(order), size)
+	}
+	seen := make([]bool, size)
+	for _, v := range order {
+		if v >= size {
+			t.Fatalf("got %d outside [0,%d)", v, size)
+		}
+		if seen[v] {
+			t.Fatalf("got %d more than once", v)
+		}
+		seen[v] = true
+	}
+}
+
+// TestPermutationCovers checks that every integer in the range appears exactly once, for sizes
+// that are prime, composite, powers of two, and too small to need a walk
+func TestPermutationCovers(t *testing.T) {
+	for _, size := range []uint64{1, 2, 3, 4, 5, 6, 7, 8, 10, 11, 12, 23, 24, 100, 256, 1000, 4096} {
+		for _, seed := range []uint64{0, 1, 0xdeadbeef} {
+			p, err := NewPermutation(size, seed)
+			if err != nil {
+				t.Fatalf("size %d: %s", size, err)
+			}
+			if p.Size() != size {
+				t.Errorf("size %d: Size is %d", size, p.Size())
+			}
+			checkCovers(t, permutationOrder(p.Iterator()), size)
+		}
+	}
+}
+
+// TestPermutationSeed checks that the order depends only on the seed and size
+func TestPermutationSeed(t *testing.T) {
+	order := func(seed uint64) []uint64 {
+		p, err := NewPermutation(1000, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return permutationOrder(p.Iterator())
+	}
+
+	a, b := order(42), order(42)
+	if !slices.Equal(a, b) {
+		t.Errorf("the same seed gave different orders")
+	}
+	if slices.Equal(a, order(43)) {
+		t.Errorf("seeds 42 and 43 gave the same order")
+	}
+}
+
+// TestPermutationShards checks that the shards of a permutation are disjoint, cover the range
+// together, and follow the order of the full walk
+func TestPermutationShards(t *testing.T) {
+	for _, size := range []uint64{1, 7, 10, 97, 100, 1000} {
+		for _, n := range []uint64{1, 2, 3, 5, 16} {
+			p, err := NewPermutation(size, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			full := permutationOrder(p.Iterator())
+			position := make(map[uint64]int, len(full))
+			for i, v := range full {
+				position[v] = i
+			}
+
+			var all []uint64
+			for i := uint64(0); i < n; i++ {
+				it, err := p.Shard(i, n)
+				if err != nil {
+					t.Fatalf("shard %d of %d: %s", i, n, err)
+				}
+				shard := permutationOrder(it)
+				for j := 1; j < len(shard); j++ {
+					if position[shard[j]] <= position[shard[j-1]] {
+						t.Errorf("size %d shard %d of %d is out of walk order", size, i, n)
+						break
+					}
+				}
+				all = append(all, shard...)
+			}
+			checkCovers(t, all, size)
+		}
+	}
+}
+
+// TestPermutationInvalid checks the limits on the size and shard arguments
+func TestPermutationInvalid(t *testing.T) {
+	for _, size := range []uint64{0, MaxPermutationSize + 1} {
+		if _, err := NewPermutation(size, 1); err == nil {
+			t.Errorf("size %d: expected an error", size)
+		}
+	}
+
+	p, err := NewPermutation(10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range [][2]uint64{{0, 0}, {1, 1}, {5, 3}} {
+		if _, err := p.Shard(shard[0], shard[1]); err == nil {
+			t.Errorf("shard %d of %d: expected an error", shard[0], shard[1])
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package rnd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ErrNoRoute is returned when no route reaches a destination
+var ErrNoRoute = errors.New("no route to destination")
+
+// ErrRoutesUnsupported is returned when the route table cannot be read on this platform
+var ErrRoutesUnsupported = errors.New("reading the route table is not supported on this platform")
+
+// Interface is a local network interface and the prefixes assigned to it
+type Interface struct {
+	Index        int
+	Name         string
+	MTU          int
+	Flags        net.Flags
+	HardwareAddr net.HardwareAddr
+	Prefixes     []netip.Prefix
+}
+
+// IsUp returns true if the interface is administratively up
+func (i Interface) IsUp() bool {
+	return i.Flags&net.FlagUp != 0
+}
+
+// Route is an entry in the route table. Gateway is invalid for directly connected routes.
+type Route struct {
+	Destination netip.Prefix
+	Gateway     netip.Addr
+	Interface   string
+	Metric      uint32
+}
+
+// IsDefault returns true if the route matches every address in its family
+func (r Route) IsDefault() bool {
+	return r.Destination.Bits() == 0
+}
+
+// Egress describes how traffic to a destination leaves the local system
+type Egress struct {
+	Destination netip.Addr
+	Source      netip.Addr
+	Interface   Interface
+	// Route is the matching route, or the connected prefix of the interface if no route was more specific
+	Route Route
+}
+
+// NextHop returns the gateway of the route, or the destination itself if it is directly reachable
+func (e *Egress) NextHop() netip.Addr {
+	if e.Route.Gateway.IsValid() {
+		return e.Route.Gateway
+	}
+	return e.Destination
+}
+
+// RouteTable is a snapshot of the local interfaces and routes. On Linux the routes come
+// from /proc/net/route and /proc/net/ipv6_route, which cover the main routing table; policy
+// routing rules are not evaluated.
+type RouteTable struct {
+	Interfaces []Interface
+	Routes     []Route
+}
+
+// LoadRouteTable reads the local interfaces and routes. It returns ErrRoutesUnsupported on
+// platforms where the route table cannot be read.
+func LoadRouteTable() (*RouteTable, error) {
+	ifaces, err := LocalInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := readRoutes()
+	if err != nil {
+		return nil, err
+	}
+	return &RouteTable{Interfaces: ifaces, Routes: routes}, nil
+}
+
+// LocalInterfaces returns the local network interfaces along with their assigned prefixes
+func LocalInterfaces() ([]Interface, error) {
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("interfaces: %w", err)
+	}
+
+	ifaces := make([]Interface, 0, len(netIfaces))
+	for _, ni := range netIfaces {
+		addrs, err := ni.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", ni.Name, err)
+		}
+		iface := Interface{
+			Index:        ni.Index,
+			Name:         ni.Name,
+			MTU:          ni.MTU,
+			Flags:        ni.Flags,
+			HardwareAddr: ni.HardwareAddr,
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ipn.IP)
+			if !ok {
+				continue
+			}
+			ones, _ := ipn.Mask.Size()
+			addr = addr.Unmap()
+			if addr.Is4() && ones > 32 {
+				ones -= 96
+			}
+			iface.Prefixes = append(iface.Prefixes, netip.PrefixFrom(addr, ones))
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+// Interface returns the interface with a name
+func (t *RouteTable) Interface(name string) (Interface, bool) {
+	for _, iface := range t.Interfaces {
+		if iface.Name == name {
+			return iface, true
+		}
+	}
+	return Interface{}, false
+}
+
+// DefaultGateways returns the default routes of both address families that have a gateway,
+// ordered by metric within each family
+func (t *RouteTable) DefaultGateways() []Route {
+	gateways := []Route{}
+	for _, r := range t.Routes {
+		if r.IsDefault() && r.Gateway.IsValid() {
+			gateways = append(gateways, r)
+		}
+	}
+	for i := 1; i < len(gateways); i++ {
+		for j := i; j > 0 && gateways[j].Metric < gateways[j-1].Metric; j-- {
+			gateways[j], gateways[j-1] = gateways[j-1], gateways[j]
+		}
+	}
+	return gateways
+}
+
+// Lookup returns the interface, source address, and route that would be used to reach a
+// destination. The most specific route wins, with ties broken by the lowest metric, and
+// a connected prefix assigned to an interface wins over a less specific route.
+func (t *RouteTable) Lookup(dst netip.Addr) (*Egress, error) {
+	if !dst.IsValid() {
+		return nil, fmt.Errorf("invalid destination")
+	}
+	dst = dst.Unmap().WithZone("")
+
+	// Addresses assigned to the local system are reached through their own interface
+	for _, iface := range t.Interfaces {
+		for _, p := range iface.Prefixes {
+			if p.Addr() == dst {
+				return &Egress{Destination: dst, Source: dst, Interface: iface, Route: Route{
+					Destination: netip.PrefixFrom(dst, dst.BitLen()),
+					Interface:   iface.Name,
+				}}, nil
+			}
+		}
+	}
+
+	var best Route
+	found := false
+	for _, r := range t.Routes {
+		if !r.Destination.Contains(dst) {
+			continue
+		}
+		if !found || r.Destination.Bits() > best.Destination.Bits() ||
+			(r.Destination.Bits() == best.Destination.Bits() && r.Metric < best.Metric) {
+			best, found = r, true
+		}
+	}
+
+	// The route table may omit connected prefixes, such as 127.0.0.0/8 on the loopback interface
+	for _, iface := range t.Interfaces {
+		if !iface.IsUp() {
+			continue
+		}
+		for _, p := range iface.Prefixes {
+			if p.Contains(dst) && (!found || p.Bits() > best.Destination.Bits()) {
+				best, found = Route{Destination: p.Masked(), Interface: iface.Name}, true
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%s: %w", dst, ErrNoRoute)
+	}
+
+	iface, ok := t.Interface(best.Interface)
+	if !ok {
+		return nil, fmt.Errorf("%s: route %s uses unknown interface %s", dst, best.Destination, best.Interface)
+	}
+
+	e := &Egress{Destination: dst, Interface: iface, Route: best}
+	src, err := selectSource(iface, e.NextHop())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dst, err)
+	}
+	e.Source = src
+	return e, nil
+}
+
+// selectSource picks the address of an interface to use when sending to a next hop. Addresses
+// on the same prefix as the next hop are preferred, followed by addresses of the same scope.
+func selectSource(iface Interface, hop netip.Addr) (netip.Addr, error) {
+	var fallback netip.Addr
+	for _, p := range iface.Prefixes {
+		addr := p.Addr()
+		if addr.Is4() != hop.Is4() {
+			continue
+		}
+		if p.Contains(hop) {
+			return addr, nil
+		}
+		if !fallback.IsValid() || (fallback.IsLinkLocalUnicast() && !addr.IsLinkLocalUnicast()) {
+			fallback = addr
+		}
+	}
+	if !fallback.IsValid() {
+		return netip.Addr{}, fmt.Errorf("interface %s has no %s address", iface.Name, addrFamily(hop))
+	}
+	if fallback.IsLinkLocalUnicast() && !hop.IsLinkLocalUnicast() && !hop.IsLoopback() {
+		return netip.Addr{}, fmt.Errorf("interface %s has no routable %s address", iface.Name, addrFamily(hop))
+	}
+	return fallback, nil
+}
+
+// addrFamily returns the name of the address family of an address
+func addrFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// EgressFor returns the interface, source address, and route that would be used to reach a
+// destination, without sending any traffic. On platforms where the route table cannot be read,
+// the source address is found by connecting an unbound UDP socket, which also sends nothing,
+// and the returned Route only names the interface.
+func EgressFor(dst netip.Addr) (*Egress, error) {
+	t, err := LoadRouteTable()
+	if err == nil {
+		return t.Lookup(dst)
+	}
+	if !errors.Is(err, ErrRoutesUnsupported) {
+		return nil, err
+	}
+	return egressByConnect(dst)
+}
+
+// egressByConnect finds the source address for a destination by letting the kernel choose
+// one for a connected UDP socket, then finds the interface that owns it
+func egressByConnect(dst netip.Addr) (*Egress, error) {
+	if !dst.IsValid() {
+		return nil, fmt.Errorf("invalid destination")
+	}
+	dst = dst.Unmap()
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 53)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dst, err)
+	}
+	src := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap().WithZone("")
+	conn.Close()
+
+	ifaces, err := LocalInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		for _, p := range iface.Prefixes {
+			if p.Addr() == src {
+				return &Egress{
+					Destination: dst,
+					Source:      src,
+					Interface:   iface,
+					Route:       Route{Interface: iface.Name},
+				}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: source address %s is not assigned to any interface", dst, src)
+}
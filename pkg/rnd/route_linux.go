@@ -0,0 +1,164 @@
+//go:build linux
+
+package rnd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Route flags from linux/route.h
+const (
+	rtfUp      = 0x0001
+	rtfGateway = 0x0002
+	rtfReject  = 0x0200
+)
+
+// readRoutes returns the IPv4 and IPv6 routes of the main routing table
+func readRoutes() ([]Route, error) {
+	routes, err := readProcRoutes("/proc/net/route", parseIPv4Route, true)
+	if err != nil {
+		return nil, err
+	}
+	// IPv6 may be disabled, in which case the file does not exist
+	routes6, err := readProcRoutes("/proc/net/ipv6_route", parseIPv6Route, false)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(routes, routes6...), nil
+}
+
+// readProcRoutes parses a route file from /proc, skipping routes that are down or reject traffic
+func readProcRoutes(path string, parse func([]string) (Route, uint32, error), header bool) ([]Route, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	routes := []Route{}
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		if header && line == 1 {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		r, flags, err := parse(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if flags&rtfUp == 0 || flags&rtfReject != 0 {
+			continue
+		}
+		if flags&rtfGateway == 0 {
+			r.Gateway = netip.Addr{}
+		}
+		routes = append(routes, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return routes, nil
+}
+
+// parseIPv4Route parses a line of /proc/net/route, where addresses are hex in host byte order:
+// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+func parseIPv4Route(fields []string) (Route, uint32, error) {
+	if len(fields) < 8 {
+		return Route{}, 0, fmt.Errorf("short route entry")
+	}
+	dst, err := parseProcIPv4(fields[1])
+	if err != nil {
+		return Route{}, 0, err
+	}
+	gw, err := parseProcIPv4(fields[2])
+	if err != nil {
+		return Route{}, 0, err
+	}
+	flags, err := strconv.ParseUint(fields[3], 16, 32)
+	if err != nil {
+		return Route{}, 0, fmt.Errorf("invalid flags: %s", fields[3])
+	}
+	metric, err := strconv.ParseUint(fields[6], 10, 32)
+	if err != nil {
+		return Route{}, 0, fmt.Errorf("invalid metric: %s", fields[6])
+	}
+	mask, err := strconv.ParseUint(fields[7], 16, 32)
+	if err != nil {
+		return Route{}, 0, fmt.Errorf("invalid mask: %s", fields[7])
+	}
+	ones := bits.OnesCount32(uint32(mask))
+
+	prefix, err := dst.Prefix(ones)
+	if err != nil {
+		return Route{}, 0, err
+	}
+	return Route{Destination: prefix, Gateway: gw, Interface: fields[0], Metric: uint32(metric)}, uint32(flags), nil
+}
+
+// parseProcIPv4 converts a hex IPv4 address in host byte order
+func parseProcIPv4(s string) (netip.Addr, error) {
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid address: %s", s)
+	}
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], uint32(v))
+	return netip.AddrFrom4(b), nil
+}
+
+// parseIPv6Route parses a line of /proc/net/ipv6_route, where addresses are hex in network byte order:
+// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface
+func parseIPv6Route(fields []string) (Route, uint32, error) {
+	if len(fields) < 10 {
+		return Route{}, 0, fmt.Errorf("short route entry")
+	}
+	dst, err := parseProcIPv6(fields[0])
+	if err != nil {
+		return Route{}, 0, err
+	}
+	ones, err := strconv.ParseUint(fields[1], 16, 8)
+	if err != nil || ones > 128 {
+		return Route{}, 0, fmt.Errorf("invalid prefix length: %s", fields[1])
+	}
+	gw, err := parseProcIPv6(fields[4])
+	if err != nil {
+		return Route{}, 0, err
+	}
+	metric, err := strconv.ParseUint(fields[5], 16, 32)
+	if err != nil {
+		return Route{}, 0, fmt.Errorf("invalid metric: %s", fields[5])
+	}
+	flags, err := strconv.ParseUint(fields[8], 16, 32)
+	if err != nil {
+		return Route{}, 0, fmt.Errorf("invalid flags: %s", fields[8])
+	}
+
+	prefix, err := dst.Prefix(int(ones))
+	if err != nil {
+		return Route{}, 0, err
+	}
+	return Route{Destination: prefix, Gateway: gw, Interface: fields[9], Metric: uint32(metric)}, uint32(flags), nil
+}
+
+// parseProcIPv6 converts a 32 digit hex IPv6 address
+func parseProcIPv6(s string) (netip.Addr, error) {
+	var b [16]byte
+	if len(s) != 32 {
+		return netip.Addr{}, fmt.Errorf("invalid address: %s", s)
+	}
+	if _, err := hex.Decode(b[:], []byte(s)); err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid address: %s", s)
+	}
+	return netip.AddrFrom16(b), nil
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package rnd
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestReadProcRoutes parses route files in the layout of /proc/net/route and /proc/net/ipv6_route,
+// skipping routes that are down or reject traffic
+func TestReadProcRoutes(t *testing.T) {
+	// The IPv4 fixture holds addresses in little-endian byte order
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("fixture requires a little-endian host")
+	}
+
+	tests := []struct {
+		path   string
+		parse  func([]string) (Route, uint32, error)
+		header bool
+		want   []Route
+	}{
+		{
+			"testdata/route/proc-net-route", parseIPv4Route, true,
+			[]Route{
+				{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParseAddr("192.168.2.1"), "eth0", 100},
+				{netip.MustParsePrefix("192.168.2.0/24"), netip.Addr{}, "eth0", 100},
+				{netip.MustParsePrefix("172.17.0.0/16"), netip.Addr{}, "docker0", 0},
+				{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParseAddr("10.0.0.1"), "wg0", 50},
+			},
+		},
+		{
+			"testdata/route/proc-net-ipv6_route", parseIPv6Route, false,
+			[]Route{
+				{netip.MustParsePrefix("2001:db8:1::/64"), netip.Addr{}, "eth0", 256},
+				{netip.MustParsePrefix("fe80::/64"), netip.Addr{}, "eth0", 256},
+				{netip.MustParsePrefix("::/0"), netip.MustParseAddr("fe80::1"), "eth0", 1024},
+				{netip.MustParsePrefix("::1/128"), netip.Addr{}, "lo", 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		routes, err := readProcRoutes(tt.path, tt.parse, tt.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(routes, tt.want) {
+			t.Errorf("%s:\n got %v\nwant %v", tt.path, routes, tt.want)
+		}
+	}
+}
+
+// TestParseRouteInvalid checks that malformed route entries are rejected
+func TestParseRouteInvalid(t *testing.T) {
+	z := strings.Repeat("0", 32)
+	tests := []struct {
+		name  string
+		parse func([]string) (Route, uint32, error)
+		line  string
+	}{
+		{"ipv4 short", parseIPv4Route, "eth0 00000000 00000000 0003 0 0 0"},
+		{"ipv4 destination", parseIPv4Route, "eth0 0000000G 00000000 0003 0 0 0 00000000"},
+		{"ipv4 gateway", parseIPv4Route, "eth0 00000000 100000000 0003 0 0 0 00000000"},
+		{"ipv4 flags", parseIPv4Route, "eth0 00000000 00000000 up 0 0 0 00000000"},
+		{"ipv4 metric", parseIPv4Route, "eth0 00000000 00000000 0003 0 0 ff 00000000"},
+		{"ipv4 mask", parseIPv4Route, "eth0 00000000 00000000 0003 0 0 0 mask"},
+		{"ipv6 short", parseIPv6Route, z + " 00 " + z + " 00 " + z + " 00000000 00000001 00000000 00000001"},
+		{"ipv6 destination", parseIPv6Route, z[1:] + " 00 " + z + " 00 " + z + " 00000000 00000001 00000000 00000001 eth0"},
+		{"ipv6 prefix length", parseIPv6Route, z + " 81 " + z + " 00 " + z + " 00000000 00000001 00000000 00000001 eth0"},
+		{"ipv6 next hop", parseIPv6Route, z + " 00 " + z + " 00 " + strings.Repeat("x", 32) + " 00000000 00000001 00000000 00000001 eth0"},
+		{"ipv6 metric", parseIPv6Route, z + " 00 " + z + " 00 " + z + " metric 00000001 00000000 00000001 eth0"},
+		{"ipv6 flags", parseIPv6Route, z + " 00 " + z + " 00 " + z + " 00000000 00000001 00000000 flags eth0"},
+	}
+	for _, tt := range tests {
+		if _, _, err := tt.parse(strings.Fields(tt.line)); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	// Errors from a route file name the line
+	path := filepath.Join(t.TempDir(), "route")
+	data := "Iface\tDestination\tGateway\n" + "eth0\t00000000\t00000000\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" + "eth0\tbad\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProcRoutes(path, parseIPv4Route, true); err == nil || !strings.Contains(err.Error(), path+":3:") {
+		t.Errorf("got error %v, want one for line 3", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package rnd
+
+// readRoutes is not implemented outside of Linux
+func readRoutes() ([]Route, error) {
+	return nil, ErrRoutesUnsupported
+}
@@ -1,16 +1,13 @@
 package rnd
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
+	"slices"
 	"time"
-
-	"github.com/gofrs/uuid"
 )
 
 //
@@ -129,6 +126,12 @@ var SMB2SessionSetupNTLMSSP = []byte{
 	0xba, 0x47, 0x00, 0x00, 0x00, 0x0f,
 }
 
+// SPNEGONTLMSSPNegotiate returns a copy of the SPNEGO NegTokenInit wrapping a NTLMSSP
+// NEGOTIATE message that SMB2SessionSetupNTLMSSP sends as its security buffer
+func SPNEGONTLMSSPNegotiate() []byte {
+	return slices.Clone(SMB2SessionSetupNTLMSSP[4+smb2HeaderLength+24:])
+}
+
 // SMBSendData writes a SMB request to a socket
 func SMBSendData(conn net.Conn, data []byte) error {
 	err := conn.SetWriteDeadline(time.Now().Add(SMBReadTimeout))
@@ -145,7 +148,8 @@ func SMBSendData(conn net.Conn, data []byte) error {
 	return nil
 }
 
-// SMBReadFrame reads the netbios header then the full response
+// SMBReadFrame reads the netbios header then the full response. A frame cut short by the
+// timeout or by the connection closing is returned as far as it was read.
 func SMBReadFrame(conn net.Conn, t time.Duration) ([]byte, error) {
 	timeout := time.Now().Add(t)
 	res := []byte{}
@@ -157,454 +161,248 @@ func SMBReadFrame(conn net.Conn, t time.Duration) ([]byte, error) {
 	}
 
 	// Read the NetBIOS header
-	n, err := conn.Read(nbh[:])
-	if err != nil {
-		// Return if EOF is reached
-		if err == io.EOF {
-			return res, nil
-		}
-
-		// Return if timeout is reached
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return res, nil
-		}
-
-		// If we have data and received an error, it was probably a reset
-		if len(res) > 0 {
+	if _, err := io.ReadFull(conn, nbh); err != nil {
+		if smbFrameEnded(err) {
 			return res, nil
 		}
-
 		return res, err
 	}
 
-	if n != 4 {
-		return res, nil
-	}
-
-	res = append(res[:], nbh[:n]...)
+	res = append(res[:], nbh...)
 	dlen := binary.BigEndian.Uint32(nbh[:]) & 0x00ffffff
 	buf := make([]byte, dlen)
-	n, err = conn.Read(buf[:])
-	if err != nil {
-		// Return if EOF is reached
-		if err == io.EOF {
-			return res, nil
-		}
-
-		// Return if timeout is reached
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return res, nil
-		}
 
-		// If we have data and received an error, it was probably a reset
-		if len(res) > 0 {
-			return res, nil
-		}
-
-		return res, err
-	}
+	// Any error after the header was probably a reset, so return what was read
+	n, _ := io.ReadFull(conn, buf)
 	res = append(res[:], buf[:n]...)
 	return res, nil
 }
 
-// SMB2NegotiateProtocolRequest generates a new Negotiate request with the specified target name
-func SMB2NegotiateProtocolRequest(dst string) []byte {
-
-	base := []byte{
-		0xfe, 0x53, 0x4d, 0x42,
-		0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0xff, 0xfe, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x24, 0x00, 0x05, 0x00,
-		0x01, 0x00, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x00,
-	}
-
-	// Client GUID (16)
-	base = append(base[:], RandomBytes(16)...)
-
-	base = append(base[:], []byte{
-		0x70, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
-		0x02, 0x02, 0x10, 0x02, 0x00, 0x03, 0x02, 0x03,
-		0x11, 0x03, 0x00, 0x00, 0x01, 0x00, 0x26, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00,
-		0x01, 0x00,
-	}...)
-
-	// SHA-512 Salt (32)
-	base = append(base[:], RandomBytes(32)...)
-
-	base = append(base[:], []byte{
-		0x00, 0x00, 0x02, 0x00, 0x06, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x02, 0x00,
-		0x01, 0x00, 0x00, 0x00, 0x03, 0x00, 0x0e, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x03, 0x00,
-		0x01, 0x00, 0x00, 0x00,
-	}...)
-
-	encodedDst := make([]byte, len(dst)*2)
-	for i, b := range []byte(dst) {
-		encodedDst[i*2] = b
+// smbFrameEnded returns true if a read failed because the connection closed or timed out
+func smbFrameEnded(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
 	}
-
-	netname := []byte{0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	binary.LittleEndian.PutUint16(netname[2:], uint16(len(encodedDst)))
-	netname = append(netname, encodedDst...)
-
-	base = append(base, netname...)
-
-	nbhd := make([]byte, 4)
-	binary.BigEndian.PutUint32(nbhd, uint32(len(base)))
-	nbhd = append(nbhd, base...)
-	return nbhd
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
 }
 
-// SMBExtractValueFromOffset peels a field out of a SMB buffer
-func SMBExtractValueFromOffset(blob []byte, idx int) ([]byte, int, error) {
-	res := []byte{}
-
-	if len(blob) < (idx + 6) {
-		return res, idx, fmt.Errorf("data truncated")
+// SMB2NegotiateProtocolRequest generates a new Negotiate request with the specified target name.
+// It panics if crypto/rand fails; use SMB2NegotiateProtocolRequestWithSource to handle errors.
+func SMB2NegotiateProtocolRequest(dst string) []byte {
+	req, err := SMB2NegotiateProtocolRequestWithSource(dst, nil)
+	if err != nil {
+		panic(err)
 	}
+	return req
+}
 
-	len1 := binary.LittleEndian.Uint16(blob[idx:])
-	idx += 2
-
-	// len2 := binary.LittleEndian.Uint16(blob[idx:])
-	idx += 2
+// SMB2NegotiateProtocolRequestWithSource generates a new Negotiate request with the specified
+// target name, reading the client GUID and preauth salt from a random source (nil for crypto/rand)
+func SMB2NegotiateProtocolRequestWithSource(dst string, src io.Reader) ([]byte, error) {
+	return SMB2NegotiateRequest(SMB2NegotiateOptions{
+		Dialects:              []uint16{0x0202, 0x0210, 0x0300, 0x0302, 0x0311},
+		SecurityMode:          0x01,
+		Capabilities:          0x7f,
+		HashAlgorithms:        []uint16{SMB2HashSHA512},
+		Ciphers:               []uint16{SMB2CipherAES128GCM, SMB2CipherAES128CCM},
+		CompressionAlgorithms: []uint16{SMB2CompressionLZ77, SMB2CompressionLZ77Huff, SMB2CompressionLZNT1},
+		NetName:               dst,
+		Random:                src,
+	})
+}
 
-	off := binary.LittleEndian.Uint32(blob[idx:])
-	idx += 4
+// SMB2NegotiateOptions describes the dialects and SMB 3.1.1 negotiate contexts offered by
+// SMB2NegotiateRequest. Contexts are only sent when 0x0311 is one of the dialects, and a context
+// is left out when its list is empty.
+type SMB2NegotiateOptions struct {
+	Dialects     []uint16
+	SecurityMode uint16
+	Capabilities uint32
+	// ClientGUID is read from Random when nil
+	ClientGUID []byte
+
+	HashAlgorithms        []uint16
+	Ciphers               []uint16
+	CompressionAlgorithms []uint16
+	CompressionFlags      uint32
+	SigningAlgorithms     []uint16
+	RDMATransforms        []uint16
+	// TransportSecurity offers to rely on transport-level security, such as QUIC
+	TransportSecurity bool
+	// NetName is the server name the client is connecting to
+	NetName string
+
+	// Random is the source of the client GUID and preauth salt (nil for crypto/rand)
+	Random io.Reader
+}
 
-	// Allow zero length values
-	if len1 == 0 {
-		return res, idx, nil
+// DefaultSMB2NegotiateOptions offers every dialect from SMB 2.0.2 to 3.1.1 along with every
+// cipher, signing algorithm, compression algorithm, and RDMA transform defined for SMB 3.1.1
+func DefaultSMB2NegotiateOptions(dst string) SMB2NegotiateOptions {
+	return SMB2NegotiateOptions{
+		Dialects:       slices.Clone(SMB2DialectsAll),
+		SecurityMode:   0x01,
+		Capabilities:   0x7f,
+		HashAlgorithms: []uint16{SMB2HashSHA512},
+		Ciphers: []uint16{
+			SMB2CipherAES256GCM, SMB2CipherAES128GCM, SMB2CipherAES256CCM, SMB2CipherAES128CCM,
+		},
+		CompressionAlgorithms: []uint16{
+			SMB2CompressionLZ77, SMB2CompressionLZ77Huff, SMB2CompressionLZNT1, SMB2CompressionPatternV1,
+		},
+		CompressionFlags:  SMB2CompressionFlagChains,
+		SigningAlgorithms: []uint16{SMB2SigningAESGMAC, SMB2SigningAESCMAC, SMB2SigningHMACSHA256},
+		RDMATransforms:    []uint16{SMB2RDMATransformEncryption, SMB2RDMATransformSigning},
+		NetName:           dst,
 	}
+}
 
-	if len(blob) < int(off+uint32(len1)) {
-		return res, idx, fmt.Errorf("data value truncated")
+// SMB2NegotiateRequest generates a Negotiate request, including the NetBIOS header
+func SMB2NegotiateRequest(opts SMB2NegotiateOptions) ([]byte, error) {
+	req, err := smb2NegotiateBody(opts)
+	if err != nil {
+		return nil, err
 	}
-
-	res = append(res, blob[off:off+uint32(len1)]...)
-	return res, idx, nil
+	return MarshalSMB2Message(&SMB2Header{Command: SMB2CommandNegotiate, MessageID: 1, ProcessID: 0xfeff}, req)
 }
 
-// SMB1ExtractNativeFieldsFromSessionSetupReply tries to extract NativeOS/NativeLM fields from a SMB1 session setup response
-func SMB1ExtractNativeFieldsFromSessionSetupReply(blob []byte, info map[string]string) {
-
-	smbOffset := bytes.Index(blob, []byte{0xff, 'S', 'M', 'B'})
-	if smbOffset < 0 {
-		return
+// smb2NegotiateBody builds the NEGOTIATE request body described by the options
+func smb2NegotiateBody(opts SMB2NegotiateOptions) (*SMB2NegotiateReq, error) {
+	guid := opts.ClientGUID
+	if guid == nil {
+		var err error
+		guid, err = RandomBytesFrom(opts.Random, 16)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	data := blob[smbOffset:]
-	if len(data) < 41 {
-		return
+	if len(guid) != 16 {
+		return nil, fmt.Errorf("client GUID must be 16 bytes, not %d", len(guid))
 	}
 
-	// Read the Security Blob Length and then skip past it
-	sbl := int(binary.LittleEndian.Uint16(data[39:]))
-	nbi := sbl + 39 + 4
-	if len(data) < nbi {
-		return
+	req := &SMB2NegotiateReq{
+		SecurityMode: opts.SecurityMode,
+		Capabilities: opts.Capabilities,
+		Dialects:     opts.Dialects,
 	}
-
-	data = data[nbi:]
-	bits := strings.Split(string(data), "\x00\x00")
-	if len(bits) < 3 {
-		return
+	copy(req.ClientGUID[:], guid)
+	if slices.Contains(opts.Dialects, SMB2Dialect311) {
+		var err error
+		req.NegotiateContexts, err = smb2NegotiateContexts(opts)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	// Extract the last three elements
-	info["smb.NativeOS"] = TrimName(bits[0])
-	info["smb.NativeLM"] = TrimName(bits[1])
-	info["smb.Domain"] = TrimName(bits[2])
+	return req, nil
 }
 
-// SMB2ExtractSIDFromSessionSetupReply tries to extract the SessionID and Signature from a SMB2 reply
-func SMB2ExtractSIDFromSessionSetupReply(blob []byte, info map[string]string) {
-	smbOffset := bytes.Index(blob, []byte{0xfe, 'S', 'M', 'B'})
-	if smbOffset < 0 {
-		return
+// smb2NegotiateContexts encodes the negotiate contexts described by the options
+func smb2NegotiateContexts(opts SMB2NegotiateOptions) ([]SMB2NegotiateContext, error) {
+	var contexts []SMB2NegotiateContext
+	add := func(t uint16, data []byte) {
+		contexts = append(contexts, SMB2NegotiateContext{Type: t, Data: data})
 	}
-
-	smbData := blob[smbOffset:]
-	if len(smbData) < 48 {
-		return
+	uint16List := func(data []byte, ids []uint16) []byte {
+		for _, id := range ids {
+			data = binary.LittleEndian.AppendUint16(data, id)
+		}
+		return data
 	}
 
-	status := binary.LittleEndian.Uint32(smbData[8:])
-	info["smb.Status"] = fmt.Sprintf("0x%.8x", status)
-
-	sessID := binary.LittleEndian.Uint64(smbData[40:])
-	info["smb.SessionID"] = fmt.Sprintf("0x%.16x", sessID)
-
-	if len(smbData) >= 64 {
-		sigData := hex.EncodeToString(smbData[48:64])
-		if sigData != "00000000000000000000000000000000" {
-			info["smb.Signature"] = sigData
+	if len(opts.HashAlgorithms) > 0 {
+		salt, err := RandomBytesFrom(opts.Random, 32)
+		if err != nil {
+			return nil, err
 		}
+		data := binary.LittleEndian.AppendUint16(nil, uint16(len(opts.HashAlgorithms)))
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(salt)))
+		data = uint16List(data, opts.HashAlgorithms)
+		add(SMB2PreauthIntegrityCapabilities, append(data, salt...))
 	}
-}
-
-// SMBExtractFieldsFromSecurityBlob extracts fields from the NTLMSSP response
-func SMBExtractFieldsFromSecurityBlob(blob []byte, info map[string]string) {
-	var err error
-
-	ntlmsspOffset := bytes.Index(blob, []byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00, 0x02, 0x00, 0x00, 0x00})
-	if ntlmsspOffset < 0 {
-		return
+	if len(opts.Ciphers) > 0 {
+		data := binary.LittleEndian.AppendUint16(nil, uint16(len(opts.Ciphers)))
+		add(SMB2EncryptionCapabilities, uint16List(data, opts.Ciphers))
 	}
-
-	data := blob[ntlmsspOffset:]
-
-	// Basic sanity check
-	if len(data) < (12 + 6 + 12 + 8 + 6 + 8) {
-		return
+	if len(opts.CompressionAlgorithms) > 0 {
+		data := binary.LittleEndian.AppendUint16(nil, uint16(len(opts.CompressionAlgorithms)))
+		data = binary.LittleEndian.AppendUint16(data, 0)
+		data = binary.LittleEndian.AppendUint32(data, opts.CompressionFlags)
+		add(SMB2CompressionCapabilities, uint16List(data, opts.CompressionAlgorithms))
 	}
-
-	idx := 12
-
-	targetName, idx, err := SMBExtractValueFromOffset(data, idx)
-	if err != nil {
-		return
+	if opts.NetName != "" {
+		add(SMB2NetnameNegotiateContextID, utf16LEBytes(opts.NetName))
 	}
-
-	// Negotiate Flags
-	negotiateFlags := binary.LittleEndian.Uint32(data[idx:])
-	info["ntlmssp.NegotiationFlags"] = fmt.Sprintf("0x%.8x", negotiateFlags)
-	idx += 4
-
-	// NTLM Server Challenge
-	idx += 8
-
-	// Reserved
-	idx += 8
-
-	// Target Info
-	targetInfo, idx, err := SMBExtractValueFromOffset(data, idx)
-	if err != nil {
-		return
+	if opts.TransportSecurity {
+		add(SMB2TransportCapabilities, binary.LittleEndian.AppendUint32(nil, SMB2AcceptTransportLevelSecurity))
 	}
-
-	// Version
-	versionMajor := uint8(data[idx])
-	idx++
-
-	versionMinor := uint8(data[idx])
-	idx++
-
-	versionBuild := binary.LittleEndian.Uint16(data[idx:])
-	idx += 2
-
-	ntlmRevision := binary.BigEndian.Uint32(data[idx:])
-
-	// macOS reverses the endian order of this field for some reason
-	if ntlmRevision == 251658240 {
-		ntlmRevision = binary.LittleEndian.Uint32(data[idx:])
+	if len(opts.RDMATransforms) > 0 {
+		data := binary.LittleEndian.AppendUint16(nil, uint16(len(opts.RDMATransforms)))
+		data = append(data, 0, 0, 0, 0, 0, 0)
+		add(SMB2RDMATransformCapabilities, uint16List(data, opts.RDMATransforms))
 	}
-
-	info["ntlmssp.Version"] = fmt.Sprintf("%d.%d.%d", versionMajor, versionMinor, versionBuild)
-	info["ntlmssp.NTLMRevision"] = fmt.Sprintf("%d", ntlmRevision)
-	info["ntlmssp.TargetName"] = TrimName(string(targetName))
-
-	idx = 0
-	for {
-		if idx+4 > len(targetInfo) {
-			break
-		}
-
-		attrType := binary.LittleEndian.Uint16(targetInfo[idx:])
-		idx += 2
-
-		// End of List
-		if attrType == 0 {
-			break
-		}
-
-		attrLen := binary.LittleEndian.Uint16(targetInfo[idx:])
-		idx += 2
-
-		if idx+int(attrLen) > len(targetInfo) {
-			// log.Printf("too short: %d/%d", idx+int(attrLen), len(targetInfo))
-			break
-		}
-
-		attrVal := targetInfo[idx : idx+int(attrLen)]
-		idx += int(attrLen)
-
-		switch attrType {
-		case 1:
-			info["ntlmssp.NetbiosComputer"] = TrimName(string(attrVal))
-		case 2:
-			info["ntlmssp.NetbiosDomain"] = TrimName(string(attrVal))
-		case 3:
-			info["ntlmssp.DNSComputer"] = TrimName(string(attrVal))
-		case 4:
-			info["ntlmssp.DNSDomain"] = TrimName(string(attrVal))
-		case 7:
-			ts := binary.LittleEndian.Uint64(attrVal[:])
-			info["ntlmssp.Timestamp"] = fmt.Sprintf("0x%.16x", ts)
-
-		}
-
-		// End of List
-		if attrType == 0 {
-			break
-		}
+	if len(opts.SigningAlgorithms) > 0 {
+		data := binary.LittleEndian.AppendUint16(nil, uint16(len(opts.SigningAlgorithms)))
+		add(SMB2SigningCapabilities, uint16List(data, opts.SigningAlgorithms))
 	}
+	return contexts, nil
 }
 
-// SMB2ExtractFieldsFromNegotiateReply extracts useful fields from the SMB2 negotiate response
-func SMB2ExtractFieldsFromNegotiateReply(blob []byte, info map[string]string) {
-
-	smbOffset := bytes.Index(blob, []byte{0xfe, 'S', 'M', 'B'})
-	if smbOffset < 0 {
-		return
+// SMBExtractValueFromOffset peels a field out of a SMB buffer, using the security buffer
+// descriptor at idx and returning the index following the descriptor
+func SMBExtractValueFromOffset(blob []byte, idx int) ([]byte, int, error) {
+	res, err := readSecurityBuffer("SMB buffer", "value", blob, idx)
+	if err != nil {
+		return []byte{}, idx, err
 	}
+	return append([]byte{}, res...), idx + 8, nil
+}
 
-	data := blob[smbOffset:]
-
-	// Basic sanity check
-	if len(data) < (64 + 8 + 16 + 36) {
+// SMB1ExtractNativeFieldsFromSessionSetupReply tries to extract NativeOS/NativeLM fields from a SMB1 session setup response
+//
+// Deprecated: use ParseSMB1SessionSetupReply, which returns typed fields and errors.
+func SMB1ExtractNativeFieldsFromSessionSetupReply(blob []byte, info map[string]string) {
+	si, _ := ParseSMB1SessionSetupReply(blob)
+	if si == nil || si.NativeOS == "" {
 		return
 	}
+	info["smb.NativeOS"] = si.NativeOS
+	info["smb.NativeLM"] = si.NativeLM
+	info["smb.Domain"] = si.Domain
+}
 
-	switch binary.LittleEndian.Uint16(data[64+2:]) {
-	case 0:
-		info["smb.Signing"] = "disabled"
-	case 1:
-		info["smb.Signing"] = "enabled"
-	case 2, 3:
-		info["smb.Signing"] = "required"
+// SMB2ExtractSIDFromSessionSetupReply tries to extract the SessionID and Signature from a SMB2 reply
+//
+// Deprecated: use ParseSMB2SessionSetupReply, which returns typed fields and errors.
+func SMB2ExtractSIDFromSessionSetupReply(blob []byte, info map[string]string) {
+	if si, _ := ParseSMB2SessionSetupReply(blob); si != nil {
+		si.Fields(info)
 	}
+}
 
-	info["smb.Dialect"] = fmt.Sprintf("0x%.4x", binary.LittleEndian.Uint16(data[64+4:]))
-	info["smb.GUID"] = uuid.FromBytesOrNil(data[64+8 : 64+8+16]).String()
-	info["smb.Capabilities"] = fmt.Sprintf("0x%.8x", binary.LittleEndian.Uint32(data[64+8+16:]))
-
-	negCtxCount := int(binary.LittleEndian.Uint16(data[64+6:]))
-	negCtxOffset := int(binary.LittleEndian.Uint32(data[64+8+16+36:]))
-	if negCtxCount == 0 || negCtxOffset == 0 || negCtxOffset+(negCtxCount*8) > len(data) {
-		return
+// SMBExtractFieldsFromSecurityBlob extracts fields from the NTLMSSP response
+//
+// Deprecated: use ParseNTLMChallenge, which returns typed fields and errors.
+func SMBExtractFieldsFromSecurityBlob(blob []byte, info map[string]string) {
+	if ci, _ := ParseNTLMChallenge(blob); ci != nil {
+		ci.Fields(info)
 	}
+}
 
-	negCtxData := data[negCtxOffset:]
-	idx := 0
-	for {
-		if idx+8 > len(negCtxData) {
-			break
-		}
-		negType := int(binary.LittleEndian.Uint16(negCtxData[idx:]))
-		negLen := int(binary.LittleEndian.Uint16(negCtxData[idx+2:]))
-		idx += 8
-
-		if idx+negLen > len(negCtxData) {
-			break
-		}
-		negData := negCtxData[idx : idx+negLen]
-
-		SMB2ParseNegotiateContext(negType, negData, info)
-
-		// Move the index to the next context
-		idx += negLen
-		// Negotiate Contexts are aligned on 64-bit boundaries
-		for idx%8 != 0 {
-			idx++
-		}
+// SMB2ExtractFieldsFromNegotiateReply extracts useful fields from the SMB2 negotiate response
+//
+// Deprecated: use ParseSMB2NegotiateReply, which returns typed fields and errors.
+func SMB2ExtractFieldsFromNegotiateReply(blob []byte, info map[string]string) {
+	if ni, _ := ParseSMB2NegotiateReply(blob); ni != nil {
+		ni.Fields(info)
 	}
 }
 
 // SMB2ParseNegotiateContext decodes fields from the SMB2 Negotiate Context values
+//
+// Deprecated: use ParseSMB2NegotiateReply, which decodes every negotiate context.
 func SMB2ParseNegotiateContext(t int, data []byte, info map[string]string) {
-	switch t {
-	case 1:
-		// SMB2_PREAUTH_INTEGRITY_CAPABILITIES
-		if len(data) < 6 {
-			return
-		}
-		hashCount := int(binary.LittleEndian.Uint16(data[:]))
-		// MUST only be one in responses
-		if hashCount != 1 {
-			return
-		}
-		hashSaltLen := int(binary.LittleEndian.Uint16(data[2:]))
-		hashType := int(binary.LittleEndian.Uint16(data[4:]))
-		hashName := "sha512"
-		if hashType != 1 {
-			hashName = fmt.Sprintf("unknown-%d", hashType)
-		}
-		info["smb.HashAlg"] = hashName
-		info["smb.HashSaltLen"] = fmt.Sprintf("%d", hashSaltLen)
-
-	case 2:
-		// SMB2_ENCRYPTION_CAPABILITIES
-		if len(data) < 4 {
-			return
-		}
-		cipherCount := int(binary.LittleEndian.Uint16(data[:]))
-		if len(data) < 2+(2*cipherCount) {
-			return
-		}
-		// MUST only be one in responses
-		if cipherCount != 1 {
-			return
-		}
-		cipherList := []string{}
-		for i := 0; i < cipherCount; i++ {
-			cipherID := int(binary.LittleEndian.Uint16(data[2+(i*2):]))
-			cipherName := ""
-			switch cipherID {
-			case 1:
-				cipherName = "aes-128-ccm"
-			case 2:
-				cipherName = "aes-128-gcm"
-			default:
-				cipherName = fmt.Sprintf("unknown-%d", cipherID)
-			}
-			cipherList = append(cipherList, cipherName)
-		}
-
-		info["smb.CipherAlg"] = strings.Join(cipherList, "\t")
-
-	case 3:
-		// SMB2_COMPRESSION_CAPABILITIES
-		if len(data) < 10 {
-			return
-		}
-		compCount := int(binary.LittleEndian.Uint16(data[:]))
-		if len(data) < 2+2+4+(2*compCount) {
-			return
-		}
-		// MUST only be one in responses
-		if compCount != 1 {
-			return
-		}
-		compList := []string{}
-		for i := 0; i < compCount; i++ {
-			compID := int(binary.LittleEndian.Uint16(data[8+(i*2):]))
-			compName := ""
-			switch compID {
-			case 0:
-				compName = "none"
-			case 1:
-				compName = "lznt1"
-			case 2:
-				compName = "lz77"
-			case 3:
-				compName = "lz77+huff"
-			case 4:
-				compName = "patternv1"
-			default:
-				compName = fmt.Sprintf("unknown-%d", compID)
-			}
-			compList = append(compList, compName)
-		}
-		info["smb.CompressionFlags"] = fmt.Sprintf("0x%.4x", binary.LittleEndian.Uint32(data[4:]))
-		info["smb.CompressionAlg"] = strings.Join(compList, "\t")
-	}
+	ni := &NegotiateInfo{}
+	parseNegotiateContext(t, data, ni)
+	ni.contextFields(info)
 }
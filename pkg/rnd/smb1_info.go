@@ -0,0 +1,385 @@
+package rnd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// ErrNoSMB1Header is returned when a reply does not contain a SMB1 header
+var ErrNoSMB1Header = errors.New("no SMB1 header found")
+
+// smb1HeaderLength is the size of the SMB1 header that precedes the parameter words
+const smb1HeaderLength = 32
+
+// SMB1 FLAGS2 values used when decoding replies
+const (
+	smb1Flags2Unicode  = 0x8000
+	smb1Flags2NTStatus = 0x4000
+)
+
+// SMB1NoDialect is the dialect index returned when the server supports none of the dialects offered
+const SMB1NoDialect = 0xffff
+
+// SMB1Dialects lists the dialects offered by SMB1NegotiateProtocolRequest, in order, so that the
+// dialect index of a reply can be named. SMB1OnlyNegotiateProtocolRequest offers the same list
+// without the two SMB2 dialects at the end.
+var SMB1Dialects = []string{
+	"PC NETWORK PROGRAM 1.0",
+	"MICROSOFT NETWORKS 1.03",
+	"MICROSOFT NETWORKS 3.0",
+	"LANMAN1.0",
+	"LM1.2X002",
+	"DOS LANMAN2.1",
+	"LANMAN2.1",
+	"Samba",
+	"NT LANMAN 1.0",
+	"NT LM 0.12",
+	"SMB 2.002",
+	"SMB 2.???",
+}
+
+// SMB1 capabilities (MS-CIFS 2.2.4.52.2, MS-SMB 2.2.4.5.2)
+const (
+	SMB1CapRawMode           = 0x00000001
+	SMB1CapMPXMode           = 0x00000002
+	SMB1CapUnicode           = 0x00000004
+	SMB1CapLargeFiles        = 0x00000008
+	SMB1CapNTSMBs            = 0x00000010
+	SMB1CapRPCRemoteAPIs     = 0x00000020
+	SMB1CapStatus32          = 0x00000040
+	SMB1CapLevel2Oplocks     = 0x00000080
+	SMB1CapLockAndRead       = 0x00000100
+	SMB1CapNTFind            = 0x00000200
+	SMB1CapDFS               = 0x00001000
+	SMB1CapInfoLevelPassthru = 0x00002000
+	SMB1CapLargeReadX        = 0x00004000
+	SMB1CapLargeWriteX       = 0x00008000
+	SMB1CapLWIO              = 0x00010000
+	SMB1CapUnix              = 0x00800000
+	SMB1CapCompressedData    = 0x02000000
+	SMB1CapDynamicReauth     = 0x20000000
+	SMB1CapPersistentHandles = 0x40000000
+	SMB1CapExtendedSecurity  = 0x80000000
+)
+
+// smb1CapabilityNames names each capability, in bit order
+var smb1CapabilityNames = []bitName{
+	{SMB1CapRawMode, "raw-mode"},
+	{SMB1CapMPXMode, "mpx-mode"},
+	{SMB1CapUnicode, "unicode"},
+	{SMB1CapLargeFiles, "large-files"},
+	{SMB1CapNTSMBs, "nt-smbs"},
+	{SMB1CapRPCRemoteAPIs, "rpc-remote-apis"},
+	{SMB1CapStatus32, "status32"},
+	{SMB1CapLevel2Oplocks, "level2-oplocks"},
+	{SMB1CapLockAndRead, "lock-and-read"},
+	{SMB1CapNTFind, "nt-find"},
+	{SMB1CapDFS, "dfs"},
+	{SMB1CapInfoLevelPassthru, "infolevel-passthru"},
+	{SMB1CapLargeReadX, "large-readx"},
+	{SMB1CapLargeWriteX, "large-writex"},
+	{SMB1CapLWIO, "lwio"},
+	{SMB1CapUnix, "unix"},
+	{SMB1CapCompressedData, "compressed-data"},
+	{SMB1CapDynamicReauth, "dynamic-reauth"},
+	{SMB1CapPersistentHandles, "persistent-handles"},
+	{SMB1CapExtendedSecurity, "extended-security"},
+}
+
+// SMB1CapabilityNames returns the names of the SMB1 capabilities that are set
+func SMB1CapabilityNames(caps uint32) []string {
+	return bitNames(caps, smb1CapabilityNames)
+}
+
+// SMB1NegotiateInfo holds the fields of a SMB1 NEGOTIATE response
+type SMB1NegotiateInfo struct {
+	Status       uint32 `json:"status"`
+	DialectIndex uint16 `json:"dialect_index"`
+	// Dialect is empty when the server rejected every dialect or returned an unknown index
+	Dialect         string     `json:"dialect,omitempty"`
+	SecurityMode    uint8      `json:"security_mode"`
+	Signing         string     `json:"signing,omitempty"`
+	MaxMpxCount     uint16     `json:"max_mpx_count,omitempty"`
+	MaxBufferSize   uint32     `json:"max_buffer_size,omitempty"`
+	SessionKey      uint32     `json:"session_key,omitempty"`
+	Capabilities    uint32     `json:"capabilities"`
+	CapabilityNames []string   `json:"capability_names,omitempty"`
+	SystemTime      *time.Time `json:"system_time,omitempty"`
+	// TimeZone is the offset of the server's local time from UTC, in minutes
+	TimeZone int16 `json:"time_zone"`
+	// GUID is only present with extended security
+	GUID *uuid.UUID `json:"guid,omitempty"`
+	// Challenge, DomainName, and ServerName are only present without extended security
+	Challenge  []byte `json:"challenge,omitempty"`
+	DomainName string `json:"domain_name,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	// SecurityBlob is the GSS token returned by the server with extended security
+	SecurityBlob []byte `json:"-"`
+}
+
+// Enabled returns true if the server accepted one of the SMB1 dialects
+func (ni *SMB1NegotiateInfo) Enabled() bool {
+	return ni.DialectIndex != SMB1NoDialect && ni.DialectIndex < uint16(len(SMB1Dialects)) &&
+		!strings.HasPrefix(SMB1Dialects[ni.DialectIndex], "SMB 2.")
+}
+
+// SMB1SessionSetupInfo holds the fields of a SMB1 SESSION_SETUP_ANDX response
+type SMB1SessionSetupInfo struct {
+	Status   uint32 `json:"status"`
+	UID      uint16 `json:"uid"`
+	Action   uint16 `json:"action"`
+	NativeOS string `json:"native_os,omitempty"`
+	NativeLM string `json:"native_lm,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	// SecurityBlob is the GSS token returned by the server, such as a NTLMSSP CHALLENGE
+	SecurityBlob []byte `json:"-"`
+}
+
+// smb1Message holds the parts of a SMB1 reply shared by every command
+type smb1Message struct {
+	status  uint32
+	flags2  uint16
+	uid     uint16
+	words   []byte
+	payload []byte
+	// payloadOffset is the offset of the payload from the start of the header
+	payloadOffset int
+}
+
+// parseSMB1Message splits a SMB1 reply into its header fields, parameter words, and payload
+func parseSMB1Message(message string, blob []byte) (*smb1Message, error) {
+	smbOffset := bytes.Index(blob, []byte{0xff, 'S', 'M', 'B'})
+	if smbOffset < 0 {
+		return nil, ErrNoSMB1Header
+	}
+	data := blob[smbOffset:]
+
+	if len(data) < smb1HeaderLength+1 {
+		return nil, smbTruncated(message, "header", 0, smb1HeaderLength+1, len(data))
+	}
+	m := &smb1Message{
+		flags2: binary.LittleEndian.Uint16(data[10:]),
+		uid:    binary.LittleEndian.Uint16(data[28:]),
+	}
+
+	// Older servers return a DOS error class and code instead of a NT status
+	if m.flags2&smb1Flags2NTStatus != 0 {
+		m.status = binary.LittleEndian.Uint32(data[5:])
+	} else {
+		m.status = uint32(data[5]) | uint32(binary.LittleEndian.Uint16(data[7:]))<<16
+	}
+
+	wordsLen := int(data[smb1HeaderLength]) * 2
+	idx := smb1HeaderLength + 1
+	if idx+wordsLen+2 > len(data) {
+		// Error replies may omit the byte count entirely
+		if wordsLen == 0 {
+			return m, nil
+		}
+		return nil, smbTruncated(message, "parameter words", idx, wordsLen+2, len(data))
+	}
+	m.words = data[idx : idx+wordsLen]
+	idx += wordsLen
+
+	byteCount := int(binary.LittleEndian.Uint16(data[idx:]))
+	idx += 2
+	if idx+byteCount > len(data) {
+		return nil, smbTruncated(message, "data", idx, byteCount, len(data))
+	}
+	m.payload = data[idx : idx+byteCount]
+	m.payloadOffset = idx
+	return m, nil
+}
+
+// strings decodes up to count null-terminated strings from the payload starting at idx, using
+// UTF-16 when the reply sets the Unicode flag
+func (m *smb1Message) strings(idx int, count int) []string {
+	unicode := m.flags2&smb1Flags2Unicode != 0
+
+	// Unicode strings are aligned to two bytes from the start of the header
+	if unicode && (m.payloadOffset+idx)%2 == 1 && idx < len(m.payload) && m.payload[idx] == 0 {
+		idx++
+	}
+
+	var res []string
+	for len(res) < count && idx < len(m.payload) {
+		rest := m.payload[idx:]
+		if !unicode {
+			end := bytes.IndexByte(rest, 0)
+			if end < 0 {
+				end = len(rest)
+			}
+			res = append(res, TrimName(string(rest[:end])))
+			idx += end + 1
+			continue
+		}
+
+		end := len(rest) &^ 1
+		for i := 0; i+1 < len(rest); i += 2 {
+			if rest[i] == 0 && rest[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		res = append(res, TrimName(utf16LEToString(rest[:end])))
+		idx += end + 2
+	}
+	return res
+}
+
+// ParseSMB1NegotiateReply decodes a SMB1 NEGOTIATE response to SMB1NegotiateProtocolRequest or
+// SMB1OnlyNegotiateProtocolRequest. Only the dialect index is returned for servers that reject
+// every dialect or choose one older than NT LM 0.12.
+func ParseSMB1NegotiateReply(blob []byte) (*SMB1NegotiateInfo, error) {
+	m, err := parseSMB1Message("SMB1 negotiate response", blob)
+	if err != nil {
+		return nil, err
+	}
+
+	ni := &SMB1NegotiateInfo{Status: m.status, DialectIndex: SMB1NoDialect}
+	if len(m.words) < 2 {
+		return ni, nil
+	}
+	ni.DialectIndex = binary.LittleEndian.Uint16(m.words[0:])
+	if int(ni.DialectIndex) < len(SMB1Dialects) {
+		ni.Dialect = SMB1Dialects[ni.DialectIndex]
+	}
+
+	// The NT LM 0.12 response has 17 parameter words
+	if len(m.words) < 34 {
+		return ni, nil
+	}
+	ni.SecurityMode = m.words[2]
+	ni.MaxMpxCount = binary.LittleEndian.Uint16(m.words[3:])
+	ni.MaxBufferSize = binary.LittleEndian.Uint32(m.words[7:])
+	ni.SessionKey = binary.LittleEndian.Uint32(m.words[15:])
+	ni.Capabilities = binary.LittleEndian.Uint32(m.words[19:])
+	ni.CapabilityNames = SMB1CapabilityNames(ni.Capabilities)
+	if ft := binary.LittleEndian.Uint64(m.words[23:]); ft != 0 {
+		ts := FiletimeToTime(ft)
+		ni.SystemTime = &ts
+	}
+	// The server reports minutes to add to local time to get UTC
+	ni.TimeZone = -int16(binary.LittleEndian.Uint16(m.words[31:]))
+
+	switch {
+	case ni.SecurityMode&0x08 != 0:
+		ni.Signing = "required"
+	case ni.SecurityMode&0x04 != 0:
+		ni.Signing = "enabled"
+	default:
+		ni.Signing = "disabled"
+	}
+
+	if ni.Capabilities&SMB1CapExtendedSecurity != 0 {
+		if len(m.payload) < 16 {
+			return ni, smbTruncated("SMB1 negotiate response", "server GUID", m.payloadOffset, 16, m.payloadOffset+len(m.payload))
+		}
+		guid := uuid.FromBytesOrNil(m.payload[0:16])
+		ni.GUID = &guid
+		ni.SecurityBlob = append([]byte{}, m.payload[16:]...)
+		return ni, nil
+	}
+
+	challengeLen := int(m.words[33])
+	if challengeLen > len(m.payload) {
+		return ni, smbTruncated("SMB1 negotiate response", "challenge", m.payloadOffset, challengeLen, m.payloadOffset+len(m.payload))
+	}
+	ni.Challenge = append([]byte{}, m.payload[:challengeLen]...)
+	names := m.strings(challengeLen, 2)
+	if len(names) > 0 {
+		ni.DomainName = names[0]
+	}
+	if len(names) > 1 {
+		ni.ServerName = names[1]
+	}
+	return ni, nil
+}
+
+// Fields adds the negotiate info to a map using the smb1.* keys
+func (ni *SMB1NegotiateInfo) Fields(info map[string]string) {
+	info["smb1.Status"] = fmt.Sprintf("0x%.8x", ni.Status)
+	info["smb1.DialectIndex"] = fmt.Sprintf("%d", ni.DialectIndex)
+	if ni.Dialect != "" {
+		info["smb1.Dialect"] = ni.Dialect
+	}
+	if ni.Signing == "" {
+		return
+	}
+	info["smb1.SecurityMode"] = fmt.Sprintf("0x%.2x", ni.SecurityMode)
+	info["smb1.Signing"] = ni.Signing
+	info["smb1.Capabilities"] = fmt.Sprintf("0x%.8x", ni.Capabilities)
+	info["smb1.CapabilityNames"] = strings.Join(ni.CapabilityNames, "\t")
+	if ni.SystemTime != nil {
+		info["smb1.SystemTime"] = ni.SystemTime.Format(time.RFC3339)
+	}
+	if ni.GUID != nil {
+		info["smb1.GUID"] = ni.GUID.String()
+	}
+	if ni.DomainName != "" {
+		info["smb1.DomainName"] = ni.DomainName
+	}
+	if ni.ServerName != "" {
+		info["smb1.ServerName"] = ni.ServerName
+	}
+}
+
+// ParseSMB1SessionSetupReply decodes a SMB1 SESSION_SETUP_ANDX response, with or without
+// extended security
+func ParseSMB1SessionSetupReply(blob []byte) (*SMB1SessionSetupInfo, error) {
+	m, err := parseSMB1Message("SMB1 session setup response", blob)
+	if err != nil {
+		return nil, err
+	}
+
+	si := &SMB1SessionSetupInfo{Status: m.status, UID: m.uid}
+	if len(m.words) < 6 {
+		return si, nil
+	}
+	si.Action = binary.LittleEndian.Uint16(m.words[4:])
+
+	idx := 0
+	// The extended security response has a fourth word with the security blob length
+	if len(m.words) >= 8 {
+		blobLen := int(binary.LittleEndian.Uint16(m.words[6:]))
+		if blobLen > len(m.payload) {
+			return si, smbTruncated("SMB1 session setup response", "security blob", m.payloadOffset, blobLen, m.payloadOffset+len(m.payload))
+		}
+		si.SecurityBlob = append([]byte{}, m.payload[:blobLen]...)
+		idx = blobLen
+	}
+
+	names := m.strings(idx, 3)
+	if len(names) > 0 {
+		si.NativeOS = names[0]
+	}
+	if len(names) > 1 {
+		si.NativeLM = names[1]
+	}
+	if len(names) > 2 {
+		si.Domain = names[2]
+	}
+	return si, nil
+}
+
+// Fields adds the session setup info to a map using the smb1.* keys and the smb.Native* keys
+// set by SMB1ExtractNativeFieldsFromSessionSetupReply
+func (si *SMB1SessionSetupInfo) Fields(info map[string]string) {
+	info["smb1.Status"] = fmt.Sprintf("0x%.8x", si.Status)
+	info["smb1.UID"] = fmt.Sprintf("0x%.4x", si.UID)
+	if si.NativeOS != "" {
+		info["smb.NativeOS"] = si.NativeOS
+	}
+	if si.NativeLM != "" {
+		info["smb.NativeLM"] = si.NativeLM
+	}
+	if si.Domain != "" {
+		info["smb.Domain"] = si.Domain
+	}
+}
@@ -0,0 +1,360 @@
+package rnd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMBDefaultPort is the port used when an address does not include one
+const SMBDefaultPort = 445
+
+// smb2DefaultMaxFrame limits the size of responses read before the negotiate response has
+// set the maximum transaction size, and is the smallest limit used afterwards
+const smb2DefaultMaxFrame = 65536
+
+// ErrSMB2NoCredits is returned when the server has not granted enough credits for a request
+var ErrSMB2NoCredits = errors.New("no SMB2 credits available")
+
+// SMBStepError describes which step of a SMB exchange failed
+type SMBStepError struct {
+	// Step is "dial", "multi-protocol negotiate", "negotiate", "session setup", "echo", or "logoff"
+	Step string
+	Err  error
+}
+
+// Error describes the step and the underlying error
+func (e *SMBStepError) Error() string {
+	return e.Step + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *SMBStepError) Unwrap() error {
+	return e.Err
+}
+
+// SMB2ClientOptions configures a SMB2Client. The zero value connects to port 445 and uses
+// SMBReadTimeout for connecting and for each exchange.
+type SMB2ClientOptions struct {
+	// Port is used when the address does not include one (default 445)
+	Port int
+	// DialTimeout limits the time to connect (default SMBReadTimeout)
+	DialTimeout time.Duration
+	// Timeout limits each request and its response (default SMBReadTimeout)
+	Timeout time.Duration
+	// Dialer is used to connect (nil for a default net.Dialer)
+	Dialer *net.Dialer
+	// MultiProtocol sends a SMB1 negotiate request offering SMB2 before the SMB2 negotiate
+	// request, as older Windows clients do
+	MultiProtocol bool
+	// ProcessID is sent in the header of every request (default 0xfeff)
+	ProcessID uint32
+	// CreditRequest is the number of credits asked for by each request after the negotiate (default 33)
+	CreditRequest uint16
+}
+
+// SMB2Client is a connection to a SMB2 server that tracks message IDs, credits, and the
+// negotiated dialect. It is not safe for concurrent use.
+type SMB2Client struct {
+	conn    net.Conn
+	opts    SMB2ClientOptions
+	address string
+
+	messageID uint64
+	credits   uint16
+	dialect   uint16
+	sessionID uint64
+	// maxFrame limits the size of a response, so a bogus NetBIOS length cannot force a large allocation
+	maxFrame int
+}
+
+// SMBAddress returns host:port for a host name or address, adding the port unless the address
+// already has one. Bare and bracketed IPv6 addresses are both accepted.
+func SMBAddress(address string, port int) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// DialSMB2 connects to a SMB2 server. Nothing is sent until Negotiate is called.
+func DialSMB2(ctx context.Context, address string, opts SMB2ClientOptions) (*SMB2Client, error) {
+	if opts.Port == 0 {
+		opts.Port = SMBDefaultPort
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = SMBReadTimeout
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = SMBReadTimeout
+	}
+	if opts.ProcessID == 0 {
+		opts.ProcessID = 0xfeff
+	}
+	if opts.CreditRequest == 0 {
+		opts.CreditRequest = 33
+	}
+
+	d := &net.Dialer{}
+	if opts.Dialer != nil {
+		dc := *opts.Dialer
+		d = &dc
+	}
+	d.Timeout = opts.DialTimeout
+
+	c := &SMB2Client{opts: opts, address: SMBAddress(address, opts.Port), credits: 1, maxFrame: smb2DefaultMaxFrame}
+	conn, err := d.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, &SMBStepError{Step: "dial", Err: err}
+	}
+	c.conn = conn
+	return c, nil
+}
+
+// Close closes the connection
+func (c *SMB2Client) Close() error {
+	return c.conn.Close()
+}
+
+// Address returns the host:port the client connected to
+func (c *SMB2Client) Address() string {
+	return c.address
+}
+
+// Dialect returns the negotiated dialect, or zero before Negotiate succeeds
+func (c *SMB2Client) Dialect() uint16 {
+	return c.dialect
+}
+
+// Credits returns the number of credits the server has granted that have not been used
+func (c *SMB2Client) Credits() uint16 {
+	return c.credits
+}
+
+// SessionID returns the session ID assigned by the last SESSION_SETUP response
+func (c *SMB2Client) SessionID() uint64 {
+	return c.sessionID
+}
+
+// Negotiate sends the SMB2 NEGOTIATE request described by the options, preceded by a SMB1
+// multi-protocol negotiate if the client was configured for one. Only a missing or truncated
+// header, an error status, or a broken frame fail the negotiate; problems with the rest of the
+// response, including a dialect that was not offered, are recorded in its Warnings.
+func (c *SMB2Client) Negotiate(ctx context.Context, opts SMB2NegotiateOptions) (*NegotiateInfo, error) {
+	if c.opts.MultiProtocol && c.messageID == 0 {
+		if err := c.multiProtocolNegotiate(ctx); err != nil {
+			return nil, &SMBStepError{Step: "multi-protocol negotiate", Err: err}
+		}
+	}
+
+	req, err := smb2NegotiateBody(opts)
+	if err != nil {
+		return nil, &SMBStepError{Step: "negotiate", Err: err}
+	}
+	rh, data, err := c.roundTrip(ctx, &SMB2Header{Command: SMB2CommandNegotiate}, req)
+	if err != nil {
+		return nil, &SMBStepError{Step: "negotiate", Err: err}
+	}
+	if rh.isErrorResponse() {
+		_, err := UnmarshalSMB2Message(data, &SMB2NegotiateResp{})
+		return nil, &SMBStepError{Step: "negotiate", Err: err}
+	}
+
+	ni, err := ParseSMB2NegotiateReply(data)
+	if err != nil {
+		return nil, &SMBStepError{Step: "negotiate", Err: err}
+	}
+	if !slices.Contains(opts.Dialects, ni.Dialect) {
+		ni.warn(fmt.Errorf("server selected dialect 0x%.4x, which was not offered", ni.Dialect))
+	}
+	c.dialect = ni.Dialect
+	c.maxFrame = max(smb2DefaultMaxFrame, smb2HeaderLength+int(ni.MaxTransactSize))
+	return ni, nil
+}
+
+// multiProtocolNegotiate sends the SMB1 negotiate request that offers SMB2, which uses message
+// ID zero. The reply only grants credits, since the SMB2 negotiate that follows selects the dialect.
+func (c *SMB2Client) multiProtocolNegotiate(ctx context.Context) error {
+	stop := c.setDeadline(ctx)
+	defer stop()
+
+	if _, err := c.conn.Write(SMB1NegotiateProtocolRequest); err != nil {
+		return c.ctxErr(ctx, err)
+	}
+	c.messageID = 1
+	c.credits--
+
+	data, err := c.readFrame()
+	if err != nil {
+		return c.ctxErr(ctx, err)
+	}
+	data, err = findSMB2(data)
+	if err != nil {
+		return err
+	}
+	h := &SMB2Header{}
+	if err := h.Unmarshal(data); err != nil {
+		return err
+	}
+	c.credits += h.Credits
+	return nil
+}
+
+// SessionSetup sends a SESSION_SETUP request for a session ID, which is zero for a new
+// session. Requests with the SMB2SessionFlagBinding flag are marked as signed. Responses with
+// an error status are returned as session setup info with no error, so the caller can check
+// the status, and a malformed body or security buffer is recorded in its Warnings. Only a
+// missing or truncated header or a broken frame fail the session setup.
+func (c *SMB2Client) SessionSetup(ctx context.Context, sessionID uint64, req *SMB2SessionSetupReq) (*SessionSetupInfo, error) {
+	h := &SMB2Header{Command: SMB2CommandSessionSetup, SessionID: sessionID}
+	if req.Flags&SMB2SessionFlagBinding != 0 {
+		h.Flags |= SMB2FlagSigned
+	}
+
+	_, data, err := c.roundTrip(ctx, h, req)
+	if err != nil {
+		return nil, &SMBStepError{Step: "session setup", Err: err}
+	}
+	si, err := ParseSMB2SessionSetupReply(data)
+	if err != nil {
+		return nil, &SMBStepError{Step: "session setup", Err: err}
+	}
+	if si.SessionID != 0 {
+		c.sessionID = si.SessionID
+	}
+	return si, nil
+}
+
+// Echo sends an ECHO request
+func (c *SMB2Client) Echo(ctx context.Context) error {
+	if err := c.simpleRequest(ctx, &SMB2Header{Command: SMB2CommandEcho}, &SMB2Echo{}); err != nil {
+		return &SMBStepError{Step: "echo", Err: err}
+	}
+	return nil
+}
+
+// Logoff sends a LOGOFF request for the current session
+func (c *SMB2Client) Logoff(ctx context.Context) error {
+	h := &SMB2Header{Command: SMB2CommandLogoff, SessionID: c.sessionID}
+	if err := c.simpleRequest(ctx, h, &SMB2Logoff{}); err != nil {
+		return &SMBStepError{Step: "logoff", Err: err}
+	}
+	c.sessionID = 0
+	return nil
+}
+
+// simpleRequest sends a request whose response body has the same type, returning any error
+// response as a *SMB2ErrorResponse
+func (c *SMB2Client) simpleRequest(ctx context.Context, h *SMB2Header, body SMB2Body) error {
+	_, data, err := c.roundTrip(ctx, h, body)
+	if err != nil {
+		return err
+	}
+	_, err = UnmarshalSMB2Message(data, body)
+	return err
+}
+
+// roundTrip assigns the message ID, credit charge, and credit request of a request, sends it,
+// and returns the header and frame of the final response
+func (c *SMB2Client) roundTrip(ctx context.Context, h *SMB2Header, body SMB2Body) (*SMB2Header, []byte, error) {
+	// Only requests after the negotiate ask for credits, and SMB 2.0.2 has no credit charge
+	if c.dialect != 0 {
+		h.Credits = c.opts.CreditRequest
+		if c.dialect != SMB2Dialect202 {
+			h.CreditCharge = 1
+		}
+	}
+	if c.credits < 1 {
+		return nil, nil, ErrSMB2NoCredits
+	}
+	h.MessageID = c.messageID
+	h.ProcessID = c.opts.ProcessID
+
+	msg, err := MarshalSMB2Message(h, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := c.setDeadline(ctx)
+	defer stop()
+
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, nil, c.ctxErr(ctx, err)
+	}
+	c.messageID++
+	c.credits--
+
+	for {
+		data, err := c.readFrame()
+		if err != nil {
+			return nil, nil, c.ctxErr(ctx, err)
+		}
+		msg, err := findSMB2(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		rh := &SMB2Header{}
+		if err := rh.Unmarshal(msg); err != nil {
+			return nil, nil, err
+		}
+		c.credits += rh.Credits
+
+		if rh.MessageID != h.MessageID {
+			return nil, nil, fmt.Errorf("response message ID %d does not match request %d", rh.MessageID, h.MessageID)
+		}
+		// An interim response grants credits and is followed by the final one
+		if rh.Flags&SMB2FlagAsyncCommand != 0 && rh.Status == SMBStatusPending {
+			continue
+		}
+		return rh, data, nil
+	}
+}
+
+// readFrame reads a NetBIOS header and the message that follows it, which must fit within
+// the maximum transaction size and a header
+func (c *SMB2Client) readFrame() ([]byte, error) {
+	nbh := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, nbh); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(nbh) & 0x00ffffff)
+	if size > c.maxFrame {
+		return nil, fmt.Errorf("SMB frame of %d bytes exceeds the %d byte limit", size, c.maxFrame)
+	}
+	buf := make([]byte, 4+size)
+	copy(buf, nbh)
+	if _, err := io.ReadFull(c.conn, buf[4:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// setDeadline limits an exchange to the client timeout or the context deadline, whichever is
+// sooner, and interrupts it if the context is canceled. The returned function must be called
+// once the exchange is done.
+func (c *SMB2Client) setDeadline(ctx context.Context) func() bool {
+	deadline := time.Now().Add(c.opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() {
+		_ = c.conn.SetDeadline(time.Now())
+	})
+}
+
+// ctxErr returns the context error instead of an I/O error caused by the context ending
+func (c *SMB2Client) ctxErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
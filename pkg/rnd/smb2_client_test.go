@@ -0,0 +1,104 @@
+package rnd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveSMB2 accepts one connection and answers each request with the next reply, returning
+// the address to dial
+func serveSMB2(t *testing.T, replies ...[]byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, reply := range replies {
+			if _, err := SMBReadFrame(conn, SMBReadTimeout); err != nil {
+				return
+			}
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readSMB2TestFrame returns a frame from testdata/smb2
+func readSMB2TestFrame(t *testing.T, name string) []byte {
+	t.Helper()
+	blob, err := os.ReadFile(filepath.Join("testdata", "smb2", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+// TestSMB2ClientNegotiate checks that a negotiate succeeds, that the dialect and frame limit
+// come from the response, and that an oversized frame is rejected without reading it
+func TestSMB2ClientNegotiate(t *testing.T) {
+	// The captured response answered message ID 1, while the client starts from zero
+	reply := readSMB2TestFrame(t, "negotiate_response.bin")
+	reply[4+24] = 0
+	oversized := []byte{0x00, 0xff, 0xff, 0xff}
+	addr := serveSMB2(t, reply, oversized)
+
+	ctx := context.Background()
+	c, err := DialSMB2(ctx, addr, SMB2ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ni, err := c.Negotiate(ctx, DefaultSMB2NegotiateOptions("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("negotiate: %s", err)
+	}
+	if c.Dialect() != ni.Dialect || ni.Dialect != SMB2Dialect311 {
+		t.Errorf("dialect is 0x%.4x, client has 0x%.4x", ni.Dialect, c.Dialect())
+	}
+	if want := smb2HeaderLength + int(ni.MaxTransactSize); c.maxFrame != want {
+		t.Errorf("frame limit is %d, want %d", c.maxFrame, want)
+	}
+
+	err = c.Echo(ctx)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("oversized frame: got %v", err)
+	}
+}
+
+// TestSMB2ClientNegotiateError checks that an error status fails the negotiate
+func TestSMB2ClientNegotiateError(t *testing.T) {
+	reply := readSMB2TestFrame(t, "error_response.bin")
+	// Make the captured session setup error a negotiate error for message ID 0
+	reply[4+12] = SMB2CommandNegotiate
+	reply[4+24] = 0
+	addr := serveSMB2(t, reply)
+
+	ctx := context.Background()
+	c, err := DialSMB2(ctx, addr, SMB2ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Negotiate(ctx, DefaultSMB2NegotiateOptions("127.0.0.1"))
+	var er *SMB2ErrorResponse
+	if !errors.As(err, &er) || er.Status != 0xc0000203 {
+		t.Errorf("got %v, want an error response", err)
+	}
+}
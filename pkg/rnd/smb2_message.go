@@ -0,0 +1,637 @@
+package rnd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// SMB2 commands (MS-SMB2 2.2.1)
+const (
+	SMB2CommandNegotiate      = 0x0000
+	SMB2CommandSessionSetup   = 0x0001
+	SMB2CommandLogoff         = 0x0002
+	SMB2CommandTreeConnect    = 0x0003
+	SMB2CommandTreeDisconnect = 0x0004
+	SMB2CommandCreate         = 0x0005
+	SMB2CommandClose          = 0x0006
+	SMB2CommandFlush          = 0x0007
+	SMB2CommandRead           = 0x0008
+	SMB2CommandWrite          = 0x0009
+	SMB2CommandLock           = 0x000a
+	SMB2CommandIoctl          = 0x000b
+	SMB2CommandCancel         = 0x000c
+	SMB2CommandEcho           = 0x000d
+)
+
+// SMB2 dialects. SMB2DialectWildcard is only sent by servers, in reply to a SMB1 negotiate
+// request that offers "SMB 2.???".
+const (
+	SMB2Dialect202      = 0x0202
+	SMB2Dialect210      = 0x0210
+	SMB2Dialect300      = 0x0300
+	SMB2Dialect302      = 0x0302
+	SMB2Dialect311      = 0x0311
+	SMB2DialectWildcard = 0x02ff
+)
+
+// Dialect sets for SMB2NegotiateOptions; copy them before making changes
+var (
+	SMB2DialectsAll  = []uint16{SMB2Dialect202, SMB2Dialect210, SMB2Dialect300, SMB2Dialect302, SMB2Dialect311}
+	SMB2DialectsSMB2 = []uint16{SMB2Dialect202, SMB2Dialect210}
+	SMB2DialectsSMB3 = []uint16{SMB2Dialect300, SMB2Dialect302, SMB2Dialect311}
+)
+
+// SMB2 header flags
+const (
+	SMB2FlagServerToRedir     = 0x00000001
+	SMB2FlagAsyncCommand      = 0x00000002
+	SMB2FlagRelatedOperations = 0x00000004
+	SMB2FlagSigned            = 0x00000008
+	SMB2FlagPriorityMask      = 0x00000070
+	SMB2FlagDFSOperations     = 0x10000000
+	SMB2FlagReplayOperation   = 0x20000000
+)
+
+// StructureSize values of the header and command bodies
+const (
+	smb2HeaderStructureSize    = 64
+	smb2ErrorStructureSize     = 9
+	smb2EmptyStructureSize     = 4
+	smb2NegotiateReqStructSize = 36
+	smb2NegotiateResStructSize = 65
+	smb2SetupReqStructSize     = 25
+	smb2SetupResStructSize     = 9
+)
+
+// SMB2 security modes, used by NEGOTIATE and SESSION_SETUP
+const (
+	SMB2SigningEnabled  = 0x0001
+	SMB2SigningRequired = 0x0002
+)
+
+// SMB2 global capabilities
+const (
+	SMB2CapDFS               = 0x00000001
+	SMB2CapLeasing           = 0x00000002
+	SMB2CapLargeMTU          = 0x00000004
+	SMB2CapMultiChannel      = 0x00000008
+	SMB2CapPersistentHandles = 0x00000010
+	SMB2CapDirectoryLeasing  = 0x00000020
+	SMB2CapEncryption        = 0x00000040
+	SMB2CapNotifications     = 0x00000080
+)
+
+// SMB2 SESSION_SETUP request flags
+const (
+	SMB2SessionFlagBinding = 0x01
+)
+
+// SMB2 SESSION_SETUP response flags
+const (
+	SMB2SessionFlagIsGuest     = 0x0001
+	SMB2SessionFlagIsNull      = 0x0002
+	SMB2SessionFlagEncryptData = 0x0004
+)
+
+// SMB2Header is the header that precedes every SMB2 command. Marshal and Unmarshal use
+// AsyncID in place of ProcessID and TreeID when the SMB2FlagAsyncCommand flag is set.
+type SMB2Header struct {
+	CreditCharge uint16 `json:"credit_charge"`
+	// Status is the ChannelSequence and Reserved fields in requests
+	Status  uint32 `json:"status"`
+	Command uint16 `json:"command"`
+	// Credits is the CreditRequest of a request or the CreditResponse of a response
+	Credits     uint16   `json:"credits"`
+	Flags       uint32   `json:"flags"`
+	NextCommand uint32   `json:"next_command"`
+	MessageID   uint64   `json:"message_id"`
+	ProcessID   uint32   `json:"process_id,omitempty"`
+	TreeID      uint32   `json:"tree_id,omitempty"`
+	AsyncID     uint64   `json:"async_id,omitempty"`
+	SessionID   uint64   `json:"session_id"`
+	Signature   [16]byte `json:"signature"`
+}
+
+// Marshal encodes the header
+func (h *SMB2Header) Marshal() []byte {
+	b := make([]byte, smb2HeaderLength)
+	copy(b, []byte{0xfe, 'S', 'M', 'B'})
+	binary.LittleEndian.PutUint16(b[4:], smb2HeaderStructureSize)
+	binary.LittleEndian.PutUint16(b[6:], h.CreditCharge)
+	binary.LittleEndian.PutUint32(b[8:], h.Status)
+	binary.LittleEndian.PutUint16(b[12:], h.Command)
+	binary.LittleEndian.PutUint16(b[14:], h.Credits)
+	binary.LittleEndian.PutUint32(b[16:], h.Flags)
+	binary.LittleEndian.PutUint32(b[20:], h.NextCommand)
+	binary.LittleEndian.PutUint64(b[24:], h.MessageID)
+	if h.Flags&SMB2FlagAsyncCommand != 0 {
+		binary.LittleEndian.PutUint64(b[32:], h.AsyncID)
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], h.ProcessID)
+		binary.LittleEndian.PutUint32(b[36:], h.TreeID)
+	}
+	binary.LittleEndian.PutUint64(b[40:], h.SessionID)
+	copy(b[48:], h.Signature[:])
+	return b
+}
+
+// Unmarshal decodes a header from the start of a SMB2 message
+func (h *SMB2Header) Unmarshal(data []byte) error {
+	if len(data) < smb2HeaderLength {
+		return smbTruncated("SMB2 header", "fixed fields", 0, smb2HeaderLength, len(data))
+	}
+	if data[0] != 0xfe || data[1] != 'S' || data[2] != 'M' || data[3] != 'B' {
+		return ErrNoSMB2Header
+	}
+	if size := binary.LittleEndian.Uint16(data[4:]); size != smb2HeaderStructureSize {
+		return fmt.Errorf("SMB2 header structure size is %d, not %d", size, smb2HeaderStructureSize)
+	}
+
+	*h = SMB2Header{
+		CreditCharge: binary.LittleEndian.Uint16(data[6:]),
+		Status:       binary.LittleEndian.Uint32(data[8:]),
+		Command:      binary.LittleEndian.Uint16(data[12:]),
+		Credits:      binary.LittleEndian.Uint16(data[14:]),
+		Flags:        binary.LittleEndian.Uint32(data[16:]),
+		NextCommand:  binary.LittleEndian.Uint32(data[20:]),
+		MessageID:    binary.LittleEndian.Uint64(data[24:]),
+		SessionID:    binary.LittleEndian.Uint64(data[40:]),
+	}
+	if h.Flags&SMB2FlagAsyncCommand != 0 {
+		h.AsyncID = binary.LittleEndian.Uint64(data[32:])
+	} else {
+		h.ProcessID = binary.LittleEndian.Uint32(data[32:])
+		h.TreeID = binary.LittleEndian.Uint32(data[36:])
+	}
+	copy(h.Signature[:], data[48:64])
+	return nil
+}
+
+// IsResponse returns true if the header is from a server response
+func (h *SMB2Header) IsResponse() bool {
+	return h.Flags&SMB2FlagServerToRedir != 0
+}
+
+// SMB2Body is the command-specific part of a SMB2 message that follows the header. Buffer
+// offsets within the body are relative to the start of the header, as on the wire.
+type SMB2Body interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// MarshalSMB2Message encodes a header and body, including the NetBIOS header
+func MarshalSMB2Message(h *SMB2Header, body SMB2Body) ([]byte, error) {
+	b, err := body.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	msg := append(h.Marshal(), b...)
+	if len(msg) > 0x00ffffff {
+		return nil, fmt.Errorf("SMB2 message is too large (%d bytes)", len(msg))
+	}
+
+	nbhd := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(nbhd, uint32(len(msg)))
+	return append(nbhd, msg...), nil
+}
+
+// UnmarshalSMB2Message decodes the first SMB2 message of a reply, with or without its NetBIOS
+// header. If the status in the header marks an error response, the body is left untouched and
+// the decoded *SMB2ErrorResponse is returned as the error along with the header.
+func UnmarshalSMB2Message(blob []byte, body SMB2Body) (*SMB2Header, error) {
+	data, err := findSMB2(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &SMB2Header{}
+	if err := h.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	// The body of a compounded message ends where the next message begins
+	end := len(data)
+	if h.NextCommand != 0 {
+		if int64(h.NextCommand) > int64(len(data)) || h.NextCommand < smb2HeaderLength {
+			return h, fmt.Errorf("SMB2 next command offset %d is outside the %d byte reply", h.NextCommand, len(data))
+		}
+		end = int(h.NextCommand)
+	}
+	b := data[smb2HeaderLength:end]
+
+	if h.isErrorResponse() {
+		er := &SMB2ErrorResponse{}
+		if err := er.Unmarshal(b); err != nil {
+			return h, err
+		}
+		er.Status = h.Status
+		return h, er
+	}
+	return h, body.Unmarshal(b)
+}
+
+// isErrorResponse returns true if the status of a response means it carries an ERROR body.
+// STATUS_MORE_PROCESSING_REQUIRED is the one non-success status sent with a normal body by
+// the commands implemented here.
+func (h *SMB2Header) isErrorResponse() bool {
+	if !h.IsResponse() || h.Status == SMBStatusSuccess {
+		return false
+	}
+	return h.Command != SMB2CommandSessionSetup || h.Status != SMBStatusMoreProcessingRequired
+}
+
+// smb2CheckBody verifies the structure size at the start of a body
+func smb2CheckBody(message string, data []byte, size, fixed int) error {
+	if len(data) < fixed {
+		return smbTruncated(message, "fixed fields", smb2HeaderLength, fixed, smb2HeaderLength+len(data))
+	}
+	if got := int(binary.LittleEndian.Uint16(data)); got != size {
+		return fmt.Errorf("%s structure size is %d, not %d", message, got, size)
+	}
+	return nil
+}
+
+// smb2BodyBuffer returns the buffer described by an offset from the start of the header and a length
+func smb2BodyBuffer(message, field string, data []byte, offset, length int) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	start := offset - smb2HeaderLength
+	if start < 0 || start+length > len(data) {
+		return nil, smbTruncated(message, field, offset, length, smb2HeaderLength+len(data))
+	}
+	return append([]byte{}, data[start:start+length]...), nil
+}
+
+// smb2BufferOffset returns the offset from the header of a buffer appended to a body, or zero
+// for an empty buffer
+func smb2BufferOffset(body []byte, buf []byte) uint16 {
+	if len(buf) == 0 {
+		return 0
+	}
+	return uint16(smb2HeaderLength + len(body))
+}
+
+// smb2Pad8 pads a body so the data that follows starts on a 64-bit boundary from the header
+func smb2Pad8(body []byte) []byte {
+	for (smb2HeaderLength+len(body))%8 != 0 {
+		body = append(body, 0)
+	}
+	return body
+}
+
+// SMB2NegotiateContext is a SMB 3.1.1 negotiate context, with its data left encoded
+type SMB2NegotiateContext struct {
+	Type uint16 `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// marshalSMB2NegotiateContexts appends the contexts to a body, aligning each on a 64-bit
+// boundary, and returns the offset of the first from the header
+func marshalSMB2NegotiateContexts(body []byte, contexts []SMB2NegotiateContext) ([]byte, uint32, error) {
+	if len(contexts) == 0 {
+		return body, 0, nil
+	}
+	body = smb2Pad8(body)
+	offset := uint32(smb2HeaderLength + len(body))
+	for i, ctx := range contexts {
+		if len(ctx.Data) > math.MaxUint16 {
+			return nil, 0, fmt.Errorf("negotiate context %d is too large (%d bytes)", i, len(ctx.Data))
+		}
+		if i > 0 {
+			body = smb2Pad8(body)
+		}
+		body = binary.LittleEndian.AppendUint16(body, ctx.Type)
+		body = binary.LittleEndian.AppendUint16(body, uint16(len(ctx.Data)))
+		body = append(body, 0, 0, 0, 0)
+		body = append(body, ctx.Data...)
+	}
+	return body, offset, nil
+}
+
+// unmarshalSMB2NegotiateContexts decodes count contexts starting at an offset from the header
+func unmarshalSMB2NegotiateContexts(message string, data []byte, offset, count int) ([]SMB2NegotiateContext, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	idx := offset - smb2HeaderLength
+	if idx < 0 {
+		return nil, smbTruncated(message, "contexts", offset, count*8, smb2HeaderLength+len(data))
+	}
+
+	contexts := make([]SMB2NegotiateContext, 0, count)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			for (smb2HeaderLength+idx)%8 != 0 {
+				idx++
+			}
+		}
+		if idx+8 > len(data) {
+			return nil, smbTruncated(message, fmt.Sprintf("context %d header", i), smb2HeaderLength+idx, 8, smb2HeaderLength+len(data))
+		}
+		t := binary.LittleEndian.Uint16(data[idx:])
+		l := int(binary.LittleEndian.Uint16(data[idx+2:]))
+		idx += 8
+		if idx+l > len(data) {
+			return nil, smbTruncated(message, fmt.Sprintf("context %d (type %d)", i, t), smb2HeaderLength+idx, l, smb2HeaderLength+len(data))
+		}
+		contexts = append(contexts, SMB2NegotiateContext{Type: t, Data: append([]byte{}, data[idx:idx+l]...)})
+		idx += l
+	}
+	return contexts, nil
+}
+
+// SMB2NegotiateReq is a SMB2 NEGOTIATE request. ClientStartTime is only sent when there are
+// no negotiate contexts, since the context offset and count take its place.
+type SMB2NegotiateReq struct {
+	SecurityMode      uint16                 `json:"security_mode"`
+	Capabilities      uint32                 `json:"capabilities"`
+	ClientGUID        [16]byte               `json:"client_guid"`
+	ClientStartTime   uint64                 `json:"client_start_time,omitempty"`
+	Dialects          []uint16               `json:"dialects"`
+	NegotiateContexts []SMB2NegotiateContext `json:"negotiate_contexts,omitempty"`
+}
+
+// Marshal encodes the request body
+func (m *SMB2NegotiateReq) Marshal() ([]byte, error) {
+	if len(m.Dialects) > math.MaxUint16 || len(m.NegotiateContexts) > math.MaxUint16 {
+		return nil, fmt.Errorf("too many dialects or negotiate contexts")
+	}
+	b := binary.LittleEndian.AppendUint16(nil, smb2NegotiateReqStructSize)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.Dialects)))
+	b = binary.LittleEndian.AppendUint16(b, m.SecurityMode)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	b = append(b, m.ClientGUID[:]...)
+	b = binary.LittleEndian.AppendUint64(b, m.ClientStartTime)
+	for _, d := range m.Dialects {
+		b = binary.LittleEndian.AppendUint16(b, d)
+	}
+
+	b, offset, err := marshalSMB2NegotiateContexts(b, m.NegotiateContexts)
+	if err != nil {
+		return nil, err
+	}
+	if offset != 0 {
+		binary.LittleEndian.PutUint32(b[28:], offset)
+		binary.LittleEndian.PutUint16(b[32:], uint16(len(m.NegotiateContexts)))
+		binary.LittleEndian.PutUint16(b[34:], 0)
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the request body. Contexts are only decoded when 0x0311 is offered.
+func (m *SMB2NegotiateReq) Unmarshal(data []byte) error {
+	if err := smb2CheckBody("negotiate request", data, smb2NegotiateReqStructSize, 36); err != nil {
+		return err
+	}
+	count := int(binary.LittleEndian.Uint16(data[2:]))
+	if 36+count*2 > len(data) {
+		return smbTruncated("negotiate request", "dialects", smb2HeaderLength+36, count*2, smb2HeaderLength+len(data))
+	}
+
+	*m = SMB2NegotiateReq{
+		SecurityMode:    binary.LittleEndian.Uint16(data[4:]),
+		Capabilities:    binary.LittleEndian.Uint32(data[8:]),
+		ClientStartTime: binary.LittleEndian.Uint64(data[28:]),
+	}
+	copy(m.ClientGUID[:], data[12:28])
+	offer311 := false
+	for i := 0; i < count; i++ {
+		d := binary.LittleEndian.Uint16(data[36+i*2:])
+		offer311 = offer311 || d == SMB2Dialect311
+		m.Dialects = append(m.Dialects, d)
+	}
+	if !offer311 {
+		return nil
+	}
+
+	m.ClientStartTime = 0
+	offset := int(binary.LittleEndian.Uint32(data[28:]))
+	ctxCount := int(binary.LittleEndian.Uint16(data[32:]))
+	var err error
+	m.NegotiateContexts, err = unmarshalSMB2NegotiateContexts("negotiate request", data, offset, ctxCount)
+	return err
+}
+
+// SMB2NegotiateResp is a SMB2 NEGOTIATE response. Unlike ParseSMB2NegotiateReply, Unmarshal
+// leaves the security buffer and negotiate contexts encoded and fails on any truncation.
+type SMB2NegotiateResp struct {
+	SecurityMode      uint16                 `json:"security_mode"`
+	DialectRevision   uint16                 `json:"dialect_revision"`
+	ServerGUID        [16]byte               `json:"server_guid"`
+	Capabilities      uint32                 `json:"capabilities"`
+	MaxTransactSize   uint32                 `json:"max_transact_size"`
+	MaxReadSize       uint32                 `json:"max_read_size"`
+	MaxWriteSize      uint32                 `json:"max_write_size"`
+	SystemTime        uint64                 `json:"system_time"`
+	ServerStartTime   uint64                 `json:"server_start_time"`
+	SecurityBuffer    []byte                 `json:"security_buffer,omitempty"`
+	NegotiateContexts []SMB2NegotiateContext `json:"negotiate_contexts,omitempty"`
+}
+
+// Marshal encodes the response body
+func (m *SMB2NegotiateResp) Marshal() ([]byte, error) {
+	if len(m.SecurityBuffer) > math.MaxUint16 || len(m.NegotiateContexts) > math.MaxUint16 {
+		return nil, fmt.Errorf("negotiate response security buffer or contexts are too large")
+	}
+	b := binary.LittleEndian.AppendUint16(nil, smb2NegotiateResStructSize)
+	b = binary.LittleEndian.AppendUint16(b, m.SecurityMode)
+	b = binary.LittleEndian.AppendUint16(b, m.DialectRevision)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.NegotiateContexts)))
+	b = append(b, m.ServerGUID[:]...)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxTransactSize)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxReadSize)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxWriteSize)
+	b = binary.LittleEndian.AppendUint64(b, m.SystemTime)
+	b = binary.LittleEndian.AppendUint64(b, m.ServerStartTime)
+	b = binary.LittleEndian.AppendUint16(b, smb2BufferOffset(make([]byte, 64), m.SecurityBuffer))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.SecurityBuffer)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = append(b, m.SecurityBuffer...)
+
+	b, offset, err := marshalSMB2NegotiateContexts(b, m.NegotiateContexts)
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(b[60:], offset)
+	return b, nil
+}
+
+// Unmarshal decodes the response body
+func (m *SMB2NegotiateResp) Unmarshal(data []byte) error {
+	if err := smb2CheckBody("negotiate response", data, smb2NegotiateResStructSize, 64); err != nil {
+		return err
+	}
+
+	*m = SMB2NegotiateResp{
+		SecurityMode:    binary.LittleEndian.Uint16(data[2:]),
+		DialectRevision: binary.LittleEndian.Uint16(data[4:]),
+		Capabilities:    binary.LittleEndian.Uint32(data[24:]),
+		MaxTransactSize: binary.LittleEndian.Uint32(data[28:]),
+		MaxReadSize:     binary.LittleEndian.Uint32(data[32:]),
+		MaxWriteSize:    binary.LittleEndian.Uint32(data[36:]),
+		SystemTime:      binary.LittleEndian.Uint64(data[40:]),
+		ServerStartTime: binary.LittleEndian.Uint64(data[48:]),
+	}
+	copy(m.ServerGUID[:], data[8:24])
+
+	var err error
+	m.SecurityBuffer, err = smb2BodyBuffer("negotiate response", "security buffer", data,
+		int(binary.LittleEndian.Uint16(data[56:])), int(binary.LittleEndian.Uint16(data[58:])))
+	if err != nil {
+		return err
+	}
+	if m.DialectRevision != SMB2Dialect311 {
+		return nil
+	}
+	m.NegotiateContexts, err = unmarshalSMB2NegotiateContexts("negotiate response", data,
+		int(binary.LittleEndian.Uint32(data[60:])), int(binary.LittleEndian.Uint16(data[6:])))
+	return err
+}
+
+// SMB2SessionSetupReq is a SMB2 SESSION_SETUP request
+type SMB2SessionSetupReq struct {
+	Flags             uint8  `json:"flags"`
+	SecurityMode      uint8  `json:"security_mode"`
+	Capabilities      uint32 `json:"capabilities"`
+	Channel           uint32 `json:"channel"`
+	PreviousSessionID uint64 `json:"previous_session_id"`
+	SecurityBuffer    []byte `json:"security_buffer,omitempty"`
+}
+
+// Marshal encodes the request body
+func (m *SMB2SessionSetupReq) Marshal() ([]byte, error) {
+	if len(m.SecurityBuffer) > math.MaxUint16 {
+		return nil, fmt.Errorf("session setup security buffer is too large (%d bytes)", len(m.SecurityBuffer))
+	}
+	b := binary.LittleEndian.AppendUint16(nil, smb2SetupReqStructSize)
+	b = append(b, m.Flags, m.SecurityMode)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	b = binary.LittleEndian.AppendUint32(b, m.Channel)
+	b = binary.LittleEndian.AppendUint16(b, smb2BufferOffset(make([]byte, 24), m.SecurityBuffer))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.SecurityBuffer)))
+	b = binary.LittleEndian.AppendUint64(b, m.PreviousSessionID)
+	return append(b, m.SecurityBuffer...), nil
+}
+
+// Unmarshal decodes the request body
+func (m *SMB2SessionSetupReq) Unmarshal(data []byte) error {
+	if err := smb2CheckBody("session setup request", data, smb2SetupReqStructSize, 24); err != nil {
+		return err
+	}
+
+	*m = SMB2SessionSetupReq{
+		Flags:             data[2],
+		SecurityMode:      data[3],
+		Capabilities:      binary.LittleEndian.Uint32(data[4:]),
+		Channel:           binary.LittleEndian.Uint32(data[8:]),
+		PreviousSessionID: binary.LittleEndian.Uint64(data[16:]),
+	}
+	var err error
+	m.SecurityBuffer, err = smb2BodyBuffer("session setup request", "security buffer", data,
+		int(binary.LittleEndian.Uint16(data[12:])), int(binary.LittleEndian.Uint16(data[14:])))
+	return err
+}
+
+// SMB2SessionSetupResp is a SMB2 SESSION_SETUP response
+type SMB2SessionSetupResp struct {
+	SessionFlags   uint16 `json:"session_flags"`
+	SecurityBuffer []byte `json:"security_buffer,omitempty"`
+}
+
+// Marshal encodes the response body
+func (m *SMB2SessionSetupResp) Marshal() ([]byte, error) {
+	if len(m.SecurityBuffer) > math.MaxUint16 {
+		return nil, fmt.Errorf("session setup security buffer is too large (%d bytes)", len(m.SecurityBuffer))
+	}
+	b := binary.LittleEndian.AppendUint16(nil, smb2SetupResStructSize)
+	b = binary.LittleEndian.AppendUint16(b, m.SessionFlags)
+	b = binary.LittleEndian.AppendUint16(b, smb2BufferOffset(make([]byte, 8), m.SecurityBuffer))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.SecurityBuffer)))
+	return append(b, m.SecurityBuffer...), nil
+}
+
+// Unmarshal decodes the response body
+func (m *SMB2SessionSetupResp) Unmarshal(data []byte) error {
+	if err := smb2CheckBody("session setup response", data, smb2SetupResStructSize, 8); err != nil {
+		return err
+	}
+
+	*m = SMB2SessionSetupResp{SessionFlags: binary.LittleEndian.Uint16(data[2:])}
+	var err error
+	m.SecurityBuffer, err = smb2BodyBuffer("session setup response", "security buffer", data,
+		int(binary.LittleEndian.Uint16(data[4:])), int(binary.LittleEndian.Uint16(data[6:])))
+	return err
+}
+
+// SMB2Logoff is a SMB2 LOGOFF request or response, which share the same empty body
+type SMB2Logoff struct{}
+
+// Marshal encodes the body
+func (m *SMB2Logoff) Marshal() ([]byte, error) {
+	return append(binary.LittleEndian.AppendUint16(nil, smb2EmptyStructureSize), 0, 0), nil
+}
+
+// Unmarshal decodes the body
+func (m *SMB2Logoff) Unmarshal(data []byte) error {
+	return smb2CheckBody("logoff", data, smb2EmptyStructureSize, 4)
+}
+
+// SMB2Echo is a SMB2 ECHO request or response, which share the same empty body
+type SMB2Echo struct{}
+
+// Marshal encodes the body
+func (m *SMB2Echo) Marshal() ([]byte, error) {
+	return append(binary.LittleEndian.AppendUint16(nil, smb2EmptyStructureSize), 0, 0), nil
+}
+
+// Unmarshal decodes the body
+func (m *SMB2Echo) Unmarshal(data []byte) error {
+	return smb2CheckBody("echo", data, smb2EmptyStructureSize, 4)
+}
+
+// SMB2ErrorResponse is the body of a SMB2 response that failed. It is returned as the error
+// by UnmarshalSMB2Message, with Status copied from the header.
+type SMB2ErrorResponse struct {
+	Status            uint32 `json:"status"`
+	ErrorContextCount uint8  `json:"error_context_count"`
+	ErrorData         []byte `json:"error_data,omitempty"`
+}
+
+// Error describes the status
+func (m *SMB2ErrorResponse) Error() string {
+	return fmt.Sprintf("SMB2 error status 0x%.8x", m.Status)
+}
+
+// Marshal encodes the response body. An empty ErrorData is sent as the single zero byte
+// required by the specification.
+func (m *SMB2ErrorResponse) Marshal() ([]byte, error) {
+	b := binary.LittleEndian.AppendUint16(nil, smb2ErrorStructureSize)
+	b = append(b, m.ErrorContextCount, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.ErrorData)))
+	if len(m.ErrorData) == 0 {
+		return append(b, 0), nil
+	}
+	return append(b, m.ErrorData...), nil
+}
+
+// Unmarshal decodes the response body. Status is not part of the body and is left unchanged.
+func (m *SMB2ErrorResponse) Unmarshal(data []byte) error {
+	if err := smb2CheckBody("error response", data, smb2ErrorStructureSize, 8); err != nil {
+		return err
+	}
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if 8+int64(count) > int64(len(data)) {
+		return smbTruncated("error response", "error data", smb2HeaderLength+8, count, smb2HeaderLength+len(data))
+	}
+
+	m.ErrorContextCount = data[2]
+	m.ErrorData = nil
+	if count > 0 {
+		m.ErrorData = append([]byte{}, data[8:8+count]...)
+	}
+	return nil
+}
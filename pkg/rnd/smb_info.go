@@ -0,0 +1,677 @@
+package rnd
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gofrs/uuid"
+)
+
+// SMB2 status codes seen in responses
+const (
+	SMBStatusSuccess                = 0x00000000
+	SMBStatusPending                = 0x00000103
+	SMBStatusMoreProcessingRequired = 0xc0000016
+	SMBStatusInvalidParameter       = 0xc000000d
+	SMBStatusAccessDenied           = 0xc0000022
+	SMBStatusUserSessionDeleted     = 0xc0000203
+)
+
+// ErrNoSMB2Header is returned when a reply does not contain a SMB2 header
+var ErrNoSMB2Header = errors.New("no SMB2 header found")
+
+// ErrSMBTruncated is wrapped by every SMBParseError, for use with errors.Is
+var ErrSMBTruncated = errors.New("truncated")
+
+// SMBParseError describes a field that extends past the end of a SMB or NTLMSSP message
+type SMBParseError struct {
+	// Message names the message or structure being decoded
+	Message string
+	// Field names the field that did not fit
+	Field string
+	// Offset and Length locate the field within the message
+	Offset int
+	Length int
+	// Size is the number of bytes available
+	Size int
+}
+
+// Error describes the truncated field
+func (e *SMBParseError) Error() string {
+	return fmt.Sprintf("%s %s truncated: need %d bytes at offset %d of %d", e.Message, e.Field, e.Length, e.Offset, e.Size)
+}
+
+// Unwrap returns ErrSMBTruncated
+func (e *SMBParseError) Unwrap() error {
+	return ErrSMBTruncated
+}
+
+// smbTruncated returns a SMBParseError for a field
+func smbTruncated(message, field string, offset, length, size int) error {
+	return &SMBParseError{Message: message, Field: field, Offset: offset, Length: length, Size: size}
+}
+
+// smb2HeaderLength is the size of the SMB2 header that precedes every command
+const smb2HeaderLength = 64
+
+// NegotiateInfo holds the fields of a SMB2 NEGOTIATE response
+type NegotiateInfo struct {
+	SecurityMode uint16    `json:"security_mode"`
+	Signing      string    `json:"signing,omitempty"`
+	Dialect      uint16    `json:"dialect"`
+	GUID         uuid.UUID `json:"guid"`
+	Capabilities uint32    `json:"capabilities"`
+
+	MaxTransactSize uint32 `json:"max_transact_size"`
+	MaxReadSize     uint32 `json:"max_read_size"`
+	MaxWriteSize    uint32 `json:"max_write_size"`
+	// SystemTime is the server's clock when it sent the response
+	SystemTime *time.Time `json:"system_time,omitempty"`
+	// ServerStartTime is nil for servers that do not report it, including Windows 10 and later
+	ServerStartTime *time.Time `json:"server_start_time,omitempty"`
+	// SecurityMechanisms lists the mechTypes offered in the SPNEGO security buffer
+	SecurityMechanisms []asn1.ObjectIdentifier `json:"-"`
+
+	// Negotiate contexts (SMB 3.1.1)
+	ContextTypes          []uint16 `json:"context_types,omitempty"`
+	PreauthHashAlgorithms []uint16 `json:"preauth_hash_algorithms,omitempty"`
+	PreauthSaltLength     uint16   `json:"preauth_salt_length,omitempty"`
+	Ciphers               []uint16 `json:"ciphers,omitempty"`
+	CompressionFlags      uint32   `json:"compression_flags,omitempty"`
+	CompressionAlgorithms []uint16 `json:"compression_algorithms,omitempty"`
+	NetName               string   `json:"netname,omitempty"`
+	TransportFlags        uint32   `json:"transport_flags,omitempty"`
+	RDMATransforms        []uint16 `json:"rdma_transforms,omitempty"`
+	SigningAlgorithms     []uint16 `json:"signing_algorithms,omitempty"`
+
+	// Warnings describes optional data that could not be decoded, such as a malformed
+	// security buffer or negotiate context
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// warn records a problem with optional data in the response
+func (ni *NegotiateInfo) warn(err error) {
+	ni.Warnings = append(ni.Warnings, err.Error())
+}
+
+// SMB2 negotiate context types (MS-SMB2 2.2.3.1)
+const (
+	SMB2PreauthIntegrityCapabilities = 0x0001
+	SMB2EncryptionCapabilities       = 0x0002
+	SMB2CompressionCapabilities      = 0x0003
+	SMB2NetnameNegotiateContextID    = 0x0005
+	SMB2TransportCapabilities        = 0x0006
+	SMB2RDMATransformCapabilities    = 0x0007
+	SMB2SigningCapabilities          = 0x0008
+)
+
+// SMB2 preauth integrity hash algorithms
+const (
+	SMB2HashSHA512 = 0x0001
+)
+
+// SMB2 encryption ciphers
+const (
+	SMB2CipherAES128CCM = 0x0001
+	SMB2CipherAES128GCM = 0x0002
+	SMB2CipherAES256CCM = 0x0003
+	SMB2CipherAES256GCM = 0x0004
+)
+
+// SMB2 compression algorithms
+const (
+	SMB2CompressionNone       = 0x0000
+	SMB2CompressionLZNT1      = 0x0001
+	SMB2CompressionLZ77       = 0x0002
+	SMB2CompressionLZ77Huff   = 0x0003
+	SMB2CompressionPatternV1  = 0x0004
+	SMB2CompressionFlagNone   = 0x00000000
+	SMB2CompressionFlagChains = 0x00000001
+)
+
+// SMB2 signing algorithms
+const (
+	SMB2SigningHMACSHA256 = 0x0000
+	SMB2SigningAESCMAC    = 0x0001
+	SMB2SigningAESGMAC    = 0x0002
+)
+
+// SMB2 RDMA transforms
+const (
+	SMB2RDMATransformNone       = 0x0000
+	SMB2RDMATransformEncryption = 0x0001
+	SMB2RDMATransformSigning    = 0x0002
+)
+
+// SMB2AcceptTransportLevelSecurity is the transport capabilities flag for QUIC and similar transports
+const SMB2AcceptTransportLevelSecurity = 0x00000001
+
+// SessionSetupInfo holds the fields of a SMB2 SESSION_SETUP response
+type SessionSetupInfo struct {
+	Status       uint32 `json:"status"`
+	SessionID    uint64 `json:"session_id"`
+	SessionFlags uint16 `json:"session_flags"`
+	// Signature is nil when the response was not signed
+	Signature []byte `json:"signature,omitempty"`
+	// SecurityBlob is the GSS token returned by the server, such as a NTLMSSP CHALLENGE
+	SecurityBlob []byte `json:"-"`
+	// Warnings describes a body or security buffer that could not be decoded
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// findSMB2 returns the reply starting from its SMB2 header
+func findSMB2(blob []byte) ([]byte, error) {
+	smbOffset := bytes.Index(blob, []byte{0xfe, 'S', 'M', 'B'})
+	if smbOffset < 0 {
+		return nil, ErrNoSMB2Header
+	}
+	return blob[smbOffset:], nil
+}
+
+// ParseSMB2NegotiateReply decodes a SMB2 NEGOTIATE response. An error is only returned if
+// the header or fixed fields are missing; problems with the security buffer or negotiate
+// contexts are recorded in Warnings and the rest of the response is still decoded.
+func ParseSMB2NegotiateReply(blob []byte) (*NegotiateInfo, error) {
+	data, err := findSMB2(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	// The fixed part of the response runs through the negotiate context offset
+	if len(data) < smb2HeaderLength+64 {
+		return nil, smbTruncated("negotiate response", "fixed fields", 0, smb2HeaderLength+64, len(data))
+	}
+	body := data[smb2HeaderLength:]
+
+	ni := &NegotiateInfo{
+		SecurityMode: binary.LittleEndian.Uint16(body[2:]),
+		Dialect:      binary.LittleEndian.Uint16(body[4:]),
+		GUID:         uuid.FromBytesOrNil(body[8 : 8+16]),
+		Capabilities: binary.LittleEndian.Uint32(body[24:]),
+
+		MaxTransactSize: binary.LittleEndian.Uint32(body[28:]),
+		MaxReadSize:     binary.LittleEndian.Uint32(body[32:]),
+		MaxWriteSize:    binary.LittleEndian.Uint32(body[36:]),
+	}
+	switch ni.SecurityMode {
+	case 0:
+		ni.Signing = "disabled"
+	case 1:
+		ni.Signing = "enabled"
+	case 2, 3:
+		ni.Signing = "required"
+	}
+	if ft := binary.LittleEndian.Uint64(body[40:]); ft != 0 {
+		ts := FiletimeToTime(ft)
+		ni.SystemTime = &ts
+	}
+	if ft := binary.LittleEndian.Uint64(body[48:]); ft != 0 {
+		ts := FiletimeToTime(ft)
+		ni.ServerStartTime = &ts
+	}
+
+	// The security buffer offset is relative to the start of the SMB2 header
+	secOffset := int(binary.LittleEndian.Uint16(body[56:]))
+	secLength := int(binary.LittleEndian.Uint16(body[58:]))
+	if secLength > 0 {
+		if secOffset+secLength > len(data) {
+			ni.warn(smbTruncated("negotiate response", "security buffer", secOffset, secLength, len(data)))
+		} else if ni.SecurityMechanisms, err = ParseSPNEGOMechTypes(data[secOffset : secOffset+secLength]); err != nil {
+			ni.warn(err)
+		}
+	}
+
+	negCtxCount := int(binary.LittleEndian.Uint16(body[6:]))
+	negCtxOffset := int(binary.LittleEndian.Uint32(body[60:]))
+	if negCtxCount == 0 || negCtxOffset == 0 {
+		return ni, nil
+	}
+	if negCtxOffset > len(data) {
+		ni.warn(smbTruncated("negotiate response", "contexts", negCtxOffset, negCtxCount*8, len(data)))
+		return ni, nil
+	}
+
+	negCtxData := data[negCtxOffset:]
+	idx := 0
+	for i := 0; i < negCtxCount; i++ {
+		if idx+8 > len(negCtxData) {
+			ni.warn(smbTruncated("negotiate response", fmt.Sprintf("context %d header", i), negCtxOffset+idx, 8, len(data)))
+			break
+		}
+		negType := int(binary.LittleEndian.Uint16(negCtxData[idx:]))
+		negLen := int(binary.LittleEndian.Uint16(negCtxData[idx+2:]))
+		idx += 8
+
+		if idx+negLen > len(negCtxData) {
+			ni.warn(smbTruncated("negotiate response", fmt.Sprintf("context %d (type %d)", i, negType), negCtxOffset+idx, negLen, len(data)))
+			break
+		}
+		// A malformed context is skipped, since its length still locates the next one
+		if err := parseNegotiateContext(negType, negCtxData[idx:idx+negLen], ni); err != nil {
+			ni.warn(err)
+		}
+
+		// Move the index to the next context, which is aligned on a 64-bit boundary
+		idx += negLen
+		for idx%8 != 0 {
+			idx++
+		}
+	}
+	return ni, nil
+}
+
+// parseNegotiateContext decodes a negotiate context into the negotiate info
+func parseNegotiateContext(t int, data []byte, ni *NegotiateInfo) error {
+	ni.ContextTypes = append(ni.ContextTypes, uint16(t))
+
+	switch t {
+	case SMB2PreauthIntegrityCapabilities:
+		if len(data) < 4 {
+			return smbTruncated("preauth integrity context", "fixed fields", 0, 4, len(data))
+		}
+		hashCount := int(binary.LittleEndian.Uint16(data[:]))
+		algs, err := readUint16List("preauth integrity context", "hash algorithms", data, 4, hashCount)
+		if err != nil {
+			return err
+		}
+		ni.PreauthSaltLength = binary.LittleEndian.Uint16(data[2:])
+		ni.PreauthHashAlgorithms = algs
+
+	case SMB2EncryptionCapabilities:
+		if len(data) < 2 {
+			return smbTruncated("encryption context", "cipher count", 0, 2, len(data))
+		}
+		cipherCount := int(binary.LittleEndian.Uint16(data[:]))
+		ciphers, err := readUint16List("encryption context", "ciphers", data, 2, cipherCount)
+		if err != nil {
+			return err
+		}
+		ni.Ciphers = ciphers
+
+	case SMB2CompressionCapabilities:
+		if len(data) < 8 {
+			return smbTruncated("compression context", "fixed fields", 0, 8, len(data))
+		}
+		compCount := int(binary.LittleEndian.Uint16(data[:]))
+		algs, err := readUint16List("compression context", "algorithms", data, 8, compCount)
+		if err != nil {
+			return err
+		}
+		ni.CompressionFlags = binary.LittleEndian.Uint32(data[4:])
+		ni.CompressionAlgorithms = algs
+
+	case SMB2NetnameNegotiateContextID:
+		ni.NetName = TrimName(utf16LEToString(data))
+
+	case SMB2TransportCapabilities:
+		if len(data) < 4 {
+			return smbTruncated("transport context", "flags", 0, 4, len(data))
+		}
+		ni.TransportFlags = binary.LittleEndian.Uint32(data[:])
+
+	case SMB2RDMATransformCapabilities:
+		if len(data) < 8 {
+			return smbTruncated("RDMA transform context", "fixed fields", 0, 8, len(data))
+		}
+		transformCount := int(binary.LittleEndian.Uint16(data[:]))
+		transforms, err := readUint16List("RDMA transform context", "transforms", data, 8, transformCount)
+		if err != nil {
+			return err
+		}
+		ni.RDMATransforms = transforms
+
+	case SMB2SigningCapabilities:
+		if len(data) < 2 {
+			return smbTruncated("signing context", "algorithm count", 0, 2, len(data))
+		}
+		algCount := int(binary.LittleEndian.Uint16(data[:]))
+		algs, err := readUint16List("signing context", "algorithms", data, 2, algCount)
+		if err != nil {
+			return err
+		}
+		ni.SigningAlgorithms = algs
+	}
+	return nil
+}
+
+// readUint16List returns count little-endian 16-bit values starting at idx
+func readUint16List(message, field string, data []byte, idx int, count int) ([]uint16, error) {
+	if idx+2*count > len(data) {
+		return nil, smbTruncated(message, field, idx, 2*count, len(data))
+	}
+	res := make([]uint16, count)
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint16(data[idx+2*i:])
+	}
+	return res, nil
+}
+
+// SMB2NegotiateContextName returns the name of a negotiate context type
+func SMB2NegotiateContextName(id uint16) string {
+	switch id {
+	case SMB2PreauthIntegrityCapabilities:
+		return "preauth-integrity"
+	case SMB2EncryptionCapabilities:
+		return "encryption"
+	case SMB2CompressionCapabilities:
+		return "compression"
+	case SMB2NetnameNegotiateContextID:
+		return "netname"
+	case SMB2TransportCapabilities:
+		return "transport"
+	case SMB2RDMATransformCapabilities:
+		return "rdma-transform"
+	case SMB2SigningCapabilities:
+		return "signing"
+	}
+	return fmt.Sprintf("unknown-%d", id)
+}
+
+// SMB2HashAlgorithmName returns the name of a preauth integrity hash algorithm
+func SMB2HashAlgorithmName(id uint16) string {
+	if id == SMB2HashSHA512 {
+		return "sha512"
+	}
+	return fmt.Sprintf("unknown-%d", id)
+}
+
+// SMB2CipherName returns the name of an encryption cipher
+func SMB2CipherName(id uint16) string {
+	switch id {
+	case SMB2CipherAES128CCM:
+		return "aes-128-ccm"
+	case SMB2CipherAES128GCM:
+		return "aes-128-gcm"
+	case SMB2CipherAES256CCM:
+		return "aes-256-ccm"
+	case SMB2CipherAES256GCM:
+		return "aes-256-gcm"
+	}
+	return fmt.Sprintf("unknown-%d", id)
+}
+
+// SMB2SigningAlgorithmName returns the name of a signing algorithm
+func SMB2SigningAlgorithmName(id uint16) string {
+	switch id {
+	case SMB2SigningHMACSHA256:
+		return "hmac-sha256"
+	case SMB2SigningAESCMAC:
+		return "aes-cmac"
+	case SMB2SigningAESGMAC:
+		return "aes-gmac"
+	}
+	return fmt.Sprintf("unknown-%d", id)
+}
+
+// SMB2RDMATransformName returns the name of a RDMA transform
+func SMB2RDMATransformName(id uint16) string {
+	switch id {
+	case SMB2RDMATransformNone:
+		return "none"
+	case SMB2RDMATransformEncryption:
+		return "encryption"
+	case SMB2RDMATransformSigning:
+		return "signing"
+	}
+	return fmt.Sprintf("unknown-%d", id)
+}
+
+// SMB2CompressionName returns the name of a compression algorithm
+func SMB2CompressionName(id uint16) string {
+	switch id {
+	case SMB2CompressionNone:
+		return "none"
+	case SMB2CompressionLZNT1:
+		return "lznt1"
+	case SMB2CompressionLZ77:
+		return "lz77"
+	case SMB2CompressionLZ77Huff:
+		return "lz77+huff"
+	case SMB2CompressionPatternV1:
+		return "patternv1"
+	}
+	return fmt.Sprintf("unknown-%d", id)
+}
+
+// joinNames returns the names of a list of identifiers separated by tabs
+func joinNames(ids []uint16, name func(uint16) string) string {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, name(id))
+	}
+	return strings.Join(names, "\t")
+}
+
+// bitName names a single flag bit
+type bitName struct {
+	bit  uint32
+	name string
+}
+
+// bitNames returns the names of the bits set in flags, in table order, with any bits missing
+// from the table reported as hex values
+func bitNames(flags uint32, table []bitName) []string {
+	var names []string
+	for _, b := range table {
+		if flags&b.bit != 0 {
+			names = append(names, b.name)
+			flags &^= b.bit
+		}
+	}
+	for bit := uint32(1); flags != 0; bit <<= 1 {
+		if flags&bit != 0 {
+			names = append(names, fmt.Sprintf("0x%.8x", bit))
+			flags &^= bit
+		}
+	}
+	return names
+}
+
+// Uptime returns how long the server has been running according to its own clock, if it
+// reports a start time
+func (ni *NegotiateInfo) Uptime() (time.Duration, bool) {
+	if ni.SystemTime == nil || ni.ServerStartTime == nil {
+		return 0, false
+	}
+	return ni.SystemTime.Sub(*ni.ServerStartTime), true
+}
+
+// ClockSkew returns how far the server's clock is ahead of the local time at which the
+// response was received
+func (ni *NegotiateInfo) ClockSkew(received time.Time) (time.Duration, bool) {
+	if ni.SystemTime == nil {
+		return 0, false
+	}
+	return ni.SystemTime.Sub(received), true
+}
+
+// KerberosOffered returns true if the SPNEGO security buffer lists a Kerberos mechanism
+func (ni *NegotiateInfo) KerberosOffered() bool {
+	for _, oid := range ni.SecurityMechanisms {
+		if SPNEGOIsKerberos(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecurityMechanismNames returns the names of the offered security mechanisms
+func (ni *NegotiateInfo) SecurityMechanismNames() []string {
+	names := make([]string, 0, len(ni.SecurityMechanisms))
+	for _, oid := range ni.SecurityMechanisms {
+		names = append(names, SPNEGOMechanismName(oid))
+	}
+	return names
+}
+
+// Fields adds the negotiate info to a map using the smb.* keys
+func (ni *NegotiateInfo) Fields(info map[string]string) {
+	if ni.Signing != "" {
+		info["smb.Signing"] = ni.Signing
+	}
+	info["smb.Dialect"] = fmt.Sprintf("0x%.4x", ni.Dialect)
+	info["smb.GUID"] = ni.GUID.String()
+	info["smb.Capabilities"] = fmt.Sprintf("0x%.8x", ni.Capabilities)
+	info["smb.MaxTransactSize"] = fmt.Sprintf("%d", ni.MaxTransactSize)
+	info["smb.MaxReadSize"] = fmt.Sprintf("%d", ni.MaxReadSize)
+	info["smb.MaxWriteSize"] = fmt.Sprintf("%d", ni.MaxWriteSize)
+	if ni.SystemTime != nil {
+		info["smb.SystemTime"] = ni.SystemTime.Format(time.RFC3339)
+	}
+	if ni.ServerStartTime != nil {
+		info["smb.ServerStartTime"] = ni.ServerStartTime.Format(time.RFC3339)
+	}
+	if uptime, ok := ni.Uptime(); ok {
+		info["smb.Uptime"] = uptime.Round(time.Second).String()
+	}
+	if len(ni.SecurityMechanisms) > 0 {
+		info["smb.SecurityMechanisms"] = strings.Join(ni.SecurityMechanismNames(), "\t")
+		info["smb.Kerberos"] = fmt.Sprintf("%t", ni.KerberosOffered())
+	}
+	if len(ni.ContextTypes) > 0 {
+		info["smb.Contexts"] = joinNames(ni.ContextTypes, SMB2NegotiateContextName)
+	}
+	ni.contextFields(info)
+}
+
+// contextFields adds the fields from the negotiate contexts to a map
+func (ni *NegotiateInfo) contextFields(info map[string]string) {
+	if len(ni.PreauthHashAlgorithms) > 0 {
+		info["smb.HashAlg"] = joinNames(ni.PreauthHashAlgorithms, SMB2HashAlgorithmName)
+		info["smb.HashSaltLen"] = fmt.Sprintf("%d", ni.PreauthSaltLength)
+	}
+	if len(ni.Ciphers) > 0 {
+		info["smb.CipherAlg"] = joinNames(ni.Ciphers, SMB2CipherName)
+	}
+	if len(ni.CompressionAlgorithms) > 0 {
+		info["smb.CompressionFlags"] = fmt.Sprintf("0x%.4x", ni.CompressionFlags)
+		info["smb.CompressionAlg"] = joinNames(ni.CompressionAlgorithms, SMB2CompressionName)
+	}
+	if len(ni.SigningAlgorithms) > 0 {
+		info["smb.SigningAlg"] = joinNames(ni.SigningAlgorithms, SMB2SigningAlgorithmName)
+	}
+	if len(ni.RDMATransforms) > 0 {
+		info["smb.RDMATransforms"] = joinNames(ni.RDMATransforms, SMB2RDMATransformName)
+	}
+	if ni.TransportFlags != 0 {
+		info["smb.TransportFlags"] = fmt.Sprintf("0x%.8x", ni.TransportFlags)
+	}
+	if ni.NetName != "" {
+		info["smb.NetName"] = ni.NetName
+	}
+}
+
+// ParseSMB2SessionSetupReply decodes a SMB2 SESSION_SETUP response, including the security
+// blob of a successful or in-progress setup. An error is only returned if the header is
+// missing or truncated; a truncated body or security buffer is recorded in Warnings.
+func ParseSMB2SessionSetupReply(blob []byte) (*SessionSetupInfo, error) {
+	data, err := findSMB2(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 48 {
+		return nil, smbTruncated("session setup response", "header", 0, 48, len(data))
+	}
+
+	si := &SessionSetupInfo{
+		Status:    binary.LittleEndian.Uint32(data[8:]),
+		SessionID: binary.LittleEndian.Uint64(data[40:]),
+	}
+	if len(data) < smb2HeaderLength {
+		return si, nil
+	}
+	if sig := data[48:64]; !bytes.Equal(sig, make([]byte, 16)) {
+		si.Signature = append([]byte{}, sig...)
+	}
+
+	// Error responses carry an error body instead of a security buffer
+	if si.Status != SMBStatusSuccess && si.Status != SMBStatusMoreProcessingRequired {
+		return si, nil
+	}
+	if len(data) < smb2HeaderLength+8 {
+		si.Warnings = append(si.Warnings, smbTruncated("session setup response", "body", smb2HeaderLength, 8, len(data)).Error())
+		return si, nil
+	}
+	body := data[smb2HeaderLength:]
+	si.SessionFlags = binary.LittleEndian.Uint16(body[2:])
+	secOffset := int(binary.LittleEndian.Uint16(body[4:]))
+	secLength := int(binary.LittleEndian.Uint16(body[6:]))
+	if secLength == 0 {
+		return si, nil
+	}
+	if secOffset+secLength > len(data) {
+		si.Warnings = append(si.Warnings, smbTruncated("session setup response", "security buffer", secOffset, secLength, len(data)).Error())
+		return si, nil
+	}
+	si.SecurityBlob = append([]byte{}, data[secOffset:secOffset+secLength]...)
+	return si, nil
+}
+
+// Fields adds the session setup info to a map using the smb.* keys
+func (si *SessionSetupInfo) Fields(info map[string]string) {
+	info["smb.Status"] = fmt.Sprintf("0x%.8x", si.Status)
+	info["smb.SessionID"] = fmt.Sprintf("0x%.16x", si.SessionID)
+	if si.Signature != nil {
+		info["smb.Signature"] = hex.EncodeToString(si.Signature)
+	}
+}
+
+// SMBInfoMap returns the map of smb.* and ntlmssp.* fields produced by the older Extract
+// functions for any of the parsed replies that are not nil
+func SMBInfoMap(ni *NegotiateInfo, si *SessionSetupInfo, ci *NTLMChallengeInfo) map[string]string {
+	info := make(map[string]string)
+	if ni != nil {
+		ni.Fields(info)
+	}
+	if si != nil {
+		si.Fields(info)
+	}
+	if ci != nil {
+		ci.Fields(info)
+	}
+	return info
+}
+
+// readSecurityBuffer returns the value described by the length, maximum length, and 32-bit
+// offset of a security buffer descriptor at idx
+func readSecurityBuffer(message, field string, data []byte, idx int) ([]byte, error) {
+	if idx < 0 || idx > len(data)-8 {
+		return nil, smbTruncated(message, field+" descriptor", idx, 8, len(data))
+	}
+	length := int(binary.LittleEndian.Uint16(data[idx:]))
+	offset := int64(binary.LittleEndian.Uint32(data[idx+4:]))
+
+	// Allow zero length values
+	if length == 0 {
+		return []byte{}, nil
+	}
+	if offset+int64(length) > int64(len(data)) {
+		return nil, smbTruncated(message, field, int(offset), length, len(data))
+	}
+	return data[offset : offset+int64(length)], nil
+}
+
+// utf16LEBytes encodes a string as little-endian UTF-16
+func utf16LEBytes(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// utf16LEToString decodes a little-endian UTF-16 string, ignoring any odd trailing byte
+func utf16LEToString(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
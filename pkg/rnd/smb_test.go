@@ -0,0 +1,39 @@
+package rnd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzSMBExtractValueFromOffset checks that reading a security buffer never panics and that the
+// value, when found, lies within the blob
+func FuzzSMBExtractValueFromOffset(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte, idx int) {
+		val, next, err := SMBExtractValueFromOffset(data, idx)
+		if err != nil {
+			if len(val) != 0 || next != idx {
+				t.Fatalf("got %d bytes and index %d with error %v", len(val), next, err)
+			}
+			return
+		}
+		if next != idx+8 || len(val) > len(data) {
+			t.Fatalf("got %d bytes of %d and index %d from index %d", len(val), len(data), next, idx)
+		}
+	})
+}
+
+// TestSPNEGONTLMSSPNegotiateCopy checks that changing the returned token leaves the session
+// setup request it comes from untouched
+func TestSPNEGONTLMSSPNegotiateCopy(t *testing.T) {
+	want := bytes.Clone(SMB2SessionSetupNTLMSSP)
+	token := SPNEGONTLMSSPNegotiate()
+	for i := range token {
+		token[i] = 0
+	}
+	if !bytes.Equal(SMB2SessionSetupNTLMSSP, want) {
+		t.Error("SMB2SessionSetupNTLMSSP was modified through the returned token")
+	}
+	if !bytes.Equal(SPNEGONTLMSSPNegotiate(), want[4+smb2HeaderLength+24:]) {
+		t.Error("SPNEGONTLMSSPNegotiate did not return a fresh copy")
+	}
+}
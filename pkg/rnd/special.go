@@ -0,0 +1,206 @@
+package rnd
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// AddressClass is a category of special-purpose addresses
+type AddressClass string
+
+// Address classes, based on the IANA special-purpose address registries (RFC 6890 and successors)
+const (
+	ClassGlobal         AddressClass = "global"
+	ClassUnspecified    AddressClass = "unspecified"
+	ClassThisNetwork    AddressClass = "this-network"
+	ClassPrivate        AddressClass = "private"
+	ClassCGNAT          AddressClass = "cgnat"
+	ClassLoopback       AddressClass = "loopback"
+	ClassLinkLocal      AddressClass = "link-local"
+	ClassIETFProtocol   AddressClass = "ietf-protocol"
+	ClassDocumentation  AddressClass = "documentation"
+	ClassBenchmarking   AddressClass = "benchmarking"
+	ClassMulticast      AddressClass = "multicast"
+	ClassReserved       AddressClass = "reserved"
+	ClassBroadcast      AddressClass = "broadcast"
+	Class6to4           AddressClass = "6to4"
+	ClassTeredo         AddressClass = "teredo"
+	ClassNAT64          AddressClass = "nat64"
+	ClassUniqueLocal    AddressClass = "unique-local"
+	ClassDiscard        AddressClass = "discard"
+	ClassORCHID         AddressClass = "orchid"
+	ClassAMT            AddressClass = "amt"
+	ClassAS112          AddressClass = "as112"
+	ClassSegmentRouting AddressClass = "srv6"
+	ClassIPv4Mapped     AddressClass = "ipv4-mapped"
+)
+
+// AddressClasses lists every address class
+var AddressClasses = []AddressClass{
+	ClassGlobal, ClassUnspecified, ClassThisNetwork, ClassPrivate, ClassCGNAT, ClassLoopback,
+	ClassLinkLocal, ClassIETFProtocol, ClassDocumentation, ClassBenchmarking, ClassMulticast,
+	ClassReserved, ClassBroadcast, Class6to4, ClassTeredo, ClassNAT64, ClassUniqueLocal,
+	ClassDiscard, ClassORCHID, ClassAMT, ClassAS112, ClassSegmentRouting, ClassIPv4Mapped,
+}
+
+// SpecialPurposeBlock is an entry in the special-purpose address registries
+type SpecialPurposeBlock struct {
+	Prefix netip.Prefix
+	Class  AddressClass
+	Name   string
+	RFC    string
+}
+
+// SpecialPurposeBlocks are the special-purpose blocks used to classify addresses. The
+// IPv4-mapped block (::ffff:0:0/96) is not listed, since IPv4 addresses share its
+// representation in IPSet, and is recognized by ClassifyAddr instead.
+var SpecialPurposeBlocks = []SpecialPurposeBlock{
+	{netip.MustParsePrefix("0.0.0.0/8"), ClassThisNetwork, "This network", "RFC 791"},
+	{netip.MustParsePrefix("0.0.0.0/32"), ClassUnspecified, "This host on this network", "RFC 1122"},
+	{netip.MustParsePrefix("10.0.0.0/8"), ClassPrivate, "Private-Use", "RFC 1918"},
+	{netip.MustParsePrefix("100.64.0.0/10"), ClassCGNAT, "Shared Address Space", "RFC 6598"},
+	{netip.MustParsePrefix("127.0.0.0/8"), ClassLoopback, "Loopback", "RFC 1122"},
+	{netip.MustParsePrefix("169.254.0.0/16"), ClassLinkLocal, "Link Local", "RFC 3927"},
+	{netip.MustParsePrefix("172.16.0.0/12"), ClassPrivate, "Private-Use", "RFC 1918"},
+	{netip.MustParsePrefix("192.0.0.0/24"), ClassIETFProtocol, "IETF Protocol Assignments", "RFC 6890"},
+	{netip.MustParsePrefix("192.0.0.0/29"), ClassIETFProtocol, "IPv4 Service Continuity Prefix", "RFC 7335"},
+	{netip.MustParsePrefix("192.0.0.8/32"), ClassIETFProtocol, "IPv4 dummy address", "RFC 7600"},
+	{netip.MustParsePrefix("192.0.0.9/32"), ClassIETFProtocol, "Port Control Protocol Anycast", "RFC 7723"},
+	{netip.MustParsePrefix("192.0.0.10/32"), ClassIETFProtocol, "Traversal Using Relays around NAT Anycast", "RFC 8155"},
+	{netip.MustParsePrefix("192.0.0.170/32"), ClassNAT64, "NAT64/DNS64 Discovery", "RFC 8880"},
+	{netip.MustParsePrefix("192.0.0.171/32"), ClassNAT64, "NAT64/DNS64 Discovery", "RFC 8880"},
+	{netip.MustParsePrefix("192.0.2.0/24"), ClassDocumentation, "Documentation (TEST-NET-1)", "RFC 5737"},
+	{netip.MustParsePrefix("192.31.196.0/24"), ClassAS112, "AS112-v4", "RFC 7535"},
+	{netip.MustParsePrefix("192.52.193.0/24"), ClassAMT, "AMT", "RFC 7450"},
+	{netip.MustParsePrefix("192.88.99.0/24"), Class6to4, "Deprecated (6to4 Relay Anycast)", "RFC 7526"},
+	{netip.MustParsePrefix("192.168.0.0/16"), ClassPrivate, "Private-Use", "RFC 1918"},
+	{netip.MustParsePrefix("192.175.48.0/24"), ClassAS112, "Direct Delegation AS112 Service", "RFC 7534"},
+	{netip.MustParsePrefix("198.18.0.0/15"), ClassBenchmarking, "Benchmarking", "RFC 2544"},
+	{netip.MustParsePrefix("198.51.100.0/24"), ClassDocumentation, "Documentation (TEST-NET-2)", "RFC 5737"},
+	{netip.MustParsePrefix("203.0.113.0/24"), ClassDocumentation, "Documentation (TEST-NET-3)", "RFC 5737"},
+	{netip.MustParsePrefix("224.0.0.0/4"), ClassMulticast, "Multicast", "RFC 5771"},
+	{netip.MustParsePrefix("240.0.0.0/4"), ClassReserved, "Reserved", "RFC 1112"},
+	{netip.MustParsePrefix("255.255.255.255/32"), ClassBroadcast, "Limited Broadcast", "RFC 919"},
+
+	{netip.MustParsePrefix("::/128"), ClassUnspecified, "Unspecified Address", "RFC 4291"},
+	{netip.MustParsePrefix("::1/128"), ClassLoopback, "Loopback Address", "RFC 4291"},
+	{netip.MustParsePrefix("64:ff9b::/96"), ClassNAT64, "IPv4-IPv6 Translation", "RFC 6052"},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), ClassNAT64, "IPv4-IPv6 Translation (local use)", "RFC 8215"},
+	{netip.MustParsePrefix("100::/64"), ClassDiscard, "Discard-Only Address Block", "RFC 6666"},
+	{netip.MustParsePrefix("2001::/23"), ClassIETFProtocol, "IETF Protocol Assignments", "RFC 2928"},
+	{netip.MustParsePrefix("2001::/32"), ClassTeredo, "TEREDO", "RFC 4380"},
+	{netip.MustParsePrefix("2001:1::1/128"), ClassIETFProtocol, "Port Control Protocol Anycast", "RFC 7723"},
+	{netip.MustParsePrefix("2001:1::2/128"), ClassIETFProtocol, "Traversal Using Relays around NAT Anycast", "RFC 8155"},
+	{netip.MustParsePrefix("2001:2::/48"), ClassBenchmarking, "Benchmarking", "RFC 5180"},
+	{netip.MustParsePrefix("2001:3::/32"), ClassAMT, "AMT", "RFC 7450"},
+	{netip.MustParsePrefix("2001:4:112::/48"), ClassAS112, "AS112-v6", "RFC 7535"},
+	{netip.MustParsePrefix("2001:10::/28"), ClassORCHID, "Deprecated (previously ORCHID)", "RFC 4843"},
+	{netip.MustParsePrefix("2001:20::/28"), ClassORCHID, "ORCHIDv2", "RFC 7343"},
+	{netip.MustParsePrefix("2001:db8::/32"), ClassDocumentation, "Documentation", "RFC 3849"},
+	{netip.MustParsePrefix("2002::/16"), Class6to4, "6to4", "RFC 3056"},
+	{netip.MustParsePrefix("2620:4f:8000::/48"), ClassAS112, "Direct Delegation AS112 Service", "RFC 7534"},
+	{netip.MustParsePrefix("3fff::/20"), ClassDocumentation, "Documentation", "RFC 9637"},
+	{netip.MustParsePrefix("5f00::/16"), ClassSegmentRouting, "Segment Routing (SRv6) SIDs", "RFC 9602"},
+	{netip.MustParsePrefix("fc00::/7"), ClassUniqueLocal, "Unique-Local", "RFC 4193"},
+	{netip.MustParsePrefix("fe80::/10"), ClassLinkLocal, "Link-Local Unicast", "RFC 4291"},
+	{netip.MustParsePrefix("ff00::/8"), ClassMulticast, "Multicast", "RFC 4291"},
+}
+
+// ipv4MappedBlock describes addresses in the IPv4-mapped block, which ClassifyAddr handles separately
+var ipv4MappedBlock = SpecialPurposeBlock{netip.MustParsePrefix("::ffff:0:0/96"), ClassIPv4Mapped, "IPv4-mapped Address", "RFC 4291"}
+
+// LookupSpecialPurpose returns the most specific special-purpose block containing the address
+func LookupSpecialPurpose(addr netip.Addr) (SpecialPurposeBlock, bool) {
+	if addr.Is4In6() {
+		return ipv4MappedBlock, true
+	}
+	addr = addr.WithZone("")
+
+	var found SpecialPurposeBlock
+	ok := false
+	for _, block := range SpecialPurposeBlocks {
+		if block.Prefix.Contains(addr) && (!ok || block.Prefix.Bits() > found.Prefix.Bits()) {
+			found, ok = block, true
+		}
+	}
+	return found, ok
+}
+
+// ClassifyAddr returns the class of the most specific special-purpose block containing the
+// address, or ClassGlobal if it is not in any of them
+func ClassifyAddr(addr netip.Addr) AddressClass {
+	if block, ok := LookupSpecialPurpose(addr); ok {
+		return block.Class
+	}
+	return ClassGlobal
+}
+
+// ParseAddressClasses parses a comma-separated list of address class names
+func ParseAddressClasses(list string) ([]AddressClass, error) {
+	classes := []AddressClass{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		class, ok := lookupAddressClass(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown address class: %s", name)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// lookupAddressClass returns the class with the name
+func lookupAddressClass(name string) (AddressClass, bool) {
+	for _, class := range AddressClasses {
+		if string(class) == name {
+			return class, true
+		}
+	}
+	return "", false
+}
+
+// AddressClassSet returns the addresses that ClassifyAddr places in any of the classes. The
+// IPv4-mapped class has no members here, since IPSet treats those addresses as IPv4.
+func AddressClassSet(classes ...AddressClass) *IPSet {
+	b := &IPSetBuilder{}
+	for _, class := range classes {
+		b.AddSet(addressClassSet(class))
+	}
+	return b.IPSet()
+}
+
+// addressClassSet returns the addresses that ClassifyAddr places in a single class
+func addressClassSet(class AddressClass) *IPSet {
+	b := &IPSetBuilder{}
+	if class == ClassGlobal {
+		b.AddPrefix(netip.MustParsePrefix("::/0"))
+		for _, block := range SpecialPurposeBlocks {
+			b.RemovePrefix(block.Prefix)
+		}
+		return b.IPSet()
+	}
+
+	for _, block := range SpecialPurposeBlocks {
+		if block.Class == class {
+			b.AddPrefix(block.Prefix)
+		}
+	}
+
+	// Addresses in a more specific block of another class belong to that class instead
+	for _, block := range SpecialPurposeBlocks {
+		if block.Class == class {
+			continue
+		}
+		for _, outer := range SpecialPurposeBlocks {
+			if outer.Class == class && outer.Prefix.Bits() < block.Prefix.Bits() && outer.Prefix.Overlaps(block.Prefix) {
+				b.RemovePrefix(block.Prefix)
+				break
+			}
+		}
+	}
+	return b.IPSet()
+}
@@ -0,0 +1,137 @@
+package rnd
+
+import (
+	"math/big"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// TestClassifyAddr checks the class and block of addresses in nested and neighbouring blocks
+func TestClassifyAddr(t *testing.T) {
+	tests := []struct {
+		addr  string
+		class AddressClass
+		block string
+	}{
+		{"8.8.8.8", ClassGlobal, ""},
+		{"0.0.0.0", ClassUnspecified, "This host on this network"},
+		{"0.1.2.3", ClassThisNetwork, "This network"},
+		{"10.1.2.3", ClassPrivate, "Private-Use"},
+		{"172.31.255.255", ClassPrivate, "Private-Use"},
+		{"172.32.0.0", ClassGlobal, ""},
+		{"100.64.0.1", ClassCGNAT, "Shared Address Space"},
+		{"100.128.0.1", ClassGlobal, ""},
+		{"127.0.0.1", ClassLoopback, "Loopback"},
+		{"169.254.1.1", ClassLinkLocal, "Link Local"},
+		{"192.0.0.100", ClassIETFProtocol, "IETF Protocol Assignments"},
+		{"192.0.0.1", ClassIETFProtocol, "IPv4 Service Continuity Prefix"},
+		{"192.0.0.9", ClassIETFProtocol, "Port Control Protocol Anycast"},
+		{"192.0.0.170", ClassNAT64, "NAT64/DNS64 Discovery"},
+		{"192.0.2.1", ClassDocumentation, "Documentation (TEST-NET-1)"},
+		{"192.88.99.1", Class6to4, "Deprecated (6to4 Relay Anycast)"},
+		{"198.19.255.255", ClassBenchmarking, "Benchmarking"},
+		{"224.0.0.251", ClassMulticast, "Multicast"},
+		{"240.0.0.1", ClassReserved, "Reserved"},
+		{"255.255.255.254", ClassReserved, "Reserved"},
+		{"255.255.255.255", ClassBroadcast, "Limited Broadcast"},
+
+		{"::", ClassUnspecified, "Unspecified Address"},
+		{"::1", ClassLoopback, "Loopback Address"},
+		{"::2", ClassGlobal, ""},
+		{"::ffff:10.0.0.1", ClassIPv4Mapped, "IPv4-mapped Address"},
+		{"64:ff9b::192.0.2.1", ClassNAT64, "IPv4-IPv6 Translation"},
+		{"100::1", ClassDiscard, "Discard-Only Address Block"},
+		{"2001::1", ClassTeredo, "TEREDO"},
+		{"2001:1::1", ClassIETFProtocol, "Port Control Protocol Anycast"},
+		{"2001:1::3", ClassIETFProtocol, "IETF Protocol Assignments"},
+		{"2001:1ff::1", ClassIETFProtocol, "IETF Protocol Assignments"},
+		{"2001:200::1", ClassGlobal, ""},
+		{"2001:20::1", ClassORCHID, "ORCHIDv2"},
+		{"2001:db8::1", ClassDocumentation, "Documentation"},
+		{"2002:c000:201::1", Class6to4, "6to4"},
+		{"3fff:fff::1", ClassDocumentation, "Documentation"},
+		{"5f00::1", ClassSegmentRouting, "Segment Routing (SRv6) SIDs"},
+		{"fd00::1", ClassUniqueLocal, "Unique-Local"},
+		{"fe80::1%eth0", ClassLinkLocal, "Link-Local Unicast"},
+		{"ff02::1", ClassMulticast, "Multicast"},
+	}
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		if got := ClassifyAddr(addr); got != tt.class {
+			t.Errorf("%s: got class %s, want %s", tt.addr, got, tt.class)
+		}
+		block, ok := LookupSpecialPurpose(addr)
+		if ok != (tt.block != "") || block.Name != tt.block {
+			t.Errorf("%s: got block %q, want %q", tt.addr, block.Name, tt.block)
+		}
+	}
+}
+
+// TestAddressClassSet checks that the sets for each class agree with ClassifyAddr at the edges
+// of every block, and that together they cover the address space exactly once
+func TestAddressClassSet(t *testing.T) {
+	var addrs []netip.Addr
+	for _, block := range SpecialPurposeBlocks {
+		first := block.Prefix.Masked().Addr()
+		last := prefixRange(block.Prefix).last.addr()
+		addrs = append(addrs, first, last)
+		if prev := first.Prev(); prev.IsValid() {
+			addrs = append(addrs, prev)
+		}
+		if next := last.Next(); next.IsValid() {
+			addrs = append(addrs, next)
+		}
+	}
+
+	total := new(big.Int)
+	for _, class := range AddressClasses {
+		set := AddressClassSet(class)
+		if class == ClassIPv4Mapped {
+			if !set.IsEmpty() {
+				t.Errorf("got %s for the IPv4-mapped class", set)
+			}
+			continue
+		}
+		total.Add(total, set.Count())
+
+		for _, addr := range addrs {
+			if set.Contains(addr) != (ClassifyAddr(addr) == class) {
+				t.Errorf("%s: in the %s set is %v, classified as %s", addr, class, set.Contains(addr), ClassifyAddr(addr))
+			}
+		}
+	}
+
+	want := new(big.Int).Lsh(big.NewInt(1), 128)
+	if total.Cmp(want) != 0 {
+		t.Errorf("classes cover %s addresses, want %s", total, want)
+	}
+
+	combined := AddressClassSet(ClassPrivate, ClassLoopback)
+	if !combined.Equal(AddressClassSet(ClassPrivate).Union(AddressClassSet(ClassLoopback))) {
+		t.Errorf("got %s for private and loopback", combined)
+	}
+}
+
+// TestParseAddressClasses checks that class lists ignore case, spacing, and empty entries
+func TestParseAddressClasses(t *testing.T) {
+	classes, err := ParseAddressClasses(" Private,cgnat,, LOOPBACK ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []AddressClass{ClassPrivate, ClassCGNAT, ClassLoopback}; !slices.Equal(classes, want) {
+		t.Errorf("got %v, want %v", classes, want)
+	}
+
+	if classes, err := ParseAddressClasses(""); err != nil || len(classes) != 0 {
+		t.Errorf("empty list: got %v, %v", classes, err)
+	}
+	if _, err := ParseAddressClasses("private,bogus"); err == nil {
+		t.Errorf("expected an error for an unknown class")
+	}
+	for _, class := range AddressClasses {
+		if parsed, err := ParseAddressClasses(string(class)); err != nil || parsed[0] != class {
+			t.Errorf("%s: got %v, %v", class, parsed, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package rnd
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// ErrNoSPNEGO is returned when a security blob is not a SPNEGO NegTokenInit
+var ErrNoSPNEGO = errors.New("no SPNEGO token found")
+
+// spnegoOID identifies the SPNEGO mechanism in the GSS-API framing of a NegTokenInit
+var spnegoOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+
+// Security mechanism OIDs found in SPNEGO mechTypes lists
+var (
+	OIDKerberos5      = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	OIDMSKerberos5    = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+	OIDKerberos5User2 = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2, 3}
+	OIDIAKerb         = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 5}
+	OIDNTLMSSP        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+	OIDNegoEx         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 30}
+)
+
+// spnegoMechanisms names the known security mechanisms
+var spnegoMechanisms = []struct {
+	oid      asn1.ObjectIdentifier
+	name     string
+	kerberos bool
+}{
+	{OIDKerberos5, "krb5", true},
+	{OIDMSKerberos5, "ms-krb5", true},
+	{OIDKerberos5User2, "krb5-u2u", true},
+	{OIDIAKerb, "iakerb", true},
+	{OIDNTLMSSP, "ntlmssp", false},
+	{OIDNegoEx, "negoex", false},
+}
+
+// SPNEGOMechanismName returns the name of a security mechanism, or its dotted OID if unknown
+func SPNEGOMechanismName(oid asn1.ObjectIdentifier) string {
+	for _, m := range spnegoMechanisms {
+		if m.oid.Equal(oid) {
+			return m.name
+		}
+	}
+	return oid.String()
+}
+
+// SPNEGOIsKerberos returns true if a security mechanism is one of the Kerberos variants
+func SPNEGOIsKerberos(oid asn1.ObjectIdentifier) bool {
+	for _, m := range spnegoMechanisms {
+		if m.oid.Equal(oid) {
+			return m.kerberos
+		}
+	}
+	return false
+}
+
+// ParseSPNEGOMechTypes returns the mechTypes list of a SPNEGO NegTokenInit, such as the
+// security buffer of a SMB2 NEGOTIATE response or a HTTP Negotiate challenge
+func ParseSPNEGOMechTypes(blob []byte) ([]asn1.ObjectIdentifier, error) {
+	// InitialContextToken ::= [APPLICATION 0] IMPLICIT SEQUENCE { thisMech, innerContextToken }
+	var app asn1.RawValue
+	if _, err := asn1.Unmarshal(blob, &app); err != nil {
+		return nil, fmt.Errorf("SPNEGO token: %w", err)
+	}
+	if app.Class != asn1.ClassApplication || app.Tag != 0 {
+		return nil, ErrNoSPNEGO
+	}
+
+	var mech asn1.ObjectIdentifier
+	rest, err := asn1.Unmarshal(app.Bytes, &mech)
+	if err != nil {
+		return nil, fmt.Errorf("SPNEGO mechanism: %w", err)
+	}
+	if !mech.Equal(spnegoOID) {
+		return nil, ErrNoSPNEGO
+	}
+
+	// NegotiationToken ::= CHOICE { negTokenInit [0] NegTokenInit, ... }
+	var choice asn1.RawValue
+	if _, err := asn1.Unmarshal(rest, &choice); err != nil {
+		return nil, fmt.Errorf("SPNEGO negotiation token: %w", err)
+	}
+	if choice.Class != asn1.ClassContextSpecific || choice.Tag != 0 {
+		return nil, ErrNoSPNEGO
+	}
+
+	var init asn1.RawValue
+	if _, err := asn1.Unmarshal(choice.Bytes, &init); err != nil {
+		return nil, fmt.Errorf("SPNEGO NegTokenInit: %w", err)
+	}
+
+	// NegTokenInit ::= SEQUENCE { mechTypes [0] MechTypeList, ... }
+	fields := init.Bytes
+	for len(fields) > 0 {
+		var field asn1.RawValue
+		fields, err = asn1.Unmarshal(fields, &field)
+		if err != nil {
+			return nil, fmt.Errorf("SPNEGO NegTokenInit: %w", err)
+		}
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 0 {
+			continue
+		}
+
+		var mechTypes []asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(field.Bytes, &mechTypes); err != nil {
+			return nil, fmt.Errorf("SPNEGO mechTypes: %w", err)
+		}
+		return mechTypes, nil
+	}
+	return nil, nil
+}
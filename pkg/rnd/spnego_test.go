@@ -0,0 +1,16 @@
+package rnd
+
+import "testing"
+
+// FuzzParseSPNEGOMechTypes checks that the SPNEGO parser never panics
+func FuzzParseSPNEGOMechTypes(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mechs, err := ParseSPNEGOMechTypes(data)
+		if err != nil && mechs != nil {
+			t.Fatalf("got mechanisms %v with error %v", mechs, err)
+		}
+		for _, oid := range mechs {
+			SPNEGOMechanismName(oid)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package rnd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"iter"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// TargetSet is a set of addresses built from CIDRs, address ranges, and hostnames, less any
+// excluded addresses. Overlapping inputs are merged, so each address is counted and visited once.
+// Exclusions apply to every target, whether it was added before or after them.
+type TargetSet struct {
+	// LookupIP resolves hostnames (nil for net.LookupIP)
+	LookupIP func(host string) ([]net.IP, error)
+
+	include  IPSetBuilder
+	exclude  IPSetBuilder
+	restrict []*IPSet
+	set      *IPSet
+	offsets  []uint128
+	resolved map[string][]net.IP
+}
+
+// NewTargetSet returns an empty target set
+func NewTargetSet() *TargetSet {
+	return &TargetSet{resolved: make(map[string][]net.IP)}
+}
+
+// Add includes the addresses of a target specification, which may be a CIDR, a bare address,
+// a dash range (10.0.0.5-10.0.0.90 or 10.0.0.5-90), or a hostname, which is resolved once.
+func (t *TargetSet) Add(spec string) error {
+	ranges, err := t.parseSpec(spec)
+	if err != nil {
+		return err
+	}
+	t.include.add(ranges...)
+	t.set = nil
+	return nil
+}
+
+// Exclude removes the addresses of a target specification from the set
+func (t *TargetSet) Exclude(spec string) error {
+	ranges, err := t.parseSpec(spec)
+	if err != nil {
+		return err
+	}
+	t.exclude.add(ranges...)
+	t.set = nil
+	return nil
+}
+
+// ExcludeSet removes the addresses in an IP set from the set, such as an AddressClassSet
+func (t *TargetSet) ExcludeSet(s *IPSet) {
+	t.exclude.AddSet(s)
+	t.set = nil
+}
+
+// RestrictSet limits the set to addresses that are also in an IP set
+func (t *TargetSet) RestrictSet(s *IPSet) {
+	t.restrict = append(t.restrict, s)
+	t.set = nil
+}
+
+// AddFile includes every target specification in a file
+func (t *TargetSet) AddFile(path string) error {
+	specs, err := ReadTargetFile(path)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if err := t.Add(spec); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// ExcludeFile removes every target specification in a file from the set
+func (t *TargetSet) ExcludeFile(path string) error {
+	specs, err := ReadTargetFile(path)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if err := t.Exclude(spec); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// ReadTargetFile returns the target specifications in a file. Specifications are separated
+// by lines, commas, or spaces, and anything following a # on a line is ignored.
+func ReadTargetFile(path string) ([]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	specs := []string{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		specs = append(specs, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})...)
+	}
+	return specs, scanner.Err()
+}
+
+// IPSet returns the addresses in the set
+func (t *TargetSet) IPSet() *IPSet {
+	t.normalize()
+	return t.set
+}
+
+// Count returns the exact number of addresses in the set
+func (t *TargetSet) Count() *big.Int {
+	return t.IPSet().Count()
+}
+
+// Contains returns true if the address is in the set
+func (t *TargetSet) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && t.ContainsAddr(addr)
+}
+
+// ContainsAddr returns true if the address is in the set
+func (t *TargetSet) ContainsAddr(addr netip.Addr) bool {
+	return t.IPSet().Contains(addr)
+}
+
+// Resolved returns the addresses found for each hostname added to or excluded from the set
+func (t *TargetSet) Resolved() map[string][]net.IP {
+	resolved := make(map[string][]net.IP, len(t.resolved))
+	for name, ips := range t.resolved {
+		resolved[name] = append([]net.IP{}, ips...)
+	}
+	return resolved
+}
+
+// Addrs returns every address in the set in random order, or a random sample of them if the
+// options call for one. Options apply to the set as a whole rather than to each input, and the
+// same seed produces the same order for the same set. Iteration stops early if the context is
+// cancelled. The set must not be changed while the sequence is in use.
+func (t *TargetSet) Addrs(ctx context.Context, opts CIDROptions) (iter.Seq[netip.Addr], error) {
+	shard, shards, err := opts.shard()
+	if err != nil {
+		return nil, err
+	}
+
+	t.normalize()
+	if t.set.IsEmpty() {
+		return func(func(netip.Addr) bool) {}, nil
+	}
+
+	maxAddresses := opts.MaxAddresses
+	if maxAddresses == 0 {
+		maxAddresses = DefaultMaxAddresses
+	}
+
+	// Sets too large to permute can only be sampled
+	maxIndex := t.maxIndex()
+	if maxIndex.hi != 0 || maxIndex.lo >= MaxPermutationSize {
+		if opts.SampleSize == 0 {
+			return nil, fmt.Errorf("target set too large: %s addresses", t.Count())
+		}
+		indexes, err := sampleRange(opts, maxIndex, shardCount(opts.SampleSize, shard, shards))
+		if err != nil {
+			return nil, err
+		}
+		return mapOffsets(ctx, indexes, t.address), nil
+	}
+
+	size := maxIndex.lo + 1
+	count := uint64(0)
+	if opts.SampleSize > 0 && size > opts.SampleSize {
+		count = shardCount(opts.SampleSize, shard, shards)
+	} else if size > maxAddresses {
+		return nil, fmt.Errorf("target set too large: %d addresses (limit %d)", size, maxAddresses)
+	}
+
+	indexes, err := walkRange(opts, size, count)
+	if err != nil {
+		return nil, err
+	}
+	return mapOffsets(ctx, indexes, t.address), nil
+}
+
+// Addresses writes the addresses returned by Addrs to a channel until quit is closed
+func (t *TargetSet) Addresses(opts CIDROptions, out chan string, quit chan int) error {
+	addrs, err := t.Addrs(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	sendAddrs(addrs, out, quit)
+	return nil
+}
+
+// normalize removes the excluded addresses from the included ones, applies any restrictions, and indexes the result
+func (t *TargetSet) normalize() {
+	if t.set != nil {
+		return
+	}
+
+	t.set = t.include.IPSet().Subtract(t.exclude.IPSet())
+	for _, s := range t.restrict {
+		t.set = t.set.Intersect(s)
+	}
+	t.offsets = make([]uint128, len(t.set.ranges))
+	next := uint128{}
+	for i, r := range t.set.ranges {
+		t.offsets[i] = next
+		next = next.add(r.last.sub(r.first)).add64(1)
+	}
+}
+
+// maxIndex returns the index of the last address in the normalized set, which must not be empty
+func (t *TargetSet) maxIndex() uint128 {
+	last := len(t.set.ranges) - 1
+	return t.offsets[last].add(t.set.ranges[last].last.sub(t.set.ranges[last].first))
+}
+
+// address returns the address at an index into the normalized set
+func (t *TargetSet) address(idx uint128) uint128 {
+	i := sort.Search(len(t.offsets), func(i int) bool {
+		return t.offsets[i].cmp(idx) > 0
+	}) - 1
+	return t.set.ranges[i].first.add(idx.sub(t.offsets[i]))
+}
+
+// parseSpec converts a target specification to address ranges
+func (t *TargetSet) parseSpec(spec string) ([]addrRange, error) {
+	r, ok, err := parseRangeSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return []addrRange{r}, nil
+	}
+
+	spec = strings.TrimSpace(spec)
+	name := strings.TrimSuffix(spec, ".")
+	if !MatchHostname.MatchString(name) {
+		return nil, fmt.Errorf("invalid target: %s", spec)
+	}
+
+	ips, err := t.resolve(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %s: %s", spec, err)
+	}
+	ranges := []addrRange{}
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			v := uint128FromAddr(addr)
+			ranges = append(ranges, addrRange{first: v, last: v})
+		}
+	}
+	return ranges, nil
+}
+
+// resolve looks up a hostname, reusing the result if it was already resolved
+func (t *TargetSet) resolve(name string) ([]net.IP, error) {
+	key := strings.ToLower(name)
+	if ips, ok := t.resolved[key]; ok {
+		return ips, nil
+	}
+
+	lookup := t.LookupIP
+	if lookup == nil {
+		lookup = net.LookupIP
+	}
+	ips, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found")
+	}
+
+	if t.resolved == nil {
+		t.resolved = make(map[string][]net.IP)
+	}
+	t.resolved[key] = ips
+	return ips, nil
+}
@@ -0,0 +1,315 @@
+package rnd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// collectTargets returns every address produced by the target set for the options
+func collectTargets(t *testing.T, ts *TargetSet, opts CIDROptions) []netip.Addr {
+	t.Helper()
+	addrs, err := ts.Addrs(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []netip.Addr
+	for addr := range addrs {
+		out = append(out, addr)
+	}
+	return out
+}
+
+// TestTargetSet checks the addresses and exact count of sets built from each kind of specification
+func TestTargetSet(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		switch strings.ToLower(host) {
+		case "host.example":
+			return []net.IP{net.ParseIP("10.0.0.200"), net.ParseIP("2001:db8::1")}, nil
+		case "inside.example":
+			return []net.IP{net.ParseIP("10.0.0.10")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	tests := []struct {
+		name     string
+		add      []string
+		exclude  []string
+		ranges   string
+		count    string
+		resolved int
+	}{
+		{"address", []string{"10.0.0.1"}, nil, "10.0.0.1", "1", 0},
+		{"cidr", []string{"10.0.0.0/30"}, nil, "10.0.0.0-10.0.0.3", "4", 0},
+		{"short dash range", []string{"10.0.0.5-90"}, nil, "10.0.0.5-10.0.0.90", "86", 0},
+		{"full dash range", []string{"10.0.0.250-10.0.1.5"}, nil, "10.0.0.250-10.0.1.5", "12", 0},
+		{"overlapping", []string{"10.0.0.5-90", "10.0.0.64/26"}, nil, "10.0.0.5-10.0.0.127", "123", 0},
+		{"excluded middle", []string{"10.0.0.5-90"}, []string{"10.0.0.10-19"}, "10.0.0.5-10.0.0.9,10.0.0.20-10.0.0.90", "76", 0},
+		{"excluded all", []string{"10.0.0.5-90"}, []string{"10.0.0.0/24"}, "", "0", 0},
+		{"hostname", []string{"host.example."}, nil, "10.0.0.200,2001:db8::1", "2", 1},
+		{"hostname repeated", []string{"host.example", "HOST.example"}, nil, "10.0.0.200,2001:db8::1", "2", 1},
+		{"excluded hostname", []string{"10.0.0.5-90"}, []string{"inside.example"}, "10.0.0.5-10.0.0.9,10.0.0.11-10.0.0.90", "85", 1},
+		{"ipv6", []string{"2001:db8::/64"}, []string{"2001:db8::/65"}, "2001:db8:0:0:8000::-2001:db8::ffff:ffff:ffff:ffff", "9223372036854775808", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewTargetSet()
+			ts.LookupIP = lookup
+			for _, spec := range tt.add {
+				if err := ts.Add(spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, spec := range tt.exclude {
+				if err := ts.Exclude(spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var ranges []string
+			for _, r := range ts.IPSet().Ranges() {
+				ranges = append(ranges, r.String())
+			}
+			if got := strings.Join(ranges, ","); got != tt.ranges {
+				t.Errorf("got ranges %s, want %s", got, tt.ranges)
+			}
+			if got := ts.Count().String(); got != tt.count {
+				t.Errorf("got count %s, want %s", got, tt.count)
+			}
+			if got := len(ts.Resolved()); got != tt.resolved {
+				t.Errorf("got %d resolved names, want %d", got, tt.resolved)
+			}
+		})
+	}
+}
+
+// TestTargetSetInvalid checks the errors for specifications that are neither addresses nor hostnames
+func TestTargetSetInvalid(t *testing.T) {
+	ts := NewTargetSet()
+	ts.LookupIP = func(host string) ([]net.IP, error) {
+		if host == "empty.example" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	for _, spec := range []string{"10.0.0.90-5", "10.0.0.0/33", "10.0.0.1-2001:db8::1", "not a host", "missing.example", "empty.example"} {
+		if err := ts.Add(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+	if !ts.IPSet().IsEmpty() {
+		t.Errorf("got %s after invalid specifications", ts.IPSet())
+	}
+}
+
+// TestTargetSetExcludeOrder checks that exclusions apply to targets added before and after them,
+// including after the set has been enumerated
+func TestTargetSetExcludeOrder(t *testing.T) {
+	before := NewTargetSet()
+	if err := before.Exclude("10.0.0.16/28"); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Add("10.0.0.0/26"); err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewTargetSet()
+	if err := after.Add("10.0.0.0/26"); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.Count().String(); got != "64" {
+		t.Fatalf("got count %s before excluding, want 64", got)
+	}
+	if err := after.Exclude("10.0.0.16/28"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ts := range []*TargetSet{before, after} {
+		if got := ts.Count().String(); got != "48" {
+			t.Errorf("got count %s, want 48", got)
+		}
+		if ts.Contains(net.ParseIP("10.0.0.20")) || !ts.Contains(net.ParseIP("10.0.0.40")) {
+			t.Errorf("exclusion not applied to %s", ts.IPSet())
+		}
+	}
+	if !before.IPSet().Equal(after.IPSet()) {
+		t.Errorf("got %s and %s", before.IPSet(), after.IPSet())
+	}
+
+	// Targets added after the exclusion are also excluded
+	if err := after.Add("10.0.0.16"); err != nil {
+		t.Fatal(err)
+	}
+	if after.Count().String() != "48" {
+		t.Errorf("re-added excluded address, got %s", after.IPSet())
+	}
+}
+
+// TestTargetSetAddrs checks that each address is visited once, in an order fixed by the seed,
+// and that the limits and samples apply to the whole set
+func TestTargetSetAddrs(t *testing.T) {
+	ts := NewTargetSet()
+	for _, spec := range []string{"10.0.0.5-90", "192.0.2.0/28", "2001:db8::/124"} {
+		if err := ts.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Exclude("10.0.0.50-59"); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := collectTargets(t, ts, CIDROptions{Seed: 1})
+	if len(addrs) != 76+16+16 {
+		t.Fatalf("got %d addresses, want %d", len(addrs), 76+16+16)
+	}
+	seen := make(map[netip.Addr]bool)
+	for _, addr := range addrs {
+		if seen[addr] || !ts.ContainsAddr(addr) {
+			t.Fatalf("address %s repeated or outside the set", addr)
+		}
+		seen[addr] = true
+	}
+	if again := collectTargets(t, ts, CIDROptions{Seed: 1}); !slices.Equal(addrs, again) {
+		t.Errorf("the same seed produced a different order")
+	}
+
+	sample := collectTargets(t, ts, CIDROptions{Seed: 1, SampleSize: 10})
+	if len(sample) != 10 {
+		t.Errorf("got %d sampled addresses, want 10", len(sample))
+	}
+
+	if _, err := ts.Addrs(context.Background(), CIDROptions{MaxAddresses: 100}); err == nil {
+		t.Errorf("expected an error for %d addresses with a limit of 100", len(addrs))
+	}
+	if got := collectTargets(t, ts, CIDROptions{MaxAddresses: 108}); len(got) != 108 {
+		t.Errorf("got %d addresses at the limit, want 108", len(got))
+	}
+}
+
+// TestTargetSetSampleLarge checks that sets too large to permute are sampled without repeats
+// and never include excluded addresses
+func TestTargetSetSampleLarge(t *testing.T) {
+	ts := NewTargetSet()
+	for _, spec := range []string{"10.0.0.0/8", "2000::/3"} {
+		if err := ts.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Exclude("2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.Addrs(context.Background(), CIDROptions{Seed: 1}); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("got error %v without a sample size", err)
+	}
+
+	excluded := netip.MustParsePrefix("2001:db8::/32")
+	sample := collectTargets(t, ts, CIDROptions{Seed: 1, SampleSize: 1000})
+	if len(sample) != 1000 {
+		t.Fatalf("got %d sampled addresses, want 1000", len(sample))
+	}
+	seen := make(map[netip.Addr]bool)
+	for _, addr := range sample {
+		if seen[addr] || !ts.ContainsAddr(addr) || excluded.Contains(addr) {
+			t.Fatalf("sampled address %s repeated or outside the set", addr)
+		}
+		seen[addr] = true
+	}
+
+	// Sharding splits the sample between scanners
+	first := collectTargets(t, ts, CIDROptions{Seed: 1, SampleSize: 1000, Shard: 0, Shards: 2})
+	second := collectTargets(t, ts, CIDROptions{Seed: 1, SampleSize: 1000, Shard: 1, Shards: 2})
+	if len(first)+len(second) != 1000 {
+		t.Errorf("got %d and %d addresses in the shards, want 1000 in total", len(first), len(second))
+	}
+	for _, addr := range first {
+		if slices.Contains(second, addr) {
+			t.Errorf("address %s in both shards", addr)
+		}
+	}
+}
+
+// TestTargetSetOffsets checks the mapping from indexes to addresses across ranges whose offsets
+// carry into the high 64 bits
+func TestTargetSetOffsets(t *testing.T) {
+	ts := NewTargetSet()
+	for _, spec := range []string{"10.0.0.0/30", "2001:db8::/64", "2001:db9::/127"} {
+		if err := ts.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.normalize()
+
+	want := []uint128{{0, 0}, {0, 4}, {1, 4}}
+	if !slices.Equal(ts.offsets, want) {
+		t.Fatalf("got offsets %v, want %v", ts.offsets, want)
+	}
+	if got := ts.maxIndex(); got != (uint128{1, 5}) {
+		t.Fatalf("got max index %v, want {1 5}", got)
+	}
+
+	tests := []struct {
+		idx  uint128
+		addr string
+	}{
+		{uint128{0, 0}, "10.0.0.0"},
+		{uint128{0, 3}, "10.0.0.3"},
+		{uint128{0, 4}, "2001:db8::"},
+		{uint128{0, 5}, "2001:db8::1"},
+		{uint128{0, 1<<64 - 1}, "2001:db8::ffff:ffff:ffff:fffb"},
+		{uint128{1, 3}, "2001:db8::ffff:ffff:ffff:ffff"},
+		{uint128{1, 4}, "2001:db9::"},
+		{uint128{1, 5}, "2001:db9::1"},
+	}
+	for _, tt := range tests {
+		if got := ts.address(tt.idx).addr(); got != netip.MustParseAddr(tt.addr) {
+			t.Errorf("index %v: got %s, want %s", tt.idx, got, tt.addr)
+		}
+	}
+}
+
+// TestReadTargetFile checks the separators and comments accepted in target files
+func TestReadTargetFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.txt")
+	data := "# scan targets\r\n10.0.0.1\r\n10.0.0.5-90, 192.0.2.0/28\t2001:db8::1 # lab\n\n,,host.example\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	specs, err := ReadTargetFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1", "10.0.0.5-90", "192.0.2.0/28", "2001:db8::1", "host.example"}
+	if !slices.Equal(specs, want) {
+		t.Errorf("got %q, want %q", specs, want)
+	}
+
+	ts := NewTargetSet()
+	ts.LookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("198.51.100.7")}, nil
+	}
+	if err := ts.AddFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.Count().String(); got != "105" {
+		t.Errorf("got count %s, want 105", got)
+	}
+	if err := ts.ExcludeFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.IPSet().IsEmpty() {
+		t.Errorf("got %s after excluding the same file", ts.IPSet())
+	}
+
+	if _, err := ReadTargetFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
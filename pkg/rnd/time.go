@@ -47,3 +47,16 @@ func BytesToTimestamp(b []byte) time.Time {
 	}
 	return time.Unix(nsec/1000000000, nsec%1000000000)
 }
+
+// filetimeEpochOffset is the number of seconds from 1601-01-01 (the FILETIME epoch) to 1970-01-01
+const filetimeEpochOffset = 11644473600
+
+// FiletimeToTime converts a Windows FILETIME (100ns intervals since 1601) to a timestamp
+func FiletimeToTime(ft uint64) time.Time {
+	return time.Unix(int64(ft/10000000)-filetimeEpochOffset, int64(ft%10000000)*100).UTC()
+}
+
+// TimeToFiletime converts a timestamp to a Windows FILETIME (100ns intervals since 1601)
+func TimeToFiletime(t time.Time) uint64 {
+	return uint64(t.Unix()+filetimeEpochOffset)*10000000 + uint64(t.Nanosecond()/100)
+}
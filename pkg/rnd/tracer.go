@@ -0,0 +1,176 @@
+package rnd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//
+// Tracers are embedded in DNS names to carry the probe target and send time through
+// a resolver and back to runzero-dns. The encoded form is a 4-byte XOR key followed
+// by the payload XOR'd with that key, written as hex and split across labels:
+//
+//   legacy: [key:4] [ip:16] [timestamp:8]
+//   v1:     [key:4] [version:1] [probe:1] [ip:16] [timestamp:8] [scan:4] [sequence:4]
+//
+// Legacy tracers are always exactly 28 bytes, which the versioned formats never are.
+// Decoders ignore any trailing bytes after the fields of a known version, so future
+// versions can extend the layout without breaking older servers.
+//
+
+// TracerVersionLegacy identifies the original unversioned 28-byte tracer layout
+const TracerVersionLegacy uint8 = 0
+
+// TracerVersion1 identifies the first versioned tracer layout
+const TracerVersion1 uint8 = 1
+
+// TracerVersionCurrent is the version used when encoding new tracers
+const TracerVersionCurrent = TracerVersion1
+
+// Probe types carried in versioned tracers
+const (
+	TracerProbeUnknown  uint8 = 0
+	TracerProbeReferral uint8 = 1
+	TracerProbeReflect  uint8 = 2
+	TracerProbeSubnet   uint8 = 3
+)
+
+// TracerLabelMaxLength is the maximum number of hex characters placed in a single label
+const TracerLabelMaxLength = 56
+
+const (
+	tracerKeyLength    = 4
+	tracerLegacyLength = tracerKeyLength + 16 + 8
+	tracerV1Length     = tracerKeyLength + 1 + 1 + 16 + 8 + 4 + 4
+)
+
+// Tracer holds the fields carried by an encoded tracer
+type Tracer struct {
+	Version   uint8
+	Key       uint32
+	ProbeType uint8
+	IP        net.IP
+	Timestamp time.Time
+	ScanID    uint32
+	Sequence  uint32
+}
+
+// MarshalBinary encodes the tracer using its version, XOR'ing the payload with its key
+func (t *Tracer) MarshalBinary() ([]byte, error) {
+	ip := t.IP.To16()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid tracer address: %v", t.IP)
+	}
+
+	var raw []byte
+	switch t.Version {
+	case TracerVersionLegacy:
+		raw = make([]byte, tracerLegacyLength)
+		copy(raw[4:20], ip)
+		copy(raw[20:28], TimestampToBytes(t.Timestamp))
+
+	case TracerVersion1:
+		raw = make([]byte, tracerV1Length)
+		raw[4] = t.Version
+		raw[5] = t.ProbeType
+		copy(raw[6:22], ip)
+		copy(raw[22:30], TimestampToBytes(t.Timestamp))
+		binary.BigEndian.PutUint32(raw[30:34], t.ScanID)
+		binary.BigEndian.PutUint32(raw[34:38], t.Sequence)
+
+	default:
+		return nil, fmt.Errorf("unsupported tracer version %d", t.Version)
+	}
+
+	binary.BigEndian.PutUint32(raw[0:4], t.Key)
+	copy(raw[4:], XorBytesWithBytes(raw[4:], raw[0:4]))
+	return raw, nil
+}
+
+// UnmarshalBinary decodes an encoded tracer of any supported version
+func (t *Tracer) UnmarshalBinary(raw []byte) error {
+	if len(raw) < tracerKeyLength+1 {
+		return fmt.Errorf("tracer truncated (%d)", len(raw))
+	}
+
+	key := raw[0:tracerKeyLength]
+	decoded := XorBytesWithBytes(raw[tracerKeyLength:], key)
+
+	// [XXXX] [AAAABBBBCCCCDDDD] [YYYYZZZZ]
+	if len(raw) == tracerLegacyLength {
+		*t = Tracer{
+			Version:   TracerVersionLegacy,
+			Key:       binary.BigEndian.Uint32(key),
+			IP:        net.IP(decoded[0:16]),
+			Timestamp: BytesToTimestamp(decoded[16:24]),
+		}
+		return nil
+	}
+
+	switch decoded[0] {
+	case TracerVersion1:
+		if len(raw) < tracerV1Length {
+			return fmt.Errorf("tracer v%d truncated (%d)", decoded[0], len(raw))
+		}
+		*t = Tracer{
+			Version:   decoded[0],
+			Key:       binary.BigEndian.Uint32(key),
+			ProbeType: decoded[1],
+			IP:        net.IP(decoded[2:18]),
+			Timestamp: BytesToTimestamp(decoded[18:26]),
+			ScanID:    binary.BigEndian.Uint32(decoded[26:30]),
+			Sequence:  binary.BigEndian.Uint32(decoded[30:34]),
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported tracer version %d", decoded[0])
+}
+
+// EncodeTracerName returns <tag><hex>[.<hex>...].<domain> for the tracer, splitting long payloads across labels
+func EncodeTracerName(tag string, t *Tracer, domain string) (string, error) {
+	raw, err := t.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	encoded := hex.EncodeToString(raw)
+	labels := []string{}
+	for len(encoded) > TracerLabelMaxLength {
+		labels = append(labels, encoded[:TracerLabelMaxLength])
+		encoded = encoded[TracerLabelMaxLength:]
+	}
+	labels = append(labels, encoded)
+
+	return tag + strings.Join(labels, ".") + "." + EnsureTrailingDot(domain), nil
+}
+
+// DecodeTracerName parses a name created by EncodeTracerName, returning the tag and the decoded tracer
+func DecodeTracerName(name string, domain string) (string, *Tracer, error) {
+	name = strings.ToLower(EnsureTrailingDot(name))
+	suffix := "." + strings.ToLower(EnsureTrailingDot(domain))
+	if !strings.HasSuffix(name, suffix) {
+		return "", nil, fmt.Errorf("tracer name is not within %s", domain)
+	}
+
+	name = strings.TrimSuffix(name, suffix)
+	if len(name) < 2 {
+		return "", nil, fmt.Errorf("tracer name is too short (%d)", len(name))
+	}
+
+	tag := name[0:2]
+	raw, err := hex.DecodeString(strings.Replace(name[2:], ".", "", -1))
+	if err != nil {
+		return tag, nil, fmt.Errorf("invalid tracer encoding (%s)", err)
+	}
+
+	t := &Tracer{}
+	if err := t.UnmarshalBinary(raw); err != nil {
+		return tag, nil, err
+	}
+	return tag, t, nil
+}
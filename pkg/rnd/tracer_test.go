@@ -0,0 +1,151 @@
+package rnd
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTracerNameRoundTrip checks that each tracer version decodes to the fields it was encoded
+// from, and that the encoded name has the expected length and label split
+func TestTracerNameRoundTrip(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		name   string
+		tracer Tracer
+		labels []int
+	}{
+		{"legacy ipv4", Tracer{Version: TracerVersionLegacy, Key: 0x01020304, IP: net.ParseIP("192.0.2.1"), Timestamp: ts}, []int{56}},
+		{"legacy ipv6", Tracer{Version: TracerVersionLegacy, Key: 0xfffefdfc, IP: net.ParseIP("2001:db8::1"), Timestamp: ts}, []int{56}},
+		{"v1 ipv4", Tracer{Version: TracerVersion1, Key: 0x01020304, ProbeType: TracerProbeReferral, IP: net.ParseIP("192.0.2.1"), Timestamp: ts, ScanID: 0xa1b2c3d4, Sequence: 7}, []int{56, 20}},
+		{"v1 ipv6", Tracer{Version: TracerVersion1, Key: 0, ProbeType: TracerProbeSubnet, IP: net.ParseIP("2001:db8::1"), Timestamp: ts, ScanID: 1, Sequence: 0xffffffff}, []int{56, 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := EncodeTracerName("s0", &tt.tracer, "helper.example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(name, "s0") || !strings.HasSuffix(name, ".helper.example.") {
+				t.Fatalf("unexpected name %s", name)
+			}
+			labels := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "s0"), ".helper.example."), ".")
+			if len(labels) != len(tt.labels) {
+				t.Fatalf("got %d labels in %s, want %d", len(labels), name, len(tt.labels))
+			}
+			for i, label := range labels {
+				if len(label) != tt.labels[i] {
+					t.Errorf("label %d is %d characters, want %d", i, len(label), tt.labels[i])
+				}
+			}
+
+			// Resolvers may change the case of the name
+			tag, got, err := DecodeTracerName(strings.ToUpper(name), "helper.example.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag != "s0" {
+				t.Errorf("tag is %q", tag)
+			}
+			if got.Version != tt.tracer.Version || got.Key != tt.tracer.Key || got.ProbeType != tt.tracer.ProbeType ||
+				!got.IP.Equal(tt.tracer.IP) || !got.Timestamp.Equal(tt.tracer.Timestamp) ||
+				got.ScanID != tt.tracer.ScanID || got.Sequence != tt.tracer.Sequence {
+				t.Errorf("got %+v, want %+v", got, tt.tracer)
+			}
+		})
+	}
+}
+
+// TestTracerLayout checks the byte layout of each version with a zero key, which leaves the
+// payload unchanged
+func TestTracerLayout(t *testing.T) {
+	ts := time.Unix(0, 0x0102030405060708)
+	tests := []struct {
+		tracer Tracer
+		want   string
+	}{
+		{
+			Tracer{Version: TracerVersionLegacy, IP: net.ParseIP("192.0.2.1"), Timestamp: ts},
+			"00000000" + "00000000000000000000ffffc0000201" + "0102030405060708",
+		},
+		{
+			Tracer{Version: TracerVersion1, ProbeType: TracerProbeReflect, IP: net.ParseIP("192.0.2.1"), Timestamp: ts, ScanID: 0x0a0b0c0d, Sequence: 0x11121314},
+			"00000000" + "01" + "02" + "00000000000000000000ffffc0000201" + "0102030405060708" + "0a0b0c0d" + "11121314",
+		},
+	}
+	for _, tt := range tests {
+		raw, err := tt.tracer.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(raw); got != tt.want {
+			t.Errorf("version %d:\n got %s\nwant %s", tt.tracer.Version, got, tt.want)
+		}
+	}
+}
+
+// TestTracerDecodeVersions checks that decoding dispatches on the length and version byte, and
+// ignores bytes that a later version may append
+func TestTracerDecodeVersions(t *testing.T) {
+	v1 := "00000000" + "01" + "01" + "00000000000000000000ffffc0000201" + "0000000000000001" + "00000002" + "00000003"
+	tests := []struct {
+		name    string
+		raw     string
+		version uint8
+		err     string
+	}{
+		{"legacy", "00000000" + "00000000000000000000ffffc0000201" + "0000000000000001", TracerVersionLegacy, ""},
+		{"v1", v1, TracerVersion1, ""},
+		{"v1 extended", v1 + "ffff", TracerVersion1, ""},
+		{"v1 truncated", v1[:len(v1)-2], 0, "truncated"},
+		{"unknown version", "00000000" + "07" + strings.Repeat("00", 40), 0, "unsupported tracer version 7"},
+		{"key only", "00000000", 0, "truncated"},
+		{"empty", "", 0, "truncated"},
+	}
+	for _, tt := range tests {
+		raw, _ := hex.DecodeString(tt.raw)
+		var tr Tracer
+		err := tr.UnmarshalBinary(raw)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if tr.Version != tt.version || !tr.IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("%s: got version %d and address %s", tt.name, tr.Version, tr.IP)
+		}
+	}
+}
+
+// TestDecodeTracerNameInvalid checks the errors for names that are not tracers
+func TestDecodeTracerNameInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"s0abcd.other.example.", "not within"},
+		{"s.helper.example.", "too short"},
+		{"s0zz.helper.example.", "invalid tracer encoding"},
+		{"s0abc.helper.example.", "invalid tracer encoding"},
+		{"s000.helper.example.", "truncated"},
+	}
+	for _, tt := range tests {
+		if _, _, err := DecodeTracerName(tt.name, "helper.example"); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	if _, err := EncodeTracerName("s0", &Tracer{Version: 9, IP: net.ParseIP("192.0.2.1")}, "helper.example"); err == nil {
+		t.Errorf("unsupported version: expected an error")
+	}
+	if _, err := EncodeTracerName("s0", &Tracer{}, "helper.example"); err == nil {
+		t.Errorf("missing address: expected an error")
+	}
+}
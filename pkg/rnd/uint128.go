@@ -0,0 +1,137 @@
+package rnd
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"net/netip"
+)
+
+// uint128 is used for address arithmetic across both IPv4 and IPv6 ranges
+type uint128 struct {
+	hi uint64
+	lo uint64
+}
+
+// uint128FromAddr converts an address to an integer, using the IPv4-mapped form for IPv4
+func uint128FromAddr(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{
+		hi: binary.BigEndian.Uint64(b[0:8]),
+		lo: binary.BigEndian.Uint64(b[8:16]),
+	}
+}
+
+// addr converts the integer back to an address, unmapping IPv4-mapped addresses
+func (u uint128) addr() netip.Addr {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:16], u.lo)
+	addr := netip.AddrFrom16(b)
+	if u.isIPv4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// add64 returns u+v, wrapping on overflow
+func (u uint128) add64(v uint64) uint128 {
+	lo, carry := bits.Add64(u.lo, v, 0)
+	return uint128{hi: u.hi + carry, lo: lo}
+}
+
+// sub returns u-v, wrapping on underflow
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	return uint128{hi: u.hi - v.hi - borrow, lo: lo}
+}
+
+// add returns u+v, wrapping on overflow
+func (u uint128) add(v uint128) uint128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	return uint128{hi: u.hi + v.hi + carry, lo: lo}
+}
+
+// mul64 returns u*v, wrapping on overflow
+func (u uint128) mul64(v uint64) uint128 {
+	hi, lo := bits.Mul64(u.lo, v)
+	return uint128{hi: hi + u.hi*v, lo: lo}
+}
+
+// div64 returns u/v
+func (u uint128) div64(v uint64) uint128 {
+	hi, rem := u.hi/v, u.hi%v
+	lo, _ := bits.Div64(rem, u.lo, v)
+	return uint128{hi: hi, lo: lo}
+}
+
+// cmp returns -1, 0, or 1 depending on whether u is less than, equal to, or greater than v
+func (u uint128) cmp(v uint128) int {
+	switch {
+	case u.hi < v.hi:
+		return -1
+	case u.hi > v.hi:
+		return 1
+	case u.lo < v.lo:
+		return -1
+	case u.lo > v.lo:
+		return 1
+	}
+	return 0
+}
+
+// isMax returns true if every bit is set
+func (u uint128) isMax() bool {
+	return u.hi == ^uint64(0) && u.lo == ^uint64(0)
+}
+
+// bitLen returns the minimum number of bits required to represent u
+func (u uint128) bitLen() int {
+	if u.hi != 0 {
+		return 64 + bits.Len64(u.hi)
+	}
+	return bits.Len64(u.lo)
+}
+
+// trailingZeros returns the number of trailing zero bits, which is 128 for zero
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// big converts the integer to a big.Int
+func (u uint128) big() *big.Int {
+	v := new(big.Int).SetUint64(u.hi)
+	v.Lsh(v, 64)
+	return v.Or(v, new(big.Int).SetUint64(u.lo))
+}
+
+// isIPv4 returns true if the integer is an IPv4-mapped address
+func (u uint128) isIPv4() bool {
+	return u.hi == 0 && u.lo>>32 == 0xffff
+}
+
+// and returns the bitwise AND of u and v
+func (u uint128) and(v uint128) uint128 {
+	return uint128{hi: u.hi & v.hi, lo: u.lo & v.lo}
+}
+
+// or returns the bitwise OR of u and v
+func (u uint128) or(v uint128) uint128 {
+	return uint128{hi: u.hi | v.hi, lo: u.lo | v.lo}
+}
+
+// hostMask128 returns a mask with the low n bits set
+func hostMask128(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{lo: (1 << uint(n)) - 1}
+	case n < 128:
+		return uint128{hi: (1 << uint(n-64)) - 1, lo: ^uint64(0)}
+	}
+	return uint128{hi: ^uint64(0), lo: ^uint64(0)}
+}